@@ -4,6 +4,7 @@ go 1.21.3
 
 require (
 	github.com/PuerkitoBio/goquery v1.8.1
+	github.com/andybalholm/brotli v1.1.0
 	github.com/google/uuid v1.4.0
 	gorm.io/driver/postgres v1.5.4
 	gorm.io/gorm v1.25.5
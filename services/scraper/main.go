@@ -1,31 +1,251 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/blob"
+	"go-find-pepe/pkg/classifier"
+	"go-find-pepe/pkg/constants"
 	"go-find-pepe/pkg/db"
 	"go-find-pepe/pkg/environment"
+	"go-find-pepe/pkg/limit"
+	"go-find-pepe/pkg/metrics"
+	"go-find-pepe/pkg/retry"
+	"go-find-pepe/pkg/scope"
 	"go-find-pepe/pkg/scraper"
+	"go-find-pepe/pkg/taxonomy"
 	"go-find-pepe/pkg/utils"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 func main() {
+	ctx := context.Background()
+
+	dbEnv, err := environment.ReadDb()
+	utils.Check(err)
+
+	dbConnection := db.Connect(dbEnv)
+
+	if len(os.Args) > 2 && os.Args[1] == "history" {
+		printHistory(ctx, dbConnection, os.Args[2])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "runs" {
+		printRuns(ctx, dbConnection, os.Args[2:])
+		return
+	}
+
 	scraperEnv, err := environment.ReadScraper()
 	utils.Check(err)
 
-	dbEnv, err := environment.ReadDb()
+	blobEnv, err := environment.ReadBlob()
+	utils.Check(err)
+
+	classifierEnv, err := environment.ReadClassifier()
+	utils.Check(err)
+
+	categories, err := taxonomy.Parse(scraperEnv.Taxonomy)
+	utils.Check(err)
+
+	crawlScope, err := scope.Parse(scraperEnv.Scope)
+	utils.Check(err)
+
+	pageTypeLimits, err := scraper.ParsePageTypeLimits(scraperEnv.PageTypeLimits)
+	utils.Check(err)
+
+	boardQuotas, err := scraper.ParseBoardQuotas(scraperEnv.BoardQuotas)
+	utils.Check(err)
+
+	retryPolicies, err := retry.Parse(scraperEnv.RetryPolicies, retry.Default())
+	utils.Check(err)
+
+	hostRates, err := limit.ParseRates(scraperEnv.HostRateLimits)
 	utils.Check(err)
+	hostRates = hostRates.Share(int(scraperEnv.RateLimitReplicas))
+
+	ctx = shutdownOnSignal(ctx)
 
-	var allowedHrefSubstrings = []string{"4channel.org"}
-	// var allowedHrefSubstrings = []string{"4chan.org", "4channel.org"}
-	var requiredHrefSubstrings = []string{"https", "boards."}
-	var allowedImageTypes = []string{".jpg", ".gif", ".png"}
+	var runLock *db.RunLock
+	if scraperEnv.RunLockPolicy != constants.RUN_LOCK_NONE {
+		hostname, _ := os.Hostname()
+		runLock, err = dbConnection.AcquireRunLock(ctx, db.RunLockArguments{
+			Name:       "scraper",
+			Policy:     scraperEnv.RunLockPolicy,
+			Wait:       scraperEnv.RunLockWait,
+			StaleAfter: scraperEnv.RunLockStaleAfter,
+			Holder:     fmt.Sprintf("%v-%v", hostname, os.Getpid()),
+		})
+		if errors.Is(err, db.ErrRunLocked) {
+			recordSkippedRun(ctx, dbConnection, scraperEnv.RunLockPolicy)
+			exit(constants.RUN_SKIPPED, scraperEnv.RunLockPolicy, false)
+		}
+		if ctx.Err() != nil {
+			exit(constants.RUN_INTERRUPTED, scraperEnv.RunLockPolicy, false)
+		}
+		utils.Check(err)
+	}
 
-	scraper := scraper.NewScraper(scraper.NewScraperArguments{
-		AllowedHrefSubstrings:  allowedHrefSubstrings,
-		RequiredHrefSubstrings: requiredHrefSubstrings,
-		AllowedImageTypes:      allowedImageTypes,
-		ScraperEnv:             *scraperEnv,
-		DbConnection:           db.Connect(dbEnv),
+	registry := metrics.NewRegistry()
+	if scraperEnv.MetricsAddr != "" {
+		registry.Serve(scraperEnv.MetricsAddr)
+	}
+
+	fetcher := scraper.NewFetcher(scraper.FetcherArguments{
+		MaxIdleConnsPerHost:   scraperEnv.MaxIdleConnsPerHost,
+		DialTimeout:           scraperEnv.DialTimeout,
+		TLSHandshakeTimeout:   scraperEnv.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: scraperEnv.ResponseHeaderTimeout,
+		RequestTimeout:        scraperEnv.RequestTimeout,
+		MaxResponseBytes:      scraperEnv.MaxResponseBytes,
+		RetryPolicies:         retryPolicies,
+		HostRates:             hostRates,
+		Metrics:               registry,
+	})
+
+	scraper, err := scraper.NewScraper(ctx, scraper.NewScraperArguments{
+		ScraperEnv:      *scraperEnv,
+		DbConnection:    dbConnection,
+		BlobStore:       blob.Connect(blobEnv),
+		Classifier:      classifier.Connect(classifierEnv, fetcher.Client()),
+		ClassifierModel: classifierEnv.Model,
+		Taxonomy:        categories,
+		Scope:           crawlScope,
+		PageTypeLimits:  pageTypeLimits,
+		BoardQuotas:     boardQuotas,
+		Fetcher:         fetcher,
+		RetryPolicies:   retryPolicies,
+		HostRates:       hostRates,
+		Metrics:         registry,
 	})
+	if ctx.Err() != nil {
+		exit(constants.RUN_INTERRUPTED, scraperEnv.RunLockPolicy, false)
+	}
+	utils.Check(err)
+
+	if len(os.Args) > 1 && os.Args[1] == "reclassify" {
+		scraper.Reclassify(ctx)
+	} else {
+		scraper.Start(ctx)
+	}
+
+	status := constants.RUN_COMPLETED
+	if ctx.Err() != nil {
+		status = constants.RUN_INTERRUPTED
+	}
+
+	// the run is recorded even when it was interrupted
+	scraper.Finish(context.WithoutCancel(ctx), status)
+
+	tookOver := false
+	if runLock != nil {
+		tookOver = runLock.TookOver
+		runLock.Release()
+	}
+	exit(status, scraperEnv.RunLockPolicy, tookOver)
+}
+
+// shutdownOnSignal returns a context that is cancelled on the first SIGINT or
+// SIGTERM, which stops the run gracefully; a second signal exits immediately
+func shutdownOnSignal(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		s := <-signals
+		fmt.Printf("Received %v; shutting down\n", s)
+		cancel()
+
+		s = <-signals
+		fmt.Printf("Received %v again; exiting immediately\n", s)
+		os.Exit(130)
+	}()
+
+	return ctx
+}
+
+// exit reports the status of the run and exits; skipped runs exit with EX_TEMPFAIL
+// and interrupted runs with 130, as a shell reports an interrupted command, so
+// the scheduler can tell them apart
+func exit(status string, runLockPolicy string, tookOver bool) {
+	fmt.Printf("Run %v; run lock policy: %v; took over stale lock: %v\n", status, runLockPolicy, tookOver)
+
+	switch status {
+	case constants.RUN_COMPLETED:
+		os.Exit(0)
+	case constants.RUN_INTERRUPTED:
+		os.Exit(130)
+	default:
+		os.Exit(75)
+	}
+}
+
+// recordSkippedRun records a run that did not start because another run held the run lock
+func recordSkippedRun(ctx context.Context, dbConnection *db.DbConnection, runLockPolicy string) {
+	tx := dbConnection.InitRun().CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	now := time.Now()
+	_, err := tx.Create(db.NewRun{
+		StartedAt:  now,
+		FinishedAt: &now,
+		SeedHrefs:  "[]",
+		Config:     fmt.Sprintf(`{"RunLockPolicy":%q}`, runLockPolicy),
+		ExitReason: constants.RUN_SKIPPED,
+	})
+	utils.Check(err)
+}
+
+// printRuns prints the latest runs; args optionally holds how many
+func printRuns(ctx context.Context, dbConnection *db.DbConnection, args []string) {
+	limit := 20
+	if len(args) > 0 {
+		l, err := strconv.Atoi(args[0])
+		utils.Check(err)
+		limit = l
+	}
+
+	tx := dbConnection.InitRun().CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	runs, err := tx.FindLatest(limit)
+	utils.Check(err)
+
+	if len(runs) == 0 {
+		fmt.Println("No runs recorded")
+		return
+	}
+
+	for i := range runs {
+		scraper.PrintRunSummary(&runs[i])
+	}
+}
+
+// printHistory prints how the category of an image changed over time
+func printHistory(ctx context.Context, dbConnection *db.DbConnection, rawId string) {
+	id, err := strconv.ParseUint(rawId, 10, 64)
+	utils.Check(err)
+
+	tx := dbConnection.InitImage().CreateImageTransaction(ctx)
+	defer tx.Deferral()
+
+	changes, err := tx.FindCategoryChanges(uint(id))
+	utils.Check(err)
+
+	if len(changes) == 0 {
+		fmt.Printf("Image %v has not been classified\n", id)
+		return
+	}
 
-	scraper.Start("https://boards.4channel.org/g/")
+	for _, c := range changes {
+		fmt.Printf("%v: %v -> %v; score: %v; model: %v; source: %v\n",
+			c.CreatedAt.UTC().Format(time.RFC3339), c.From, c.Category, c.Score, c.Model, c.Source)
+	}
 }
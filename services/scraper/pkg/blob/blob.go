@@ -0,0 +1,53 @@
+package blob
+
+import (
+	"errors"
+	"go-find-pepe/pkg/environment"
+	"go-find-pepe/pkg/utils"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Info describes a stored object; Key is relative to the root of the store and
+// always uses forward slashes regardless of the backend
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore persists objects by key so that the scraper does not depend on a
+// shared filesystem
+type BlobStore interface {
+	// Put stores r under key; size may be -1 if unknown
+	Put(key string, r io.Reader, size int64) error
+	// Get, Stat and Delete return ErrNotFound if nothing is stored under key
+	Get(key string) (io.ReadCloser, error)
+	Stat(key string) (*Info, error)
+	Delete(key string) error
+	// List calls cb for every object whose key starts with prefix
+	List(prefix string, cb func(Info)) error
+}
+
+// Connect creates the BlobStore configured by env
+func Connect(env *environment.BlobEnv) BlobStore {
+	if env.Backend == "s3" {
+		store, err := NewS3(S3Arguments{
+			Endpoint:        env.Endpoint,
+			Region:          env.Region,
+			Bucket:          env.Bucket,
+			AccessKeyId:     env.AccessKeyId,
+			SecretAccessKey: env.SecretAccessKey,
+			UsePathStyle:    env.UsePathStyle,
+		})
+		utils.Check(err)
+		return store
+	}
+
+	root, err := filepath.Abs(env.LocalRoot)
+	utils.Check(err)
+	return NewLocal(root)
+}
@@ -0,0 +1,169 @@
+package blob
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory S3 server of a single bucket, addressed path-style
+type fakeS3 struct {
+	bucket  string
+	m       sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	key := strings.TrimPrefix(path, "/")
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	switch {
+	case r.Method == "GET" && key == "" && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == "PUT":
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+	case r.Method == "GET" || r.Method == "HEAD":
+		body, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method == "GET" {
+			w.Write(body)
+		}
+	case r.Method == "DELETE":
+		// like S3, a missing key is no error
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	result := s3ListResult{}
+	for key, body := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{Key: key, Size: int64(len(body)), LastModified: time.Now().UTC()})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newFakeS3(t *testing.T) BlobStore {
+	server := httptest.NewServer(&fakeS3{bucket: "pepe", objects: map[string][]byte{}})
+	t.Cleanup(server.Close)
+
+	store, err := NewS3(S3Arguments{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          "pepe",
+		AccessKeyId:     "key",
+		SecretAccessKey: "secret",
+		UsePathStyle:    true,
+		Client:          server.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestContract runs the same expectations against every backend
+func TestContract(t *testing.T) {
+	backends := map[string]func(t *testing.T) BlobStore{
+		"local": func(t *testing.T) BlobStore { return NewLocal(t.TempDir()) },
+		"s3":    newFakeS3,
+	}
+
+	for name, newStore := range backends {
+		t.Run(name, func(t *testing.T) {
+			testContract(t, newStore(t))
+		})
+	}
+}
+
+func testContract(t *testing.T, store BlobStore) {
+	content := "pepe"
+	err := store.Put("images/pepe/a.png", strings.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	err = store.Put("images/other/b.png", strings.NewReader("other"), -1)
+	if err != nil {
+		t.Fatalf("put of unknown size: %v", err)
+	}
+
+	r, err := store.Get("images/pepe/a.png")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if string(got) != content {
+		t.Errorf("got %q; want %q", got, content)
+	}
+
+	info, err := store.Stat("images/pepe/a.png")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Key != "images/pepe/a.png" || info.Size != int64(len(content)) {
+		t.Errorf("stat got %+v", info)
+	}
+
+	keys := []string{}
+	err = store.List("images/", func(i Info) { keys = append(keys, i.Key) })
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "images/other/b.png,images/pepe/a.png" {
+		t.Errorf("listed %v", keys)
+	}
+
+	keys = []string{}
+	store.List("images/pepe/", func(i Info) { keys = append(keys, i.Key) })
+	if len(keys) != 1 || keys[0] != "images/pepe/a.png" {
+		t.Errorf("listed %v of prefix images/pepe/", keys)
+	}
+
+	err = store.Delete("images/pepe/a.png")
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if _, err := store.Get("images/pepe/a.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get of deleted key returned %v; want ErrNotFound", err)
+	}
+	if _, err := store.Stat("images/pepe/a.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat of deleted key returned %v; want ErrNotFound", err)
+	}
+	if err := store.Delete("images/pepe/a.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("delete of missing key returned %v; want ErrNotFound", err)
+	}
+}
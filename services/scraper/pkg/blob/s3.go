@@ -0,0 +1,285 @@
+package blob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+type S3Arguments struct {
+	// Endpoint including scheme, e.g. http://minio:9000
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyId     string
+	SecretAccessKey string
+	// UsePathStyle addresses the bucket as endpoint/bucket instead of bucket.endpoint;
+	// required by most self-hosted S3-compatible servers such as MinIO
+	UsePathStyle bool
+	Client       *http.Client
+}
+
+type s3 struct {
+	S3Arguments
+	endpoint *url.URL
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func NewS3(arg S3Arguments) (BlobStore, error) {
+	endpoint, err := url.Parse(arg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint must include scheme and host; got %v", arg.Endpoint)
+	}
+
+	if arg.Client == nil {
+		arg.Client = &http.Client{}
+	}
+
+	return &s3{S3Arguments: arg, endpoint: endpoint}, nil
+}
+
+func (s *s3) Put(key string, r io.Reader, size int64) error {
+	response, err := s.do("PUT", key, nil, r, size)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return s.checkResponse(response, "PUT", key)
+}
+
+func (s *s3) Get(key string) (io.ReadCloser, error) {
+	response, err := s.do("GET", key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkResponse(response, "GET", key)
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+
+	return response.Body, nil
+}
+
+func (s *s3) Stat(key string) (*Info, error) {
+	response, err := s.do("HEAD", key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	err = s.checkResponse(response, "HEAD", key)
+	if err != nil {
+		return nil, err
+	}
+
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	return &Info{Key: key, Size: response.ContentLength, ModTime: modTime}, nil
+}
+
+// Delete checks that key exists first, as S3 answers 204 for a missing key too
+func (s *s3) Delete(key string) error {
+	_, err := s.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.do("DELETE", key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return s.checkResponse(response, "DELETE", key)
+}
+
+func (s *s3) List(prefix string, cb func(Info)) error {
+	continuationToken := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		response, err := s.do("GET", "", query, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		err = s.checkResponse(response, "LIST", prefix)
+		if err != nil {
+			response.Body.Close()
+			return err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, c := range result.Contents {
+			cb(Info{Key: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *s3) checkResponse(response *http.Response, op string, key string) error {
+	if response.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("s3 %v %v failed with %v: %s", op, key, response.StatusCode, body)
+	}
+
+	return nil
+}
+
+// do sends a request signed with AWS signature version 4
+func (s *s3) do(method string, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	host := s.endpoint.Host
+	path := strings.TrimSuffix(s.endpoint.EscapedPath(), "/")
+	if s.UsePathStyle {
+		path += "/" + uriEncode(s.Bucket, true)
+	} else {
+		host = s.Bucket + "." + host
+	}
+	if key != "" || !s.UsePathStyle {
+		path += "/" + uriEncode(key, false)
+	}
+
+	canonicalQuery := canonicalQueryString(query)
+	rawUrl := fmt.Sprintf("%v://%v%v", s.endpoint.Scheme, host, path)
+	if canonicalQuery != "" {
+		rawUrl += "?" + canonicalQuery
+	}
+
+	req, err := http.NewRequest(method, rawUrl, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil && size >= 0 {
+		req.ContentLength = size
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", s3UnsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%v\nx-amz-content-sha256:%v\nx-amz-date:%v\n", req.URL.Host, s3UnsignedPayload, amzDate)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		req.URL.EscapedPath(),
+		canonicalQuery,
+		canonicalHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, s.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSha256([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+s.SecretAccessKey), date)
+	signingKey = hmacSha256(signingKey, s.Region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.AccessKeyId, scope, signedHeaders, signature))
+
+	return s.Client.Do(req)
+}
+
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes s as required by signature version 4; slashes are kept
+// unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSha256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
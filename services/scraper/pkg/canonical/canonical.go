@@ -0,0 +1,130 @@
+package canonical
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrUnsupportedScheme is returned for urls that cannot be fetched, such as
+// javascript: or mailto: links
+var ErrUnsupportedScheme = errors.New("unsupported scheme")
+
+// Canonicalizer turns every spelling of a url into one canonical url, so the
+// canonical url can be used as dedup key
+type Canonicalizer struct {
+	// HostEquivalents maps a host, and its subdomains, onto the host it is
+	// canonicalized to; the longest matching host wins
+	HostEquivalents map[string]string
+	// TrackingParameters are removed from the query; a trailing * matches any suffix
+	TrackingParameters []string
+}
+
+// Default maps the 4chan domains onto one another and strips the common tracking parameters
+func Default() *Canonicalizer {
+	return &Canonicalizer{
+		HostEquivalents: map[string]string{
+			"4channel.org":  "4chan.org",
+			"is2.4chan.org": "i.4cdn.org",
+		},
+		TrackingParameters: []string{"utm_*", "fbclid", "gclid", "mc_cid", "mc_eid", "ref_src"},
+	}
+}
+
+// Resolve resolves href, as found on the page at base, and canonicalizes the result
+func (c *Canonicalizer) Resolve(base string, href string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "", err
+	}
+
+	return c.canonicalize(b.ResolveReference(ref))
+}
+
+// Canonicalize canonicalizes the absolute url raw; urls without scheme, such
+// as //i.4cdn.org/g/1.jpg, are taken to be https
+func (c *Canonicalizer) Canonicalize(raw string) (string, error) {
+	return c.Resolve("https:", raw)
+}
+
+func (c *Canonicalizer) canonicalize(u *url.URL) (string, error) {
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%w %v", ErrUnsupportedScheme, u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", fmt.Errorf("url %v has no host", u)
+	}
+	host = c.equivalentHost(host)
+
+	port := u.Port()
+	if (u.Scheme == "https" && port == "443") || (u.Scheme == "http" && port == "80") {
+		port = ""
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	u.User = nil
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	if u.Path == "" {
+		u.Path = "/"
+	} else if len(u.Path) > 1 {
+		u.Path = strings.TrimRight(u.Path, "/")
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+	u.RawPath = ""
+
+	query := u.Query()
+	for key := range query {
+		if c.isTrackingParameter(key) {
+			query.Del(key)
+		}
+	}
+	// Encode sorts by key
+	u.RawQuery = query.Encode()
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+func (c *Canonicalizer) equivalentHost(host string) string {
+	match := ""
+	for equivalent := range c.HostEquivalents {
+		if (host == equivalent || strings.HasSuffix(host, "."+equivalent)) && len(equivalent) > len(match) {
+			match = equivalent
+		}
+	}
+
+	if match == "" {
+		return host
+	}
+	return strings.TrimSuffix(host, match) + c.HostEquivalents[match]
+}
+
+func (c *Canonicalizer) isTrackingParameter(key string) bool {
+	key = strings.ToLower(key)
+	for _, parameter := range c.TrackingParameters {
+		if prefix, ok := strings.CutSuffix(parameter, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == parameter {
+			return true
+		}
+	}
+	return false
+}
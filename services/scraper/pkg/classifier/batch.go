@@ -0,0 +1,60 @@
+package classifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrBatchUnsupported is returned when the backend cannot classify several files in one request
+var ErrBatchUnsupported = errors.New("batch unsupported")
+
+type BatchClassifier interface {
+	Classifier
+	// ClassifyBatch returns one result per blob in the same order
+	ClassifyBatch(ctx context.Context, blobs []Blob) ([]Result, error)
+}
+
+// ClassifyBatch classifies all blobs in one request if c supports it; otherwise, or
+// if the batch failed because of one of its files, every blob is classified on its own
+func ClassifyBatch(ctx context.Context, c Classifier, blobs []Blob) ([]Result, []error) {
+	results := make([]Result, len(blobs))
+	errs := make([]error, len(blobs))
+	if len(blobs) == 0 {
+		return results, errs
+	}
+
+	if bc, ok := c.(BatchClassifier); ok && len(blobs) > 1 {
+		batchResults, err := bc.ClassifyBatch(ctx, blobs)
+		if err == nil && len(batchResults) == len(blobs) {
+			return batchResults, errs
+		}
+
+		if err == nil {
+			err = fmt.Errorf("%w; got %v results for %v files", ErrBatchUnsupported, len(batchResults), len(blobs))
+		}
+
+		if !errors.Is(err, ErrBatchUnsupported) && !errors.Is(err, ErrFaultyFile) && !rejected(err) {
+			for i := range errs {
+				errs[i] = err
+			}
+			return results, errs
+		}
+
+		fmt.Printf("Batch of %v not classified; %v; falling back to single requests\n", len(blobs), err)
+	}
+
+	for i, blob := range blobs {
+		results[i], errs[i] = c.Classify(ctx, blob)
+	}
+
+	return results, errs
+}
+
+// rejected returns whether err is a 4xx response other than 429, with which the
+// backend rejects a whole batch for one of its files
+func rejected(err error) bool {
+	var status *StatusError
+	return errors.As(err, &status) && status.Code >= 400 && status.Code < 500 && status.Code != http.StatusTooManyRequests
+}
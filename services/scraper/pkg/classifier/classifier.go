@@ -0,0 +1,171 @@
+package classifier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/environment"
+	"go-find-pepe/pkg/retry"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrFaultyFile is returned when the backend could not process the file itself;
+// retrying will not help
+var ErrFaultyFile = errors.New("faulty file")
+
+// StatusError is returned for a response of the backend with another status than
+// 200, or 500 which results in ErrFaultyFile
+type StatusError struct {
+	Code int
+	Url  string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unsuccessful response %v", e.Code)
+}
+
+// ModelHeader is the response header a backend may use to report its model version
+const ModelHeader = "X-Model-Version"
+
+// Blob is the file to be classified
+type Blob struct {
+	Name string
+	Data []byte
+}
+
+// DefaultLabel is the label of backends that only respond with a single score
+const DefaultLabel = "pepe"
+
+type Result struct {
+	// probability per label of the image being of that label; between 0 and 1
+	Scores map[string]float32
+	// identifier of the model that produced Scores; empty if unknown
+	Model string
+}
+
+type Classifier interface {
+	Classify(ctx context.Context, blob Blob) (Result, error)
+	Health(ctx context.Context) error
+}
+
+// Doer sends http requests; satisfied by *http.Client
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// send does the request, retrying temporary failures by policy; a 500 response is
+// assumed to be caused by the file and is not retried unless policy says so
+func send(ctx context.Context, client Doer, policy retry.Policy, method string, url string, contentType string, body []byte) ([]byte, http.Header, error) {
+	attempt := func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		response, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// read within the attempt so a connection lost halfway through the body is retried
+		data, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		response.Body = io.NopCloser(bytes.NewReader(data))
+		return response, nil
+	}
+
+	response, err := policy.Do(ctx, attempt, func(attempt int, wait time.Duration, reason string) {
+		fmt.Printf("Retrying %v %v after %v; attempt %v failed with %v\n", method, url, wait, attempt, reason)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to %v %v; %w", method, url, err)
+	}
+
+	data, _ := io.ReadAll(response.Body)
+
+	if response.StatusCode == http.StatusInternalServerError {
+		return nil, nil, ErrFaultyFile
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to %v %v; %w", method, url, &StatusError{Code: response.StatusCode, Url: url})
+	}
+
+	return data, response.Header, nil
+}
+
+// modelOf prefers the model reported in the response body, then the header and
+// lastly the configured model
+func modelOf(field string, header http.Header, configured string) string {
+	if field != "" {
+		return field
+	}
+
+	if model := header.Get(ModelHeader); model != "" {
+		return model
+	}
+
+	return configured
+}
+
+func health(ctx context.Context, client Doer, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("health of %v returned %v", url, response.StatusCode)
+	}
+
+	return nil
+}
+
+// Connect creates the Classifier configured by env, which sends its requests
+// through client
+func Connect(env *environment.ClassifierEnv, client Doer) Classifier {
+	if env.Backend != "ensemble" {
+		return newBackend(env, env.Backend, client)
+	}
+
+	classifiers := make([]Classifier, 0, len(env.Ensemble))
+	for _, backend := range env.Ensemble {
+		classifiers = append(classifiers, newBackend(env, backend, client))
+	}
+
+	return NewEnsemble(classifiers...)
+}
+
+func newBackend(env *environment.ClassifierEnv, backend string, client Doer) Classifier {
+	policy, err := retry.ParsePolicy(env.RetryPolicy, retry.Service())
+	if err != nil {
+		panic(fmt.Errorf("invalid classifier retry policy; %w", err))
+	}
+
+	switch backend {
+	case "http":
+		return NewHttp(env.VisionApiUrl, env.Model, client, policy)
+	case "json":
+		return NewJson(env.JsonApiUrl, env.Model, client, policy)
+	case "fake":
+		return NewFake()
+	default:
+		panic(fmt.Errorf("unknown classifier backend %v", backend))
+	}
+}
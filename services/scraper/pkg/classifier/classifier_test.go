@@ -0,0 +1,31 @@
+package classifier
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestModelOf(t *testing.T) {
+	tests := []struct {
+		field      string
+		header     string
+		configured string
+		want       string
+	}{
+		{"body", "header", "configured", "body"},
+		{"", "header", "configured", "header"},
+		{"", "", "configured", "configured"},
+		{"", "", "", ""},
+	}
+
+	for _, test := range tests {
+		header := http.Header{}
+		if test.header != "" {
+			header.Set(ModelHeader, test.header)
+		}
+
+		if got := modelOf(test.field, header, test.configured); got != test.want {
+			t.Errorf("%+v: got %v, want %v", test, got, test.want)
+		}
+	}
+}
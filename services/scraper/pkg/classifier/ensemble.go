@@ -0,0 +1,68 @@
+package classifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type ensemble struct {
+	classifiers []Classifier
+}
+
+// NewEnsemble classifies with every classifier concurrently and averages the
+// scores per label; a label missing from a result counts as 0
+func NewEnsemble(classifiers ...Classifier) Classifier {
+	return &ensemble{classifiers: classifiers}
+}
+
+func (c *ensemble) Classify(ctx context.Context, blob Blob) (Result, error) {
+	if len(c.classifiers) == 0 {
+		return Result{}, errors.New("ensemble without classifiers")
+	}
+
+	results := make([]Result, len(c.classifiers))
+	errs := make([]error, len(c.classifiers))
+
+	wg := sync.WaitGroup{}
+	for i, classifier := range c.classifiers {
+		wg.Add(1)
+		go func(i int, classifier Classifier) {
+			defer wg.Done()
+			results[i], errs[i] = classifier.Classify(ctx, blob)
+		}(i, classifier)
+	}
+	wg.Wait()
+
+	sums := map[string]float32{}
+	models := make([]string, len(results))
+	for i := range results {
+		if errs[i] != nil {
+			return Result{}, errs[i]
+		}
+		for label, score := range results[i].Scores {
+			sums[label] += score
+		}
+		models[i] = results[i].Model
+	}
+
+	for label := range sums {
+		sums[label] /= float32(len(results))
+	}
+
+	return Result{
+		Scores: sums,
+		Model:  fmt.Sprintf("ensemble(%v)", strings.Join(models, ",")),
+	}, nil
+}
+
+func (c *ensemble) Health(ctx context.Context) error {
+	for _, classifier := range c.classifiers {
+		if err := classifier.Health(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
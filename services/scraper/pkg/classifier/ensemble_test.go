@@ -0,0 +1,78 @@
+package classifier
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fixed classifies every file alike
+type fixed struct {
+	result Result
+	err    error
+}
+
+func (c *fixed) Classify(ctx context.Context, blob Blob) (Result, error) {
+	return c.result, c.err
+}
+
+func (c *fixed) Health(ctx context.Context) error {
+	return c.err
+}
+
+func TestEnsemble(t *testing.T) {
+	failed := errors.New("failed")
+	scored := func(model string, scores map[string]float32) *fixed {
+		return &fixed{result: Result{Scores: scores, Model: model}}
+	}
+
+	tests := []struct {
+		name        string
+		classifiers []Classifier
+		want        map[string]float32
+		wantModel   string
+		wantErr     error
+	}{
+		{"single", []Classifier{scored("a", map[string]float32{"pepe": 0.4})}, map[string]float32{"pepe": 0.4}, "ensemble(a)", nil},
+		{
+			"average",
+			[]Classifier{scored("a", map[string]float32{"pepe": 0.2}), scored("b", map[string]float32{"pepe": 0.6})},
+			map[string]float32{"pepe": 0.4},
+			"ensemble(a,b)",
+			nil,
+		},
+		{
+			"missing label counts as 0",
+			[]Classifier{scored("a", map[string]float32{"pepe": 0.2, "wojak": 0.8}), scored("b", map[string]float32{"pepe": 0.6})},
+			map[string]float32{"pepe": 0.4, "wojak": 0.4},
+			"ensemble(a,b)",
+			nil,
+		},
+		{"one fails", []Classifier{scored("a", map[string]float32{"pepe": 0.2}), &fixed{err: failed}}, nil, "", failed},
+		{"one faulty", []Classifier{&fixed{err: ErrFaultyFile}, scored("a", map[string]float32{"pepe": 0.2})}, nil, "", ErrFaultyFile},
+	}
+
+	for _, test := range tests {
+		result, err := NewEnsemble(test.classifiers...).Classify(context.Background(), Blob{Name: "a.png", Data: []byte("pepe")})
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%v: got error %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if len(result.Scores) != len(test.want) || result.Model != test.wantModel {
+			t.Errorf("%v: got %v of %v, want %v of %v", test.name, result.Scores, result.Model, test.want, test.wantModel)
+			continue
+		}
+		for label, want := range test.want {
+			if diff := result.Scores[label] - want; diff > 1e-6 || diff < -1e-6 {
+				t.Errorf("%v: got %v of %v, want %v of %v", test.name, result.Scores, result.Model, test.want, test.wantModel)
+			}
+		}
+	}
+
+	if _, err := NewEnsemble().Classify(context.Background(), Blob{}); err == nil {
+		t.Error("ensemble without classifiers classified")
+	}
+	if err := NewEnsemble(&fixed{}, &fixed{err: failed}).Health(context.Background()); !errors.Is(err, failed) {
+		t.Errorf("ensemble with an unhealthy classifier returned %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package classifier
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFakeScoresByContent(t *testing.T) {
+	c := NewFake()
+	ctx := context.Background()
+
+	a, err := c.Classify(ctx, Blob{Name: "a.png", Data: []byte("pepe")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := c.Classify(ctx, Blob{Name: "b.png", Data: []byte("pepe")})
+	other, _ := c.Classify(ctx, Blob{Name: "a.png", Data: []byte("not pepe")})
+
+	score := a.Scores[DefaultLabel]
+	if score < 0 || score > 1 {
+		t.Errorf("score %v is not between 0 and 1", score)
+	}
+	if again.Scores[DefaultLabel] != score {
+		t.Errorf("the same content scored %v and %v", score, again.Scores[DefaultLabel])
+	}
+	if other.Scores[DefaultLabel] == score {
+		t.Errorf("other content scored the same %v", score)
+	}
+	if a.Model != "fake" {
+		t.Errorf("model is %v; want fake", a.Model)
+	}
+}
+
+func TestFakeBatch(t *testing.T) {
+	blobs := []Blob{{Name: "a.png", Data: []byte("pepe")}, {Name: "empty.png"}, {Name: "c.png", Data: []byte("frog")}}
+
+	results, errs := ClassifyBatch(context.Background(), NewFake(), blobs)
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("classified with errors %v", errs)
+	}
+	if !errors.Is(errs[1], ErrFaultyFile) {
+		t.Errorf("empty file returned %v; want %v", errs[1], ErrFaultyFile)
+	}
+	if results[0].Scores[DefaultLabel] == results[2].Scores[DefaultLabel] {
+		t.Error("results are not in the order of the blobs")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewFake().Classify(ctx, blobs[0]); !errors.Is(err, context.Canceled) {
+		t.Errorf("classified after cancellation; %v", err)
+	}
+	if err := NewFake().Health(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("healthy after cancellation; %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package classifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/retry"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// FileKey is the multipart form key the vision service reads the image from
+const FileKey = "file"
+
+type httpClassifier struct {
+	url    string
+	model  string
+	client Doer
+	policy retry.Policy
+}
+
+// scoreResponse is either {"score": 0.9} for DefaultLabel or {"labels": {"pepe": 0.9, "wojak": 0.1}}
+type scoreResponse struct {
+	Score  *float32           `json:"score"`
+	Labels map[string]float32 `json:"labels"`
+	Model  string             `json:"model"`
+}
+
+// batchScoreResponse is either {"scores": [...]} or {"labels": [{...}, ...]}
+type batchScoreResponse struct {
+	Scores []float32            `json:"scores"`
+	Labels []map[string]float32 `json:"labels"`
+	Model  string               `json:"model"`
+}
+
+func (r *scoreResponse) scores() (map[string]float32, error) {
+	if r.Labels != nil {
+		return r.Labels, nil
+	}
+
+	if r.Score != nil {
+		return map[string]float32{DefaultLabel: *r.Score}, nil
+	}
+
+	return nil, errors.New("response has neither score nor labels")
+}
+
+func (r *batchScoreResponse) scores() ([]map[string]float32, error) {
+	if r.Labels != nil {
+		return r.Labels, nil
+	}
+
+	if r.Scores != nil {
+		scores := make([]map[string]float32, len(r.Scores))
+		for i, score := range r.Scores {
+			scores[i] = map[string]float32{DefaultLabel: score}
+		}
+		return scores, nil
+	}
+
+	return nil, errors.New("response has neither scores nor labels")
+}
+
+// NewHttp classifies by posting the file as multipart form to url, the way
+// the vision service expects it; model is used if the response does not report one
+func NewHttp(url string, model string, client Doer, policy retry.Policy) Classifier {
+	return &httpClassifier{url: strings.TrimSuffix(url, "/"), model: model, client: client, policy: policy}
+}
+
+func (c *httpClassifier) Classify(ctx context.Context, blob Blob) (Result, error) {
+	body, contentType, err := createMultiPart([]Blob{blob})
+	if err != nil {
+		return Result{}, err
+	}
+
+	data, header, err := send(ctx, c.client, c.policy, "POST", c.url, contentType, body)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return parseScoreResponse(c.url, data, header, c.model)
+}
+
+// ClassifyBatch posts every blob as a "file" part of one multipart form; a vision
+// service supporting batches responds with {"scores": [...]} in the same order
+func (c *httpClassifier) ClassifyBatch(ctx context.Context, blobs []Blob) ([]Result, error) {
+	if len(blobs) == 0 {
+		return nil, nil
+	}
+
+	body, contentType, err := createMultiPart(blobs)
+	if err != nil {
+		return nil, err
+	}
+
+	data, header, err := send(ctx, c.client, c.policy, "POST", c.url, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var response batchScoreResponse
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return nil, ErrBatchUnsupported
+	}
+
+	scores, err := response.scores()
+	if err != nil {
+		// a service without batch support only classifies the first file
+		return nil, ErrBatchUnsupported
+	}
+
+	model := modelOf(response.Model, header, c.model)
+	results := make([]Result, len(scores))
+	for i := range scores {
+		results[i] = Result{Scores: scores[i], Model: model}
+	}
+
+	return results, nil
+}
+
+func (c *httpClassifier) Health(ctx context.Context) error {
+	return health(ctx, c.client, c.url+"/health")
+}
+
+func parseScoreResponse(url string, data []byte, header http.Header, model string) (Result, error) {
+	var response scoreResponse
+	err := json.Unmarshal(data, &response)
+	if err != nil {
+		return Result{}, fmt.Errorf("invalid response of %v; %w", url, err)
+	}
+
+	scores, err := response.scores()
+	if err != nil {
+		return Result{}, fmt.Errorf("invalid response of %v; %w", url, err)
+	}
+
+	return Result{Scores: scores, Model: modelOf(response.Model, header, model)}, nil
+}
+
+func createMultiPart(blobs []Blob) (body []byte, contentType string, err error) {
+	var b bytes.Buffer
+	writer := multipart.NewWriter(&b)
+
+	for _, blob := range blobs {
+		part, err := writer.CreateFormFile(FileKey, blob.Name)
+		if err != nil {
+			return nil, "", err
+		}
+
+		_, err = part.Write(blob.Data)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return b.Bytes(), writer.FormDataContentType(), nil
+}
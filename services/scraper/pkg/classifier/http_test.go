@@ -0,0 +1,213 @@
+package classifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-find-pepe/pkg/retry"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// visionServer responds like the vision service: {"score": ...} for one file and
+// {"scores": [...]} for several, scoring each file by the length of its content.
+// A file named bad.png rejects the whole request with 400; dropScore drops the last
+// score of a batch and legacy only scores the first file like a service without
+// batch support
+type visionServer struct {
+	dropScore bool
+	legacy    bool
+	m         sync.Mutex
+	// number of files per request
+	requests []int
+}
+
+func (v *visionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		return
+	}
+
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	files := r.MultipartForm.File[FileKey]
+
+	v.m.Lock()
+	v.requests = append(v.requests, len(files))
+	v.m.Unlock()
+
+	scores := []float32{}
+	for _, file := range files {
+		if file.Filename == "bad.png" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		scores = append(scores, float32(file.Size)/10)
+	}
+
+	if len(scores) == 1 || v.legacy {
+		json.NewEncoder(w).Encode(map[string]float32{"score": scores[0]})
+		return
+	}
+	if v.dropScore {
+		scores = scores[:len(scores)-1]
+	}
+	json.NewEncoder(w).Encode(map[string][]float32{"scores": scores})
+}
+
+func newVision(t *testing.T, v *visionServer) Classifier {
+	server := httptest.NewServer(v)
+	t.Cleanup(server.Close)
+
+	policy := retry.Service()
+	policy.BaseDelay = time.Millisecond
+	policy.MaxDelay = time.Millisecond
+	return NewHttp(server.URL, "v1", server.Client(), policy)
+}
+
+func TestClassifyBatchHttp(t *testing.T) {
+	blobs := []Blob{{Name: "a.png", Data: []byte("a")}, {Name: "b.png", Data: []byte("bb")}, {Name: "c.png", Data: []byte("ccc")}}
+	withBad := []Blob{blobs[0], {Name: "bad.png", Data: []byte("bad")}, blobs[2]}
+
+	tests := []struct {
+		name   string
+		server *visionServer
+		blobs  []Blob
+		// files per request the server received
+		requests []int
+		scores   []float32
+		failed   []bool
+	}{
+		{"batch", &visionServer{}, blobs, []int{3}, []float32{0.1, 0.2, 0.3}, []bool{false, false, false}},
+		{"count mismatch", &visionServer{dropScore: true}, blobs, []int{3, 1, 1, 1}, []float32{0.1, 0.2, 0.3}, []bool{false, false, false}},
+		{"without batch support", &visionServer{legacy: true}, blobs, []int{3, 1, 1, 1}, []float32{0.1, 0.2, 0.3}, []bool{false, false, false}},
+		{"rejected batch", &visionServer{}, withBad, []int{3, 1, 1, 1}, []float32{0.1, 0, 0.3}, []bool{false, true, false}},
+		{"single", &visionServer{}, blobs[:1], []int{1}, []float32{0.1}, []bool{false}},
+		{"empty", &visionServer{}, []Blob{}, nil, []float32{}, []bool{}},
+	}
+
+	for _, test := range tests {
+		results, errs := ClassifyBatch(context.Background(), newVision(t, test.server), test.blobs)
+
+		if len(test.server.requests) != len(test.requests) {
+			t.Errorf("%v: got requests of %v files, want %v", test.name, test.server.requests, test.requests)
+		} else {
+			for i := range test.requests {
+				if test.server.requests[i] != test.requests[i] {
+					t.Errorf("%v: got requests of %v files, want %v", test.name, test.server.requests, test.requests)
+					break
+				}
+			}
+		}
+
+		if len(results) != len(test.blobs) || len(errs) != len(test.blobs) {
+			t.Fatalf("%v: got %v results and %v errors for %v files", test.name, len(results), len(errs), len(test.blobs))
+		}
+		for i := range test.blobs {
+			if (errs[i] != nil) != test.failed[i] {
+				t.Errorf("%v: file %v failed with %v, want failed %v", test.name, i, errs[i], test.failed[i])
+				continue
+			}
+			if test.failed[i] {
+				var status *StatusError
+				if !errors.As(errs[i], &status) || status.Code != http.StatusBadRequest {
+					t.Errorf("%v: file %v failed with %v, want a 400 response", test.name, i, errs[i])
+				}
+				continue
+			}
+			if got := results[i].Scores[DefaultLabel]; got != test.scores[i] || results[i].Model != "v1" {
+				t.Errorf("%v: file %v got %v of %v, want %v of v1", test.name, i, got, results[i].Model, test.scores[i])
+			}
+		}
+	}
+}
+
+func TestRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{Code: http.StatusBadRequest}, true},
+		{&StatusError{Code: http.StatusUnsupportedMediaType}, true},
+		{&StatusError{Code: http.StatusTooManyRequests}, false},
+		{&StatusError{Code: http.StatusBadGateway}, false},
+		{errors.New("connection reset"), false},
+	}
+
+	for _, test := range tests {
+		if got := rejected(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestClassifyBatchOverloaded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	policy := retry.Service()
+	policy.MaxAttempts = 1
+	c := NewHttp(server.URL, "", server.Client(), policy)
+
+	blobs := []Blob{{Name: "a.png", Data: []byte("a")}, {Name: "b.png", Data: []byte("b")}}
+	_, errs := ClassifyBatch(context.Background(), c, blobs)
+	for i, err := range errs {
+		if err == nil || !strings.Contains(err.Error(), "429") {
+			t.Errorf("file %v failed with %v, want the 429 of the batch", i, err)
+		}
+	}
+}
+
+func TestHttpHealth(t *testing.T) {
+	if err := newVision(t, &visionServer{}).Health(context.Background()); err != nil {
+		t.Errorf("health returned %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	if err := NewHttp(server.URL, "", server.Client(), retry.Service()).Health(context.Background()); err == nil {
+		t.Error("unavailable service is healthy")
+	}
+}
+
+func TestParseScoreResponse(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    map[string]float32
+		wantErr bool
+	}{
+		{`{"score": 0.5}`, map[string]float32{DefaultLabel: 0.5}, false},
+		{`{"score": 0}`, map[string]float32{DefaultLabel: 0}, false},
+		{`{"labels": {"pepe": 0.9, "wojak": 0.1}}`, map[string]float32{"pepe": 0.9, "wojak": 0.1}, false},
+		{`{"score": 0.5, "labels": {"wojak": 0.1}}`, map[string]float32{"wojak": 0.1}, false},
+		{`{}`, nil, true},
+		{`not json`, nil, true},
+	}
+
+	for _, test := range tests {
+		result, err := parseScoreResponse("http://vision", []byte(test.data), http.Header{}, "v1")
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: got error %v, want error %v", test.data, err, test.wantErr)
+			continue
+		}
+		if len(result.Scores) != len(test.want) {
+			t.Errorf("%v: got %v, want %v", test.data, result.Scores, test.want)
+			continue
+		}
+		for label, score := range test.want {
+			if result.Scores[label] != score {
+				t.Errorf("%v: got %v, want %v", test.data, result.Scores, test.want)
+			}
+		}
+	}
+}
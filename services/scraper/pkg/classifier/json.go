@@ -0,0 +1,48 @@
+package classifier
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"go-find-pepe/pkg/retry"
+	"strings"
+)
+
+type jsonClassifier struct {
+	url    string
+	model  string
+	client Doer
+	policy retry.Policy
+}
+
+type jsonRequest struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// NewJson classifies by posting {"name": ..., "image": <base64>} to url; model
+// is used if the response does not report one
+func NewJson(url string, model string, client Doer, policy retry.Policy) Classifier {
+	return &jsonClassifier{url: strings.TrimSuffix(url, "/"), model: model, client: client, policy: policy}
+}
+
+func (c *jsonClassifier) Classify(ctx context.Context, blob Blob) (Result, error) {
+	body, err := json.Marshal(jsonRequest{
+		Name:  blob.Name,
+		Image: base64.StdEncoding.EncodeToString(blob.Data),
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	data, header, err := send(ctx, c.client, c.policy, "POST", c.url, "application/json", body)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return parseScoreResponse(c.url, data, header, c.model)
+}
+
+func (c *jsonClassifier) Health(ctx context.Context) error {
+	return health(ctx, c.client, c.url+"/health")
+}
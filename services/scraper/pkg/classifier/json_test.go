@@ -0,0 +1,30 @@
+package classifier
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"go-find-pepe/pkg/retry"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJsonClassify(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request jsonRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		data, _ := base64.StdEncoding.DecodeString(request.Image)
+		if err != nil || r.Header.Get("Content-Type") != "application/json" || request.Name != "a.png" || string(data) != "pepe" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"score": 0.25, "model": "v2"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	result, err := NewJson(server.URL, "v1", server.Client(), retry.Service()).Classify(context.Background(), Blob{Name: "a.png", Data: []byte("pepe")})
+	if err != nil || result.Scores[DefaultLabel] != 0.25 || result.Model != "v2" {
+		t.Errorf("got %v of %v, %v; want 0.25 of the reported model v2", result.Scores, result.Model, err)
+	}
+}
@@ -0,0 +1,5 @@
+package constants
+
+const SOURCE_MODEL = "model"
+const SOURCE_HUMAN = "human"
+const SOURCE_DEDUP = "dedup"
@@ -0,0 +1,6 @@
+package constants
+
+const FRONTIER_PENDING = "pending"
+const FRONTIER_LEASED = "leased"
+const FRONTIER_DONE = "done"
+const FRONTIER_FAILED = "failed"
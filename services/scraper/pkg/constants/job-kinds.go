@@ -0,0 +1,4 @@
+package constants
+
+const JOB_IMAGE_DOWNLOAD = "image-download"
+const JOB_CLASSIFY = "classify"
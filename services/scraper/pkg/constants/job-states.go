@@ -0,0 +1,6 @@
+package constants
+
+const JOB_PENDING = "pending"
+const JOB_LEASED = "leased"
+const JOB_DONE = "done"
+const JOB_FAILED = "failed"
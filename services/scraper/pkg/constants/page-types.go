@@ -0,0 +1,8 @@
+package constants
+
+// board index, including its numbered pages
+const PAGE_INDEX = "index"
+const PAGE_CATALOG = "catalog"
+const PAGE_THREAD = "thread"
+const PAGE_ARCHIVE = "archive"
+const PAGE_OTHER = "other"
@@ -0,0 +1,13 @@
+package constants
+
+// runs do not exclude each other; for replicas that share their work through the job tables
+const RUN_LOCK_NONE = "none"
+
+// give up when another run holds the run lock
+const RUN_LOCK_SKIP = "skip"
+
+// wait a limited time for another run to release the run lock
+const RUN_LOCK_WAIT = "wait"
+
+// take the run lock over when its holder stopped its heartbeat
+const RUN_LOCK_TAKEOVER_STALE = "takeover-stale"
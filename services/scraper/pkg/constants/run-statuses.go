@@ -0,0 +1,9 @@
+package constants
+
+const RUN_COMPLETED = "completed"
+
+// another run held the run lock
+const RUN_SKIPPED = "skipped"
+
+// the run was stopped by a signal before it completed
+const RUN_INTERRUPTED = "interrupted"
@@ -0,0 +1,10 @@
+package constants
+
+// shallower pages first
+const TRAVERSAL_BFS = "bfs"
+
+// deeper pages first
+const TRAVERSAL_DFS = "dfs"
+
+// threads with more images first
+const TRAVERSAL_BEST_FIRST = "best-first"
@@ -0,0 +1,13 @@
+package constants
+
+// threads of a board crawled, or walked through the api
+const USAGE_THREADS = "threads"
+
+// images of a board downloaded
+const USAGE_IMAGES = "images"
+
+// bytes transferred for a board
+const USAGE_BYTES = "bytes"
+
+// pages of a page type leased
+const USAGE_PAGES = "pages"
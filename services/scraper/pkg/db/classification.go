@@ -0,0 +1,85 @@
+package db
+
+import "gorm.io/gorm"
+
+// NewClassification is one decision about the category of an image; the images
+// row holds the latest decision
+type NewClassification struct {
+	ImageID uint `gorm:"index"`
+	Model   string
+	// score that decided Category
+	Score float32
+	// json object with the score per label as returned by the classifier
+	Labels   string
+	Category string
+	// one of constants.SOURCE_MODEL, constants.SOURCE_HUMAN or constants.SOURCE_DEDUP
+	Source string
+}
+
+type Classification struct {
+	gorm.Model
+	NewClassification
+}
+
+// CategoryChange is a moment the effective category of an image changed
+type CategoryChange struct {
+	From string
+	Classification
+}
+
+// Classify records c in the history and makes it the effective classification of the image
+func (t *imgTx) Classify(c NewClassification) (err error) {
+	r := t.tx.Create(&Classification{NewClassification: c})
+	if r.Error != nil {
+		return r.Error
+	}
+
+	r = t.tx.Model(&Image{}).Where("id = ?", c.ImageID).Updates(map[string]interface{}{
+		"category":       c.Category,
+		"classification": c.Score,
+		"model_version":  c.Model,
+	})
+	err = r.Error
+	return
+}
+
+// FindClassificationHistory returns every classification of the image, oldest first
+func (t *imgTx) FindClassificationHistory(imageID uint) (history []Classification, err error) {
+	r := t.tx.Where("image_id = ?", imageID).Order("created_at ASC, id ASC").Find(&history)
+	err = r.Error
+	return
+}
+
+// FindLatestClassification returns the classification that is effective for the image
+func (t *imgTx) FindLatestClassification(imageID uint) (c *Classification, err error) {
+	c = &Classification{}
+	r := t.tx.Where("image_id = ?", imageID).Order("created_at DESC, id DESC").Take(c)
+	err = r.Error
+	return
+}
+
+// FindCategoryChanges returns only the classifications that changed the category of the image
+func (t *imgTx) FindCategoryChanges(imageID uint) (changes []CategoryChange, err error) {
+	history, err := t.FindClassificationHistory(imageID)
+	if err != nil {
+		return
+	}
+
+	changes = categoryChanges(history)
+	return
+}
+
+// categoryChanges returns the classifications of history, oldest first, that changed the category
+func categoryChanges(history []Classification) (changes []CategoryChange) {
+	previous := ""
+	for _, c := range history {
+		if c.Category == previous {
+			continue
+		}
+
+		changes = append(changes, CategoryChange{From: previous, Classification: c})
+		previous = c.Category
+	}
+
+	return
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestCategoryChanges(t *testing.T) {
+	classification := func(category string, model string) Classification {
+		return Classification{NewClassification: NewClassification{Category: category, Model: model}}
+	}
+
+	tests := []struct {
+		name    string
+		history []Classification
+		// from and to of every change
+		want [][2]string
+	}{
+		{"unclassified", nil, nil},
+		{"once", []Classification{classification("pepe", "v1")}, [][2]string{{"", "pepe"}}},
+		{"same category again", []Classification{classification("pepe", "v1"), classification("pepe", "v2")}, [][2]string{{"", "pepe"}}},
+		{
+			"changed back",
+			[]Classification{classification("maybe", "v1"), classification("pepe", "v2"), classification("pepe", "v3"), classification("maybe", "v4")},
+			[][2]string{{"", "maybe"}, {"maybe", "pepe"}, {"pepe", "maybe"}},
+		},
+	}
+
+	for _, test := range tests {
+		changes := categoryChanges(test.history)
+		if len(changes) != len(test.want) {
+			t.Errorf("%v: got %v changes, want %v", test.name, len(changes), len(test.want))
+			continue
+		}
+		for i, change := range changes {
+			if change.From != test.want[i][0] || change.Category != test.want[i][1] {
+				t.Errorf("%v: change %v is %v -> %v, want %v -> %v", test.name, i, change.From, change.Category, test.want[i][0], test.want[i][1])
+			}
+		}
+	}
+
+	// a change keeps the classification that made it
+	changes := categoryChanges([]Classification{classification("pepe", "v1"), classification("pepe", "v2"), classification("maybe", "v3")})
+	if changes[0].NewClassification.Model != "v1" || changes[1].NewClassification.Model != "v3" {
+		t.Errorf("changes were made by %v and %v; want v1 and v3", changes[0].NewClassification.Model, changes[1].NewClassification.Model)
+	}
+}
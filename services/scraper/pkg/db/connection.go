@@ -21,6 +21,43 @@ func Connect(env *environment.DbEnv) *DbConnection {
 
 	db.AutoMigrate(&Image{})
 	db.AutoMigrate(&Html{})
+	db.AutoMigrate(&Sighting{})
+	db.AutoMigrate(&Classification{})
+	db.AutoMigrate(&Frontier{})
+	db.AutoMigrate(&Job{})
+	db.AutoMigrate(&RunLockHeartbeat{})
+	db.AutoMigrate(&Run{})
+	db.AutoMigrate(&RunUsage{})
+	db.AutoMigrate(&Migration{})
+
+	err = migrateOnce(db, "file-paths-to-keys", migrateFilePathsToKeys)
+	utils.Check(err)
+	err = migrateOnce(db, "canonical-urls", migrateCanonicalUrls)
+	utils.Check(err)
+	err = migrateOnce(db, "unique-sha256", migrateUniqueSha256)
+	utils.Check(err)
 
 	return &DbConnection{db: db}
 }
+
+// notIn returns a condition, starting with AND, that excludes values from column,
+// and its arguments; empty if there are no values. Rows of which column is NULL,
+// as stored before the column existed, are not excluded
+func notIn(column string, values []string) (string, []interface{}) {
+	if len(values) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("AND (%v IS NULL OR %v NOT IN ?)", column, column), []interface{}{values}
+}
+
+// migrateFilePathsToKeys rewrites absolute paths below the data directory, as
+// stored before the blob store existed, to blob store keys
+func migrateFilePathsToKeys(tx *gorm.DB) error {
+	for _, table := range []string{"images", "htmls"} {
+		err := tx.Exec(fmt.Sprintf(`UPDATE %v SET file_path = substring(file_path from '/data/(.*)$') WHERE file_path LIKE '/%%/data/%%'`, table)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
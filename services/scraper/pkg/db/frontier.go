@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"go-find-pepe/pkg/constants"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type NewFrontier struct {
+	Url string `gorm:"uniqueIndex"`
+	// higher priorities are leased first
+	Priority int `gorm:"index"`
+	// number of links followed from the seed
+	Depth int
+	// one of constants.PAGE_INDEX, PAGE_CATALOG, PAGE_THREAD, PAGE_ARCHIVE or PAGE_OTHER
+	PageType string `gorm:"index"`
+	Board    string `gorm:"index"`
+	// one of constants.FRONTIER_PENDING, FRONTIER_LEASED, FRONTIER_DONE or FRONTIER_FAILED
+	State    string `gorm:"index"`
+	Attempts int
+	// pending urls are not leased, and done urls are not enqueued again, before this moment
+	NextAttemptAt  time.Time `gorm:"index"`
+	DiscoveredFrom string
+	// worker holding the lease; the lease is abandoned once LeaseExpiresAt passed
+	LeasedBy       string
+	LeaseExpiresAt *time.Time `gorm:"index"`
+}
+
+type Frontier struct {
+	gorm.Model
+	NewFrontier
+}
+
+type frontierTx struct {
+	tx       *gorm.DB
+	Rollback func()
+	Commit   func()
+	Deferral func()
+}
+
+type FrontierDbConnection struct {
+	db *gorm.DB
+}
+
+func (c *DbConnection) InitFrontier() *FrontierDbConnection {
+	return &FrontierDbConnection{db: c.db}
+}
+
+func (c *FrontierDbConnection) CreateTransaction(ctx context.Context) *frontierTx {
+	tx := c.db.WithContext(ctx).Begin()
+
+	return &frontierTx{
+		tx:       tx,
+		Rollback: func() { tx.Rollback() },
+		Commit:   func() { tx.Commit() },
+		Deferral: func() {
+			if err := recover(); err != nil {
+				tx.Rollback()
+			} else {
+				tx.Commit()
+			}
+		},
+	}
+}
+
+// Enqueue adds urls that are not part of the frontier yet as pending; done urls
+// that are due for a revisit become pending again
+func (t *frontierTx) Enqueue(news []NewFrontier) (err error) {
+	now := time.Now()
+	seen := map[string]bool{}
+	frontiers := []Frontier{}
+	for _, new := range news {
+		// a url may only be affected once per statement
+		if seen[new.Url] {
+			continue
+		}
+		seen[new.Url] = true
+
+		new.State = constants.FRONTIER_PENDING
+		new.NextAttemptAt = now
+		frontiers = append(frontiers, Frontier{NewFrontier: new})
+	}
+
+	if len(frontiers) == 0 {
+		return
+	}
+
+	due := gorm.Expr("frontiers.state = ? AND frontiers.next_attempt_at <= ?", constants.FRONTIER_DONE, now)
+	r := t.tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "url"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"state":           gorm.Expr("CASE WHEN ? THEN ? ELSE frontiers.state END", due, constants.FRONTIER_PENDING),
+			"next_attempt_at": gorm.Expr("CASE WHEN ? THEN ? ELSE frontiers.next_attempt_at END", due, now),
+			// urls enqueued before boards were recorded get theirs
+			"board": gorm.Expr("excluded.board"),
+		}),
+	}).Create(&frontiers)
+	err = r.Error
+	return
+}
+
+// EnqueueSeed adds seed as pending at depth 0, even if it was crawled before
+func (t *frontierTx) EnqueueSeed(seed NewFrontier) (err error) {
+	seed.Depth = 0
+	seed.State = constants.FRONTIER_PENDING
+	seed.NextAttemptAt = time.Now()
+
+	r := t.tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "url"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"state":           gorm.Expr("CASE WHEN frontiers.state = ? THEN frontiers.state ELSE ? END", constants.FRONTIER_LEASED, constants.FRONTIER_PENDING),
+			"priority":        seed.Priority,
+			"page_type":       seed.PageType,
+			"board":           seed.Board,
+			"depth":           0,
+			"attempts":        0,
+			"next_attempt_at": seed.NextAttemptAt,
+			"deleted_at":      nil,
+		}),
+	}).Create(&Frontier{NewFrontier: seed})
+	err = r.Error
+	return
+}
+
+// FrontierExclusion excludes urls from leasing
+type FrontierExclusion struct {
+	PageTypes []string
+	Boards    []string
+}
+
+func (e FrontierExclusion) condition() (string, []interface{}) {
+	pageTypes, pageTypeArgs := notIn("page_type", e.PageTypes)
+	boards, boardArgs := notIn("board", e.Boards)
+	return pageTypes + " " + boards, append(pageTypeArgs, boardArgs...)
+}
+
+// Lease leases the due url with the highest priority that is not excluded to worker
+// for leaseTimeout; pending urls and urls whose lease expired are due. Returns nil if
+// there is none
+func (t *frontierTx) Lease(worker string, leaseTimeout time.Duration, excluded FrontierExclusion) (f *Frontier, err error) {
+	now := time.Now()
+	args := []interface{}{
+		constants.FRONTIER_LEASED, worker, now.Add(leaseTimeout), now,
+		constants.FRONTIER_PENDING, now,
+		constants.FRONTIER_LEASED, now,
+	}
+
+	exclusion, exclusionArgs := excluded.condition()
+	args = append(args, exclusionArgs...)
+
+	var leased []Frontier
+	r := t.tx.Raw(fmt.Sprintf(`UPDATE frontiers SET state = ?, attempts = attempts + 1, leased_by = ?, lease_expires_at = ?, updated_at = ?
+		WHERE id = (
+			SELECT id FROM frontiers
+			WHERE deleted_at IS NULL AND (
+				(state = ? AND next_attempt_at <= ?) OR
+				(state = ? AND lease_expires_at < ?)
+			) %v
+			ORDER BY priority DESC, id ASC
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, exclusion), args...).Scan(&leased)
+	err = r.Error
+
+	if err != nil || len(leased) == 0 {
+		return
+	}
+
+	f = &leased[0]
+	return
+}
+
+// Heartbeat extends the leases worker holds on IDs by leaseTimeout
+func (t *frontierTx) Heartbeat(IDs []uint, worker string, leaseTimeout time.Duration) (err error) {
+	if len(IDs) == 0 {
+		return
+	}
+
+	r := t.tx.Model(&Frontier{}).
+		Where("id IN ? AND state = ? AND leased_by = ?", IDs, constants.FRONTIER_LEASED, worker).
+		Update("lease_expires_at", time.Now().Add(leaseTimeout))
+	err = r.Error
+	return
+}
+
+// Release makes the urls still leased by worker pending again, without counting
+// the interrupted attempt; returns how many were released
+func (t *frontierTx) Release(worker string) (count int64, err error) {
+	r := t.tx.Model(&Frontier{}).
+		Where("state = ? AND leased_by = ?", constants.FRONTIER_LEASED, worker).
+		Updates(map[string]interface{}{
+			"state":            constants.FRONTIER_PENDING,
+			"attempts":         gorm.Expr("GREATEST(attempts - 1, 0)"),
+			"next_attempt_at":  time.Now(),
+			"lease_expires_at": nil,
+		})
+	count = r.RowsAffected
+	err = r.Error
+	return
+}
+
+// Complete marks the url worker leases as done; it is revisited when it is enqueued again after revisitAfter
+func (t *frontierTx) Complete(ID uint, worker string, revisitAfter time.Duration) (err error) {
+	r := t.tx.Model(&Frontier{}).Where("id = ? AND state = ? AND leased_by = ?", ID, constants.FRONTIER_LEASED, worker).Updates(map[string]interface{}{
+		"state":            constants.FRONTIER_DONE,
+		"attempts":         0,
+		"next_attempt_at":  time.Now().Add(revisitAfter),
+		"lease_expires_at": nil,
+	})
+	err = leaseResult(r)
+	return
+}
+
+// Retry makes the url worker leases pending again after retryAfter
+func (t *frontierTx) Retry(ID uint, worker string, retryAfter time.Duration) (err error) {
+	r := t.tx.Model(&Frontier{}).Where("id = ? AND state = ? AND leased_by = ?", ID, constants.FRONTIER_LEASED, worker).Updates(map[string]interface{}{
+		"state":            constants.FRONTIER_PENDING,
+		"next_attempt_at":  time.Now().Add(retryAfter),
+		"lease_expires_at": nil,
+	})
+	err = leaseResult(r)
+	return
+}
+
+// Fail marks the url worker leases as failed; it is not leased again unless it is a seed
+func (t *frontierTx) Fail(ID uint, worker string) (err error) {
+	r := t.tx.Model(&Frontier{}).Where("id = ? AND state = ? AND leased_by = ?", ID, constants.FRONTIER_LEASED, worker).Updates(map[string]interface{}{
+		"state":            constants.FRONTIER_FAILED,
+		"lease_expires_at": nil,
+	})
+	err = leaseResult(r)
+	return
+}
+
+// NextDueAt returns when the earliest url that is pending, or leased by any worker,
+// and not excluded may be leased; nil if there is no such url
+func (t *frontierTx) NextDueAt(excluded FrontierExclusion) (at *time.Time, err error) {
+	var result struct {
+		At *time.Time
+	}
+
+	args := []interface{}{constants.FRONTIER_PENDING, constants.FRONTIER_PENDING, constants.FRONTIER_LEASED}
+
+	exclusion, exclusionArgs := excluded.condition()
+	args = append(args, exclusionArgs...)
+
+	r := t.tx.Raw(fmt.Sprintf(`SELECT MIN(CASE WHEN state = ? THEN next_attempt_at ELSE lease_expires_at END) AS at
+		FROM frontiers WHERE state IN (?, ?) AND deleted_at IS NULL %v`, exclusion), args...).Scan(&result)
+	at = result.At
+	err = r.Error
+	return
+}
@@ -1,15 +1,20 @@
 package db
 
 import (
+	"context"
 	"errors"
 
 	"gorm.io/gorm"
 )
 
 type NewHtml struct {
-	FilePath string
-	Href     string `gorm:"index"`
-	Board    string `gorm:"index"`
+	// Key of the file in the blob store; the column predates the blob store
+	Key    string `gorm:"column:file_path"`
+	Href   string `gorm:"index"`
+	Board  string `gorm:"index"`
+	Sha256 string `gorm:"index"`
+	// run that fetched the page
+	RunID *uint `gorm:"index"`
 }
 
 type Html struct {
@@ -32,8 +37,8 @@ func (c *DbConnection) InitHtml() *HtmlDbConnection {
 	return &HtmlDbConnection{db: c.db}
 }
 
-func (c *HtmlDbConnection) CreateTransaction() *htmlTx {
-	tx := c.db.Begin()
+func (c *HtmlDbConnection) CreateTransaction(ctx context.Context) *htmlTx {
+	tx := c.db.WithContext(ctx).Begin()
 
 	return &htmlTx{
 		tx:       tx,
@@ -106,7 +111,3 @@ func (t *htmlTx) FindAll(cb func(*Html)) (err error) {
 
 	return
 }
-
-func (t *htmlTx) DeleteAll() {
-	t.tx.Exec("DELETE FROM htmls")
-}
@@ -1,18 +1,31 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"go-find-pepe/pkg/constants"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type NewImage struct {
-	FilePath       string
+	// Key of the file in the blob store; the column predates the blob store
+	Key            string `gorm:"column:file_path"`
 	Category       string `gorm:"index"`
 	Classification float32
 	Href           string `gorm:"index"`
 	Board          string `gorm:"index"`
+	MD5            string `gorm:"index"`
+	Sha256         string `gorm:"index"`
+	// perceptual hashes; nil if the image could not be decoded
+	PHash *int64
+	DHash *int64
+	// version of the model that produced Category and Classification
+	ModelVersion string `gorm:"index"`
+	// run that downloaded the image
+	RunID *uint `gorm:"index"`
 }
 
 type Image struct {
@@ -35,8 +48,8 @@ func (c *DbConnection) InitImage() *ImageDbConnection {
 	return &ImageDbConnection{db: c.db}
 }
 
-func (c *ImageDbConnection) CreateImageTransaction() *imgTx {
-	tx := c.db.Begin()
+func (c *ImageDbConnection) CreateImageTransaction(ctx context.Context) *imgTx {
+	tx := c.db.WithContext(ctx).Begin()
 
 	return &imgTx{
 		tx:       tx,
@@ -52,10 +65,22 @@ func (c *ImageDbConnection) CreateImageTransaction() *imgTx {
 	}
 }
 
-func (t *imgTx) Create(new NewImage) *Image {
-	img := &Image{NewImage: new}
-	t.tx.Create(&img)
-	return img
+// CreateUnlessSha256Exists creates the image unless a live image of the same sha256
+// exists, which another replica may have created concurrently; that image is
+// returned instead, with created false
+func (t *imgTx) CreateUnlessSha256Exists(new NewImage) (i *Image, created bool, err error) {
+	i = &Image{NewImage: new}
+	r := t.tx.Clauses(clause.OnConflict{
+		Columns:     []clause.Column{{Name: "sha256"}},
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: uniqueSha256Where}}},
+		DoNothing:   true,
+	}).Create(i)
+	if r.Error != nil || r.RowsAffected > 0 {
+		return i, r.Error == nil, r.Error
+	}
+
+	i, err = t.FindOneBySha256(new.Sha256)
+	return
 }
 
 func (t *imgTx) FindOneByID(ID uint) (i *Image, err error) {
@@ -77,6 +102,20 @@ func (t *imgTx) FindOneByHref(href string) (i *Image, err error) {
 	return
 }
 
+func (t *imgTx) FindOneByMD5(md5 string) (i *Image, err error) {
+	i = &Image{}
+	r := t.tx.Take(i, "md5 = ?", md5)
+	err = r.Error
+	return
+}
+
+func (t *imgTx) FindOneBySha256(hash string) (i *Image, err error) {
+	i = &Image{}
+	r := t.tx.Take(i, "sha256 = ?", hash)
+	err = r.Error
+	return
+}
+
 func (t *imgTx) ExistsByHref(href string) bool {
 	var result struct {
 		Found bool
@@ -106,6 +145,56 @@ func (t *imgTx) UpdateById(ID uint, update NewImage) (err error) {
 	return
 }
 
+// FindAllToReclassify finds classified images of another model than model, including
+// images classified before the model was recorded, or in one of categories
+func (t *imgTx) FindAllToReclassify(model string, categories []string, cb func(*Image)) (err error) {
+	unclassified := []string{constants.CATEGORY_UNCLASSIFIED, constants.CATEGORY_FAULTY}
+
+	query := t.tx.Model(&Image{})
+	switch {
+	case model != "" && len(categories) > 0:
+		query = query.Where("(category NOT IN ? AND model_version IS DISTINCT FROM ?) OR category IN ?", unclassified, model, categories)
+	case model != "":
+		query = query.Where("category NOT IN ? AND model_version IS DISTINCT FROM ?", unclassified, model)
+	case len(categories) > 0:
+		query = query.Where("category IN ?", categories)
+	default:
+		return
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var img Image
+		t.tx.ScanRows(rows, &img)
+		cb(&img)
+	}
+
+	return
+}
+
+// FindAllWithPerceptualHash finds the images with a perceptual hash that were
+// updated after updatedAfter; the zero time finds all of them
+func (t *imgTx) FindAllWithPerceptualHash(updatedAfter time.Time, cb func(*Image)) (err error) {
+	rows, err := t.tx.Model(&Image{}).Where("p_hash IS NOT NULL AND updated_at > ?", updatedAfter).Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var img Image
+		t.tx.ScanRows(rows, &img)
+		cb(&img)
+	}
+
+	return
+}
+
 func (t *imgTx) FindAllUnclassified(cb func(*Image)) (err error) {
 	rows, err := t.tx.Model(&Image{}).Where("category = ?", constants.CATEGORY_UNCLASSIFIED).Rows()
 	if err != nil {
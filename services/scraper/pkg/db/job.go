@@ -0,0 +1,240 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/constants"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrLeaseLost is returned when the outcome of work is recorded by a worker whose
+// lease expired, and which may have been taken by another worker since
+var ErrLeaseLost = errors.New("lease lost")
+
+// leaseResult returns the error of r, an update of a row leased by one worker, or
+// ErrLeaseLost if the worker no longer holds the lease
+func leaseResult(r *gorm.DB) error {
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+type NewJob struct {
+	// one of constants.JOB_IMAGE_DOWNLOAD or JOB_CLASSIFY
+	Kind string `gorm:"uniqueIndex:idx_jobs_kind_key"`
+	// identifies the work within its kind; the same work is never enqueued twice
+	Key string `gorm:"uniqueIndex:idx_jobs_kind_key"`
+	// json encoded arguments of the work
+	Payload string
+	// board the work is about
+	Board string `gorm:"index"`
+	// one of constants.JOB_PENDING, JOB_LEASED, JOB_DONE or JOB_FAILED
+	State         string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	// worker holding the lease; the lease is abandoned once LeaseExpiresAt passed
+	LeasedBy       string
+	LeaseExpiresAt *time.Time `gorm:"index"`
+}
+
+type Job struct {
+	gorm.Model
+	NewJob
+}
+
+type jobTx struct {
+	tx       *gorm.DB
+	Rollback func()
+	Commit   func()
+	Deferral func()
+}
+
+type JobDbConnection struct {
+	db *gorm.DB
+}
+
+func (c *DbConnection) InitJob() *JobDbConnection {
+	return &JobDbConnection{db: c.db}
+}
+
+func (c *JobDbConnection) CreateTransaction(ctx context.Context) *jobTx {
+	tx := c.db.WithContext(ctx).Begin()
+
+	return &jobTx{
+		tx:       tx,
+		Rollback: func() { tx.Rollback() },
+		Commit:   func() { tx.Commit() },
+		Deferral: func() {
+			if err := recover(); err != nil {
+				tx.Rollback()
+			} else {
+				tx.Commit()
+			}
+		},
+	}
+}
+
+// Enqueue adds jobs whose key is new for their kind as pending; if reopen is set,
+// finished jobs with the same key become pending again. Returns the number of jobs
+// that became pending
+func (t *jobTx) Enqueue(news []NewJob, reopen bool) (count int64, err error) {
+	now := time.Now()
+	seen := map[string]bool{}
+	jobs := []Job{}
+	for _, new := range news {
+		// a key may only be affected once per statement
+		if seen[new.Kind+"\x00"+new.Key] {
+			continue
+		}
+		seen[new.Kind+"\x00"+new.Key] = true
+
+		new.State = constants.JOB_PENDING
+		new.NextAttemptAt = now
+		jobs = append(jobs, Job{NewJob: new})
+	}
+
+	if len(jobs) == 0 {
+		return
+	}
+
+	onConflict := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "kind"}, {Name: "key"}},
+		DoNothing: true,
+	}
+	if reopen {
+		onConflict = clause.OnConflict{
+			Columns: []clause.Column{{Name: "kind"}, {Name: "key"}},
+			Where: clause.Where{Exprs: []clause.Expression{
+				clause.IN{Column: clause.Column{Table: "jobs", Name: "state"}, Values: []interface{}{constants.JOB_DONE, constants.JOB_FAILED}},
+			}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"state":           constants.JOB_PENDING,
+				"payload":         gorm.Expr("excluded.payload"),
+				"attempts":        0,
+				"next_attempt_at": now,
+			}),
+		}
+	}
+
+	r := t.tx.Clauses(onConflict).Create(&jobs)
+	count = r.RowsAffected
+	err = r.Error
+	return
+}
+
+// Lease leases at most n due jobs of kind, about none of excludedBoards, to worker
+// for leaseTimeout; pending jobs and jobs whose lease expired are due. Jobs locked
+// by other workers are skipped
+func (t *jobTx) Lease(kind string, worker string, n int, leaseTimeout time.Duration, excludedBoards []string) (jobs []Job, err error) {
+	now := time.Now()
+	exclusion, exclusionArgs := notIn("board", excludedBoards)
+
+	args := []interface{}{
+		constants.JOB_LEASED, worker, now.Add(leaseTimeout), now,
+		kind,
+		constants.JOB_PENDING, now,
+		constants.JOB_LEASED, now,
+	}
+	args = append(args, exclusionArgs...)
+	args = append(args, n)
+
+	r := t.tx.Raw(fmt.Sprintf(`UPDATE jobs SET state = ?, attempts = attempts + 1, leased_by = ?, lease_expires_at = ?, updated_at = ?
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE kind = ? AND deleted_at IS NULL AND (
+				(state = ? AND next_attempt_at <= ?) OR
+				(state = ? AND lease_expires_at < ?)
+			) %v
+			ORDER BY id ASC
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, exclusion), args...).Scan(&jobs)
+	err = r.Error
+	return
+}
+
+// Heartbeat extends the leases worker holds on IDs by leaseTimeout
+func (t *jobTx) Heartbeat(IDs []uint, worker string, leaseTimeout time.Duration) (err error) {
+	if len(IDs) == 0 {
+		return
+	}
+
+	r := t.tx.Model(&Job{}).
+		Where("id IN ? AND state = ? AND leased_by = ?", IDs, constants.JOB_LEASED, worker).
+		Update("lease_expires_at", time.Now().Add(leaseTimeout))
+	err = r.Error
+	return
+}
+
+// Release makes the jobs of kind still leased by worker pending again, without
+// counting the interrupted attempt; returns how many were released
+func (t *jobTx) Release(kind string, worker string) (count int64, err error) {
+	r := t.tx.Model(&Job{}).
+		Where("kind = ? AND state = ? AND leased_by = ?", kind, constants.JOB_LEASED, worker).
+		Updates(map[string]interface{}{
+			"state":            constants.JOB_PENDING,
+			"attempts":         gorm.Expr("GREATEST(attempts - 1, 0)"),
+			"next_attempt_at":  time.Now(),
+			"lease_expires_at": nil,
+		})
+	count = r.RowsAffected
+	err = r.Error
+	return
+}
+
+// Complete marks the job worker leases as done
+func (t *jobTx) Complete(ID uint, worker string) (err error) {
+	r := t.tx.Model(&Job{}).Where("id = ? AND state = ? AND leased_by = ?", ID, constants.JOB_LEASED, worker).Updates(map[string]interface{}{
+		"state":            constants.JOB_DONE,
+		"lease_expires_at": nil,
+	})
+	err = leaseResult(r)
+	return
+}
+
+// Retry makes the job worker leases pending again after retryAfter
+func (t *jobTx) Retry(ID uint, worker string, retryAfter time.Duration) (err error) {
+	r := t.tx.Model(&Job{}).Where("id = ? AND state = ? AND leased_by = ?", ID, constants.JOB_LEASED, worker).Updates(map[string]interface{}{
+		"state":            constants.JOB_PENDING,
+		"next_attempt_at":  time.Now().Add(retryAfter),
+		"lease_expires_at": nil,
+	})
+	err = leaseResult(r)
+	return
+}
+
+// Fail marks the job worker leases as failed; it is not leased again
+func (t *jobTx) Fail(ID uint, worker string) (err error) {
+	r := t.tx.Model(&Job{}).Where("id = ? AND state = ? AND leased_by = ?", ID, constants.JOB_LEASED, worker).Updates(map[string]interface{}{
+		"state":            constants.JOB_FAILED,
+		"lease_expires_at": nil,
+	})
+	err = leaseResult(r)
+	return
+}
+
+// NextDueAt returns when the earliest job of kind, about none of excludedBoards,
+// that is pending, or leased by any worker, may be leased; nil if there is no such job
+func (t *jobTx) NextDueAt(kind string, excludedBoards []string) (at *time.Time, err error) {
+	var result struct {
+		At *time.Time
+	}
+
+	exclusion, exclusionArgs := notIn("board", excludedBoards)
+	args := append([]interface{}{constants.JOB_PENDING, kind, constants.JOB_PENDING, constants.JOB_LEASED}, exclusionArgs...)
+
+	r := t.tx.Raw(fmt.Sprintf(`SELECT MIN(CASE WHEN state = ? THEN next_attempt_at ELSE lease_expires_at END) AS at
+		FROM jobs WHERE kind = ? AND state IN (?, ?) AND deleted_at IS NULL %v`, exclusion), args...).Scan(&result)
+	at = result.At
+	err = r.Error
+	return
+}
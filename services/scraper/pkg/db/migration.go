@@ -0,0 +1,137 @@
+package db
+
+import (
+	"fmt"
+	"go-find-pepe/pkg/canonical"
+	"go-find-pepe/pkg/constants"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Migration records a data migration that was applied
+type Migration struct {
+	Name      string `gorm:"primaryKey"`
+	AppliedAt time.Time
+}
+
+// migrateOnce applies migrate unless a migration of name was applied before; the
+// record is inserted in the same transaction, so concurrent replicas wait for
+// the first and then skip it
+func migrateOnce(db *gorm.DB, name string, migrate func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		r := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Migration{Name: name, AppliedAt: time.Now()})
+		if r.Error != nil || r.RowsAffected == 0 {
+			return r.Error
+		}
+		return migrate(tx)
+	})
+}
+
+// urlColumn is a column of urls, stored before urls were canonicalized the way
+// they are now
+type urlColumn struct {
+	table  string
+	column string
+	// restricts the rows of which column holds a url; empty for every row
+	where string
+	// whether column is unique, in which case a row whose canonical url is taken
+	// is the same work as the row holding it, and is deleted
+	unique bool
+}
+
+// migrateCanonicalUrls canonicalizes the urls of frontiers, image download jobs and
+// images, so urls found from now on match the ones stored before
+func migrateCanonicalUrls(tx *gorm.DB) error {
+	c := canonical.Default()
+	columns := []urlColumn{
+		{table: "frontiers", column: "url", unique: true},
+		{table: "jobs", column: "key", where: fmt.Sprintf("kind = '%v'", constants.JOB_IMAGE_DOWNLOAD), unique: true},
+		{table: "images", column: "href"},
+	}
+
+	for _, col := range columns {
+		err := col.canonicalize(tx, c)
+		if err != nil {
+			return fmt.Errorf("failed to canonicalize %v.%v; %w", col.table, col.column, err)
+		}
+	}
+	return nil
+}
+
+func (col urlColumn) canonicalize(tx *gorm.DB, c *canonical.Canonicalizer) error {
+	where := "TRUE"
+	if col.where != "" {
+		where = col.where
+	}
+
+	var rows []struct {
+		ID  uint
+		Url string
+	}
+	err := tx.Raw(fmt.Sprintf(`SELECT id, %q AS url FROM %v WHERE %v`, col.column, col.table, where)).Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		url, err := c.Canonicalize(row.Url)
+		if err != nil || url == row.Url {
+			continue
+		}
+
+		if !col.unique {
+			err = tx.Exec(fmt.Sprintf(`UPDATE %v SET %q = ? WHERE id = ?`, col.table, col.column), url, row.ID).Error
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		r := tx.Exec(fmt.Sprintf(`UPDATE %v SET %q = ? WHERE id = ? AND NOT EXISTS (SELECT 1 FROM %v WHERE %q = ? AND %v)`,
+			col.table, col.column, col.table, col.column, where), url, row.ID, url)
+		if r.Error != nil {
+			return r.Error
+		}
+		if r.RowsAffected == 0 {
+			err = tx.Exec(fmt.Sprintf(`DELETE FROM %v WHERE id = ?`, col.table), row.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// uniqueSha256Where restricts the unique index on images.sha256 to live images
+// with a sha256, as images stored before the column existed have none
+const uniqueSha256Where = "sha256 <> '' AND deleted_at IS NULL"
+
+// migrateUniqueSha256 makes images.sha256 unique, so replicas storing the same
+// content at once create one image. Of live images sharing a sha256 the oldest is
+// kept; the others become sightings of it and are deleted
+func migrateUniqueSha256(tx *gorm.DB) error {
+	duplicates := fmt.Sprintf(`WITH duplicates AS (
+		SELECT id, href, board, first_value(id) OVER (PARTITION BY sha256 ORDER BY id) AS kept
+		FROM images WHERE %v
+	) `, uniqueSha256Where)
+
+	statements := []string{
+		duplicates + `INSERT INTO sightings (created_at, updated_at, image_id, href, board)
+			SELECT now(), now(), kept, href, board FROM duplicates WHERE id <> kept`,
+		duplicates + `UPDATE sightings SET image_id = duplicates.kept
+			FROM duplicates WHERE sightings.image_id = duplicates.id AND duplicates.id <> duplicates.kept`,
+		duplicates + `UPDATE images SET deleted_at = now()
+			FROM duplicates WHERE images.id = duplicates.id AND duplicates.id <> duplicates.kept`,
+		fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS idx_images_sha256_unique ON images (sha256) WHERE %v`, uniqueSha256Where),
+	}
+
+	for _, statement := range statements {
+		err := tx.Exec(statement).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/constants"
+	"hash/crc32"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrRunLocked is returned when another run holds the run lock
+var ErrRunLocked = errors.New("another run holds the run lock")
+
+// runLockClass namespaces the advisory locks of the scraper ("pepe")
+const runLockClass = 0x70657065
+
+// RunLockHeartbeat is refreshed by the holder of a run lock while it is alive
+type RunLockHeartbeat struct {
+	Name        string `gorm:"primaryKey"`
+	Holder      string
+	HeartbeatAt time.Time
+}
+
+type RunLockArguments struct {
+	Name string
+	// one of constants.RUN_LOCK_SKIP, RUN_LOCK_WAIT or RUN_LOCK_TAKEOVER_STALE
+	Policy string
+	// how long RUN_LOCK_WAIT waits for the lock
+	Wait time.Duration
+	// a holder is stale once its heartbeat is older than StaleAfter
+	StaleAfter time.Duration
+	// identifies the run in the heartbeat
+	Holder string
+}
+
+// RunLock is a postgres session level advisory lock held on a dedicated
+// connection; it is released when the connection closes, so a crashed run
+// never keeps it
+type RunLock struct {
+	RunLockArguments
+	// whether the lock was taken over from a stale holder
+	TookOver bool
+	conn     *sql.Conn
+	db       *gorm.DB
+	stop     chan bool
+}
+
+// AcquireRunLock acquires the run lock according to the policy of arg; returns
+// ErrRunLocked if another run keeps holding it, or the error of ctx if ctx is done
+// while waiting
+func (c *DbConnection) AcquireRunLock(ctx context.Context, arg RunLockArguments) (*RunLock, error) {
+	sqlDb, err := c.db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sqlDb.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &RunLock{RunLockArguments: arg, conn: conn, db: c.db, stop: make(chan bool)}
+
+	acquired, err := l.acquire(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if !acquired {
+		conn.Close()
+		return nil, ErrRunLocked
+	}
+
+	err = l.beat()
+	if err != nil {
+		l.Release()
+		return nil, err
+	}
+	go l.keepAlive()
+
+	return l, nil
+}
+
+func (l *RunLock) acquire(ctx context.Context) (bool, error) {
+	acquired, err := l.tryLock(ctx)
+	if err != nil || acquired {
+		return acquired, err
+	}
+
+	switch l.Policy {
+	case constants.RUN_LOCK_WAIT:
+		deadline := time.Now().Add(l.Wait)
+		for time.Now().Before(deadline) {
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-time.After(time.Second):
+			}
+
+			acquired, err = l.tryLock(ctx)
+			if err != nil || acquired {
+				return acquired, err
+			}
+		}
+		return false, nil
+	case constants.RUN_LOCK_TAKEOVER_STALE:
+		stale, err := l.terminateStaleHolder(ctx)
+		if err != nil || !stale {
+			return false, err
+		}
+
+		// the lock is released once the terminated session has ended
+		for i := 0; i < 10; i++ {
+			acquired, err = l.tryLock(ctx)
+			if err != nil || acquired {
+				l.TookOver = acquired
+				return acquired, err
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false, nil
+	default:
+		return false, nil
+	}
+}
+
+func (l *RunLock) tryLock(ctx context.Context) (acquired bool, err error) {
+	err = l.conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1, $2)`,
+		runLockClass, l.objectId()).Scan(&acquired)
+	return
+}
+
+// terminateStaleHolder ends the session of the holder of the lock if its heartbeat
+// expired; returns false if the holder is alive
+func (l *RunLock) terminateStaleHolder(ctx context.Context) (bool, error) {
+	var heartbeat RunLockHeartbeat
+	r := l.db.WithContext(ctx).Take(&heartbeat, "name = ?", l.Name)
+	if errors.Is(r.Error, gorm.ErrRecordNotFound) {
+		// the holder has only just acquired the lock
+		return false, nil
+	}
+	if r.Error != nil {
+		return false, r.Error
+	}
+
+	if time.Since(heartbeat.HeartbeatAt) < l.StaleAfter {
+		return false, nil
+	}
+
+	fmt.Printf("Run lock %v of %v is stale since %v; taking over\n", l.Name, heartbeat.Holder, heartbeat.HeartbeatAt)
+
+	r = l.db.WithContext(ctx).Exec(`SELECT pg_terminate_backend(pid) FROM pg_locks
+		WHERE locktype = 'advisory' AND classid = ? AND objid = ? AND objsubid = 2 AND granted`,
+		runLockClass, uint32(l.objectId()))
+	return true, r.Error
+}
+
+func (l *RunLock) objectId() int32 {
+	return int32(crc32.ChecksumIEEE([]byte(l.Name)))
+}
+
+func (l *RunLock) beat() error {
+	r := l.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&RunLockHeartbeat{
+		Name:        l.Name,
+		Holder:      l.Holder,
+		HeartbeatAt: time.Now(),
+	})
+	return r.Error
+}
+
+func (l *RunLock) keepAlive() {
+	ticker := time.NewTicker(l.StaleAfter / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			err := l.beat()
+			if err != nil {
+				fmt.Printf("Failed to refresh run lock %v; %v\n", l.Name, err)
+			}
+		}
+	}
+}
+
+// Release releases the run lock and closes its connection
+func (l *RunLock) Release() error {
+	close(l.stop)
+	defer l.conn.Close()
+
+	_, err := l.conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1, $2)`, runLockClass, l.objectId())
+	return err
+}
@@ -0,0 +1,15 @@
+package db
+
+import "testing"
+
+func TestRunLockObjectId(t *testing.T) {
+	scraper := &RunLock{RunLockArguments: RunLockArguments{Name: "scraper"}}
+	other := &RunLock{RunLockArguments: RunLockArguments{Name: "reclassify"}}
+
+	if scraper.objectId() != scraper.objectId() {
+		t.Error("the object id of a run lock changes")
+	}
+	if scraper.objectId() == other.objectId() {
+		t.Errorf("run locks %v and %v share the object id %v", scraper.Name, other.Name, scraper.objectId())
+	}
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RunCounters is what a run did
+type RunCounters struct {
+	Threads          int64
+	PagesFetched     int64
+	NotFound         int64
+	ImagesDiscovered int64
+	SkippedExisting  int64
+	Downloaded       int64
+	// json object with the number of images classified per category
+	Classified       string
+	Faulty           int64
+	BytesTransferred int64
+	Retries          int64
+	// json object with the BoardCounters per board
+	Boards string
+}
+
+// BoardCounters is what a run did on one board
+type BoardCounters struct {
+	Threads          int64            `json:"threads"`
+	PagesFetched     int64            `json:"pages_fetched"`
+	NotFound         int64            `json:"not_found"`
+	ImagesDiscovered int64            `json:"images_discovered"`
+	SkippedExisting  int64            `json:"skipped_existing"`
+	Downloaded       int64            `json:"downloaded"`
+	Classified       map[string]int64 `json:"classified"`
+	Faulty           int64            `json:"faulty"`
+	BytesTransferred int64            `json:"bytes_transferred"`
+	Retries          int64            `json:"retries"`
+}
+
+type NewRun struct {
+	StartedAt  time.Time `gorm:"index"`
+	FinishedAt *time.Time
+	// json list of the hrefs the run started from
+	SeedHrefs string
+	// json snapshot of the configuration of the run
+	Config string
+	// one of constants.RUN_COMPLETED, RUN_SKIPPED or RUN_INTERRUPTED; empty while
+	// running or if the run crashed
+	ExitReason string
+	RunCounters
+}
+
+type Run struct {
+	gorm.Model
+	NewRun
+}
+
+type runTx struct {
+	tx       *gorm.DB
+	Rollback func()
+	Commit   func()
+	Deferral func()
+}
+
+type RunDbConnection struct {
+	db *gorm.DB
+}
+
+func (c *DbConnection) InitRun() *RunDbConnection {
+	return &RunDbConnection{db: c.db}
+}
+
+func (c *RunDbConnection) CreateTransaction(ctx context.Context) *runTx {
+	tx := c.db.WithContext(ctx).Begin()
+
+	return &runTx{
+		tx:       tx,
+		Rollback: func() { tx.Rollback() },
+		Commit:   func() { tx.Commit() },
+		Deferral: func() {
+			if err := recover(); err != nil {
+				tx.Rollback()
+			} else {
+				tx.Commit()
+			}
+		},
+	}
+}
+
+func (t *runTx) Create(new NewRun) (r *Run, err error) {
+	r = &Run{NewRun: new}
+	err = t.tx.Create(r).Error
+	return
+}
+
+func (t *runTx) FindOneByID(ID uint) (r *Run, err error) {
+	r = &Run{}
+	err = t.tx.Take(r, ID).Error
+	return
+}
+
+// Finish records the exit reason and counters of the run
+func (t *runTx) Finish(ID uint, exitReason string, counters RunCounters) (err error) {
+	r := t.tx.Model(&Run{}).Where("id = ?", ID).Updates(map[string]interface{}{
+		"finished_at":       time.Now(),
+		"exit_reason":       exitReason,
+		"threads":           counters.Threads,
+		"pages_fetched":     counters.PagesFetched,
+		"not_found":         counters.NotFound,
+		"images_discovered": counters.ImagesDiscovered,
+		"skipped_existing":  counters.SkippedExisting,
+		"downloaded":        counters.Downloaded,
+		"classified":        counters.Classified,
+		"faulty":            counters.Faulty,
+		"bytes_transferred": counters.BytesTransferred,
+		"retries":           counters.Retries,
+		"boards":            counters.Boards,
+	})
+	err = r.Error
+	return
+}
+
+// FindLatest returns at most limit runs, latest first
+func (t *runTx) FindLatest(limit int) (runs []Run, err error) {
+	r := t.tx.Order("started_at DESC, id DESC").Limit(limit).Find(&runs)
+	err = r.Error
+	return
+}
@@ -0,0 +1,21 @@
+package db
+
+import "gorm.io/gorm"
+
+// NewSighting records that an already stored image was seen again under another href
+type NewSighting struct {
+	ImageID uint   `gorm:"index"`
+	Href    string `gorm:"index"`
+	Board   string `gorm:"index"`
+}
+
+type Sighting struct {
+	gorm.Model
+	NewSighting
+}
+
+func (t *imgTx) CreateSighting(new NewSighting) *Sighting {
+	s := &Sighting{NewSighting: new}
+	t.tx.Create(&s)
+	return s
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RunUsage is how much of a quota a run used, shared with the other runs in progress
+type RunUsage struct {
+	RunID uint `gorm:"primaryKey"`
+	// one of constants.USAGE_THREADS, USAGE_IMAGES, USAGE_BYTES or USAGE_PAGES
+	Counter string `gorm:"primaryKey"`
+	// board the usage counts for, or page type of USAGE_PAGES
+	Key   string `gorm:"primaryKey"`
+	Value int64
+}
+
+type usageTx struct {
+	tx       *gorm.DB
+	Rollback func()
+	Commit   func()
+	Deferral func()
+}
+
+type UsageDbConnection struct {
+	db *gorm.DB
+}
+
+func (c *DbConnection) InitUsage() *UsageDbConnection {
+	return &UsageDbConnection{db: c.db}
+}
+
+func (c *UsageDbConnection) CreateTransaction(ctx context.Context) *usageTx {
+	tx := c.db.WithContext(ctx).Begin()
+
+	return &usageTx{
+		tx:       tx,
+		Rollback: func() { tx.Rollback() },
+		Commit:   func() { tx.Commit() },
+		Deferral: func() {
+			if err := recover(); err != nil {
+				tx.Rollback()
+			} else {
+				tx.Commit()
+			}
+		},
+	}
+}
+
+// Add adds usages to what run runID used, and marks the run as alive
+func (t *usageTx) Add(runID uint, usages []RunUsage) (err error) {
+	err = t.tx.Model(&Run{}).Where("id = ?", runID).Update("updated_at", time.Now()).Error
+	if err != nil || len(usages) == 0 {
+		return
+	}
+
+	for i := range usages {
+		usages[i].RunID = runID
+	}
+
+	r := t.tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "run_id"}, {Name: "counter"}, {Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"value": gorm.Expr("run_usages.value + excluded.value")}),
+	}).Create(&usages)
+	err = r.Error
+	return
+}
+
+// FindOfOtherRuns returns what the runs in progress other than runID used together,
+// per counter and key; a run that was not marked alive since aliveSince is taken
+// to have crashed
+func (t *usageTx) FindOfOtherRuns(runID uint, aliveSince time.Time) (usages []RunUsage, err error) {
+	r := t.tx.Raw(`SELECT u.counter, u.key, SUM(u.value) AS value FROM run_usages u
+		JOIN runs r ON r.id = u.run_id
+		WHERE u.run_id <> ? AND r.finished_at IS NULL AND r.deleted_at IS NULL AND r.updated_at >= ?
+		GROUP BY u.counter, u.key`, runID, aliveSince).Scan(&usages)
+	err = r.Error
+	return
+}
@@ -0,0 +1,89 @@
+package environment
+
+import "fmt"
+
+type BlobEnv struct {
+	// either "local" or "s3"
+	Backend   string
+	LocalRoot string
+	S3Env
+}
+
+type S3Env struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyId     string
+	SecretAccessKey string
+	UsePathStyle    bool
+}
+
+func ReadBlob() (*BlobEnv, error) {
+	backend, err := readString("BLOB_BACKEND", "local", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// relative to the working directory of the scraper
+	localRoot, err := readString("BLOB_LOCAL_ROOT", "data", false)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &BlobEnv{Backend: *backend, LocalRoot: *localRoot}
+
+	switch *backend {
+	case "local":
+		return env, nil
+	case "s3":
+		s3Env, err := readS3()
+		if err != nil {
+			return nil, err
+		}
+		env.S3Env = *s3Env
+		return env, nil
+	default:
+		return nil, fmt.Errorf("BLOB_BACKEND must be local or s3; got %v", *backend)
+	}
+}
+
+func readS3() (*S3Env, error) {
+	endpoint, err := readString("S3_ENDPOINT", "", true)
+	if err != nil {
+		return nil, err
+	}
+
+	region, err := readString("S3_REGION", "us-east-1", false)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, err := readString("S3_BUCKET", "", true)
+	if err != nil {
+		return nil, err
+	}
+
+	accessKeyId, err := readString("S3_ACCESS_KEY_ID", "", true)
+	if err != nil {
+		return nil, err
+	}
+
+	secretAccessKey, err := readString("S3_SECRET_ACCESS_KEY", "", true)
+	if err != nil {
+		return nil, err
+	}
+
+	usePathStyle, err := readBool("S3_USE_PATH_STYLE", true, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Env{
+		Endpoint:        *endpoint,
+		Region:          *region,
+		Bucket:          *bucket,
+		AccessKeyId:     *accessKeyId,
+		SecretAccessKey: *secretAccessKey,
+		UsePathStyle:    *usePathStyle,
+	}, nil
+}
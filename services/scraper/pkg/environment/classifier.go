@@ -0,0 +1,73 @@
+package environment
+
+import "fmt"
+
+type ClassifierEnv struct {
+	// one of "http", "json", "fake" or "ensemble"
+	Backend      string
+	VisionApiUrl string
+	JsonApiUrl   string
+	// backends whose scores are averaged by the "ensemble" backend
+	Ensemble []string
+	// model version recorded when the backend does not report one; also the
+	// version images are compared against when reclassifying
+	Model string
+	// json retry.Policy of the requests to the http and json backends, onto retry.Service
+	RetryPolicy string
+}
+
+func ReadClassifier() (*ClassifierEnv, error) {
+	backend, err := readString("CLASSIFIER_BACKEND", "http", false)
+	if err != nil {
+		return nil, err
+	}
+
+	ensemble, err := readStringList("CLASSIFIER_ENSEMBLE", []string{}, *backend == "ensemble")
+	if err != nil {
+		return nil, err
+	}
+
+	backends := []string{*backend}
+	if *backend == "ensemble" {
+		backends = ensemble
+	}
+
+	uses := map[string]bool{}
+	for _, b := range backends {
+		switch b {
+		case "http", "json", "fake":
+			uses[b] = true
+		default:
+			return nil, fmt.Errorf("classifier backend must be http, json, fake or ensemble; got %v", b)
+		}
+	}
+
+	visionApiUrl, err := readString("VISION_API_URL", "", uses["http"])
+	if err != nil {
+		return nil, err
+	}
+
+	jsonApiUrl, err := readString("CLASSIFIER_JSON_URL", "", uses["json"])
+	if err != nil {
+		return nil, err
+	}
+
+	model, err := readString("CLASSIFIER_MODEL", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	retryPolicy, err := readString("CLASSIFIER_RETRY_POLICY", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClassifierEnv{
+		Backend:      *backend,
+		VisionApiUrl: *visionApiUrl,
+		JsonApiUrl:   *jsonApiUrl,
+		Ensemble:     ensemble,
+		Model:        *model,
+		RetryPolicy:  *retryPolicy,
+	}, nil
+}
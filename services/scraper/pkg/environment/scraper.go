@@ -1,37 +1,317 @@
 package environment
 
+import (
+	"fmt"
+	"go-find-pepe/pkg/constants"
+	"math"
+	"time"
+)
+
 type ScraperEnv struct {
-	VisionApiUrl  string
-	ImageLimit    int8
-	HtmlLimit     int8
-	ClassifyLimit int8
+	ImageLimit      int8
+	HtmlLimit       int8
+	ClassifyLimit   int8
+	DiscoverySource string
+	// maximum hamming distance between perceptual hashes of near-duplicates
+	MaxHashDistance int8
+	// images are sent to the classifier in batches of at most ClassifyBatchSize,
+	// waiting at most ClassifyBatchWait for a batch to fill up
+	ClassifyBatchSize int8
+	ClassifyBatchWait time.Duration
+	// categories that are classified again in reclassify mode regardless of their model
+	ReclassifyCategories []string
+	// adapt the concurrency of downloads and classifications to how their destination
+	// copes, up to ImageLimit and ClassifyLimit
+	AdaptiveLimits bool
+	// json encoded taxonomy.Taxonomy; empty for the default pepe/maybe/non-pepe rules
+	Taxonomy string
+	// json encoded scope.Scope; empty for https board pages and jpg, gif and png images
+	Scope string
+	// crawled pages are fetched again when they are discovered after FrontierRevisitAfter
+	FrontierRevisitAfter time.Duration
+	// order in which pages are crawled; bfs, dfs or best-first
+	Traversal string
+	// pages more links away from the seed are not crawled; -1 is unlimited
+	MaxDepth int8
+	// json object with the scraper.PageTypeLimit per page type
+	PageTypeLimits string
+	// urls or board names the crawl starts from
+	Seeds []string
+	// json object with the scraper.BoardQuota per board, or * for any board
+	BoardQuotas string
+	// work leased by a replica is reclaimed by others once its lease was not
+	// extended for LeaseTimeout
+	LeaseTimeout time.Duration
+	// what a run does when another run holds the run lock; skip, wait or takeover-stale,
+	// or none to not take the run lock at all
+	RunLockPolicy string
+	// how long the wait policy waits for the run lock
+	RunLockWait time.Duration
+	// the takeover-stale policy takes over a run lock whose heartbeat is older than RunLockStaleAfter
+	RunLockStaleAfter time.Duration
+	// idle connections kept per host for reuse; 0 for the default of net/http
+	MaxIdleConnsPerHost   int
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	// time a request may take, including reading the body
+	RequestTimeout time.Duration
+	// larger response bodies are not read; 0 is unlimited
+	MaxResponseBytes int64
+	// json object with the retry.Policy per host, or * for any host
+	RetryPolicies string
+	// json object with the limit.Rate per host, or * for any host
+	HostRateLimits string
+	// replicas that send requests at the same time; each sends its share of the host rates
+	RateLimitReplicas int8
+	// address the metrics are served on at /metrics, e.g. :9090; empty to not serve them
+	MetricsAddr string
+	// once a run is stopped by a signal, downloads and classifications in flight get
+	// ShutdownGrace to finish
+	ShutdownGrace time.Duration
 }
 
 func ReadScraper() (*ScraperEnv, error) {
-	visionApiUrl, err := readString("VISION_API_URL", "", true)
+	hrefLimit, err := readInt("IMAGE_LIMIT", 0, false)
 	if err != nil {
 		return nil, err
 	}
 
-	hrefLimit, err := readInt("IMAGE_LIMIT", 0, false)
+	classifyLimit, err := readInt("CLASSIFY_LIMIT", 0, false)
 	if err != nil {
 		return nil, err
 	}
 
-	classifyLimit, err := readInt("CLASSIFY_LIMIT", 0, false)
+	htmlLimit, err := readInt("HTML_LIMIT", 0, false)
 	if err != nil {
 		return nil, err
 	}
 
-	htmlLimit, err := readInt("HTML_LIMIT", 0, false)
+	adaptiveLimits, err := readBool("ADAPTIVE_LIMITS", false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// either "api" for the 4chan JSON API or "html" for scraping the board pages
+	discoverySource, err := readString("DISCOVERY_SOURCE", "api", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if *discoverySource != "api" && *discoverySource != "html" {
+		return nil, fmt.Errorf("DISCOVERY_SOURCE must be api or html; got %v", *discoverySource)
+	}
+
+	maxHashDistance, err := readInt("MAX_HASH_DISTANCE", 6, false)
+	if err != nil {
+		return nil, err
+	}
+
+	classifyBatchSize, err := readInt("CLASSIFY_BATCH_SIZE", 1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if *classifyBatchSize < 1 {
+		return nil, fmt.Errorf("CLASSIFY_BATCH_SIZE must be at least 1; got %v", *classifyBatchSize)
+	}
+
+	classifyBatchWait, err := readMilliseconds("CLASSIFY_BATCH_WAIT_MS", 200*time.Millisecond, false)
+	if err != nil {
+		return nil, err
+	}
+
+	reclassifyCategories, err := readStringList("RECLASSIFY_CATEGORIES", []string{}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	taxonomy, err := readString("TAXONOMY", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	scope, err := readString("SCOPE", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	frontierRevisitAfter, err := readMilliseconds("FRONTIER_REVISIT_AFTER_MS", time.Hour, false)
+	if err != nil {
+		return nil, err
+	}
+
+	traversal, err := readString("TRAVERSAL", constants.TRAVERSAL_BFS, false)
+	if err != nil {
+		return nil, err
+	}
+
+	switch *traversal {
+	case constants.TRAVERSAL_BFS, constants.TRAVERSAL_DFS, constants.TRAVERSAL_BEST_FIRST:
+	default:
+		return nil, fmt.Errorf("TRAVERSAL must be %v, %v or %v; got %v",
+			constants.TRAVERSAL_BFS, constants.TRAVERSAL_DFS, constants.TRAVERSAL_BEST_FIRST, *traversal)
+	}
+
+	maxDepth, err := readInt64("MAX_DEPTH", -1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if *maxDepth < -1 || *maxDepth > math.MaxInt8 {
+		return nil, fmt.Errorf("MAX_DEPTH must be -1 or between 0 and %v; got %v", math.MaxInt8, *maxDepth)
+	}
+
+	pageTypeLimits, err := readString("PAGE_TYPE_LIMITS", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	seeds, err := readStringList("SEEDS", []string{"https://boards.4channel.org/g/"}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("SEEDS must contain at least one seed")
+	}
+
+	boardQuotas, err := readString("BOARD_QUOTAS", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseTimeout, err := readMilliseconds("LEASE_TIMEOUT_MS", time.Minute, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if *leaseTimeout < 3*time.Millisecond {
+		return nil, fmt.Errorf("LEASE_TIMEOUT_MS must be at least 3; got %v", leaseTimeout.Milliseconds())
+	}
+
+	runLockPolicy, err := readString("RUN_LOCK_POLICY", "skip", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if *runLockPolicy != "none" && *runLockPolicy != "skip" && *runLockPolicy != "wait" && *runLockPolicy != "takeover-stale" {
+		return nil, fmt.Errorf("RUN_LOCK_POLICY must be none, skip, wait or takeover-stale; got %v", *runLockPolicy)
+	}
+
+	runLockWait, err := readMilliseconds("RUN_LOCK_WAIT_MS", 5*time.Minute, false)
+	if err != nil {
+		return nil, err
+	}
+
+	runLockStaleAfter, err := readMilliseconds("RUN_LOCK_STALE_AFTER_MS", 5*time.Minute, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if *runLockStaleAfter < 3*time.Millisecond {
+		return nil, fmt.Errorf("RUN_LOCK_STALE_AFTER_MS must be at least 3; got %v", runLockStaleAfter.Milliseconds())
+	}
+
+	maxIdleConnsPerHost, err := readInt64("MAX_IDLE_CONNS_PER_HOST", 16, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if *maxIdleConnsPerHost < 0 || *maxIdleConnsPerHost > math.MaxInt32 {
+		return nil, fmt.Errorf("MAX_IDLE_CONNS_PER_HOST must be between 0 and %v; got %v", math.MaxInt32, *maxIdleConnsPerHost)
+	}
+
+	dialTimeout, err := readMilliseconds("DIAL_TIMEOUT_MS", 10*time.Second, false)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsHandshakeTimeout, err := readMilliseconds("TLS_HANDSHAKE_TIMEOUT_MS", 10*time.Second, false)
+	if err != nil {
+		return nil, err
+	}
+
+	responseHeaderTimeout, err := readMilliseconds("RESPONSE_HEADER_TIMEOUT_MS", 30*time.Second, false)
+	if err != nil {
+		return nil, err
+	}
+
+	requestTimeout, err := readMilliseconds("REQUEST_TIMEOUT_MS", 2*time.Minute, false)
+	if err != nil {
+		return nil, err
+	}
+
+	maxResponseBytes, err := readInt64("MAX_RESPONSE_BYTES", 32<<20, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if *maxResponseBytes < 0 {
+		return nil, fmt.Errorf("MAX_RESPONSE_BYTES must not be negative; got %v", *maxResponseBytes)
+	}
+
+	retryPolicies, err := readString("RETRY_POLICIES", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	hostRateLimits, err := readString("HOST_RATE_LIMITS", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimitReplicas, err := readInt("RATE_LIMIT_REPLICAS", 1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if *rateLimitReplicas < 1 {
+		return nil, fmt.Errorf("RATE_LIMIT_REPLICAS must be at least 1; got %v", *rateLimitReplicas)
+	}
+
+	metricsAddr, err := readString("METRICS_ADDR", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownGrace, err := readMilliseconds("SHUTDOWN_GRACE_MS", 20*time.Second, false)
 	if err != nil {
 		return nil, err
 	}
 
 	return &ScraperEnv{
-		ImageLimit:    int8(*hrefLimit),
-		ClassifyLimit: int8(*classifyLimit),
-		HtmlLimit:     int8(*htmlLimit),
-		VisionApiUrl:  *visionApiUrl,
+		ImageLimit:            int8(*hrefLimit),
+		ClassifyLimit:         int8(*classifyLimit),
+		HtmlLimit:             int8(*htmlLimit),
+		AdaptiveLimits:        *adaptiveLimits,
+		DiscoverySource:       *discoverySource,
+		MaxHashDistance:       int8(*maxHashDistance),
+		ClassifyBatchSize:     int8(*classifyBatchSize),
+		ClassifyBatchWait:     *classifyBatchWait,
+		ReclassifyCategories:  reclassifyCategories,
+		Taxonomy:              *taxonomy,
+		Scope:                 *scope,
+		FrontierRevisitAfter:  *frontierRevisitAfter,
+		Traversal:             *traversal,
+		MaxDepth:              int8(*maxDepth),
+		PageTypeLimits:        *pageTypeLimits,
+		Seeds:                 seeds,
+		BoardQuotas:           *boardQuotas,
+		LeaseTimeout:          *leaseTimeout,
+		RunLockPolicy:         *runLockPolicy,
+		RunLockWait:           *runLockWait,
+		RunLockStaleAfter:     *runLockStaleAfter,
+		MaxIdleConnsPerHost:   int(*maxIdleConnsPerHost),
+		DialTimeout:           *dialTimeout,
+		TLSHandshakeTimeout:   *tlsHandshakeTimeout,
+		ResponseHeaderTimeout: *responseHeaderTimeout,
+		RequestTimeout:        *requestTimeout,
+		MaxResponseBytes:      *maxResponseBytes,
+		RetryPolicies:         *retryPolicies,
+		HostRateLimits:        *hostRateLimits,
+		RateLimitReplicas:     int8(*rateLimitReplicas),
+		MetricsAddr:           *metricsAddr,
+		ShutdownGrace:         *shutdownGrace,
 	}, nil
 }
@@ -0,0 +1,45 @@
+package environment
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadScraperRunLock(t *testing.T) {
+	env, err := ReadScraper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.RunLockPolicy != "skip" || env.RunLockWait != 5*time.Minute || env.RunLockStaleAfter != 5*time.Minute {
+		t.Errorf("run lock is %v, %v, %v; want skip, 5m and 5m by default", env.RunLockPolicy, env.RunLockWait, env.RunLockStaleAfter)
+	}
+
+	t.Setenv("RUN_LOCK_POLICY", "takeover-stale")
+	t.Setenv("RUN_LOCK_STALE_AFTER_MS", "30000")
+	env, err = ReadScraper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.RunLockPolicy != "takeover-stale" || env.RunLockStaleAfter != 30*time.Second {
+		t.Errorf("run lock is %v, %v; want takeover-stale and 30s", env.RunLockPolicy, env.RunLockStaleAfter)
+	}
+}
+
+func TestReadScraperRejectsRunLock(t *testing.T) {
+	tests := []struct {
+		env   string
+		value string
+	}{
+		{"RUN_LOCK_POLICY", "steal"},
+		{"RUN_LOCK_STALE_AFTER_MS", "2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.env, func(t *testing.T) {
+			t.Setenv(test.env, test.value)
+			if _, err := ReadScraper(); err == nil {
+				t.Errorf("%v=%v: expected an error", test.env, test.value)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func readInt(env string, d int64, required bool) (*int64, error) {
@@ -37,3 +39,80 @@ func readString(env string, d string, required bool) (*string, error) {
 
 	return &envString, nil
 }
+
+func readBool(env string, d bool, required bool) (*bool, error) {
+	bString := os.Getenv(env)
+	if bString == "" {
+		var err error
+		if required {
+			err = fmt.Errorf("%s unset", env)
+		}
+		return &d, err
+	}
+
+	envBool, err := strconv.ParseBool(bString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &envBool, nil
+}
+
+// readStringList reads a comma separated list; surrounding whitespace and empty items are dropped
+func readStringList(env string, d []string, required bool) ([]string, error) {
+	envString, err := readString(env, "", required)
+	if err != nil {
+		return nil, err
+	}
+
+	if *envString == "" {
+		return d, nil
+	}
+
+	list := []string{}
+	for _, item := range strings.Split(*envString, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list, nil
+}
+
+func readInt64(env string, d int64, required bool) (*int64, error) {
+	iString := os.Getenv(env)
+	if iString == "" {
+		var err error
+		if required {
+			err = fmt.Errorf("%s unset", env)
+		}
+		return &d, err
+	}
+
+	envInt, err := strconv.ParseInt(iString, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &envInt, nil
+}
+
+func readMilliseconds(env string, d time.Duration, required bool) (*time.Duration, error) {
+	msString := os.Getenv(env)
+	if msString == "" {
+		var err error
+		if required {
+			err = fmt.Errorf("%s unset", env)
+		}
+		return &d, err
+	}
+
+	ms, err := strconv.ParseInt(msString, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	duration := time.Duration(ms) * time.Millisecond
+	return &duration, nil
+}
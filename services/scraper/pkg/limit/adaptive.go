@@ -0,0 +1,162 @@
+package limit
+
+import (
+	"context"
+	"go-find-pepe/pkg/metrics"
+	"math"
+	"sync"
+	"time"
+)
+
+// work is slow once its recent latency exceeds the baseline by slowFactor; both
+// are moving averages of the latency, of which the baseline follows slowly
+const (
+	slowFactor     = 2
+	recentWeight   = 0.2
+	baselineWeight = 0.02
+	// share of the limit kept after a cut
+	decreaseFactor = 0.5
+)
+
+// Feedback is implemented by limiters that adapt to how the work they limit went
+type Feedback interface {
+	// Observe reports the latency of a piece of work and whether it failed in a
+	// way that suggests the destination is overloaded, e.g. a timeout or a 5xx
+	Observe(latency time.Duration, overloaded bool)
+}
+
+type AdaptiveArguments struct {
+	// label of the limit metric, e.g. downloads
+	Name    string
+	Initial int
+	Min     int
+	Max     int
+	// gauge the current limit is reported to, labelled by Name; may be nil
+	Gauge *metrics.Gauge
+}
+
+// AdaptiveLimiter caps concurrency at a limit that grows by one per limit's worth
+// of healthy work and is halved on overloaded or slow work (AIMD)
+type AdaptiveLimiter struct {
+	name  string
+	min   float64
+	max   float64
+	gauge *metrics.Gauge
+
+	m        sync.Mutex
+	limit    float64
+	inFlight int
+	// closed and replaced whenever a slot may have become free
+	changed chan bool
+	// moving averages of the latency of work that was not overloaded
+	recent   time.Duration
+	baseline time.Duration
+	// work that started before the last cut does not cut again
+	cutAt time.Time
+}
+
+func NewAdaptiveLimiter(arg AdaptiveArguments) *AdaptiveLimiter {
+	if arg.Min < 1 {
+		arg.Min = 1
+	}
+	if arg.Max < arg.Min {
+		arg.Max = arg.Min
+	}
+	initial := math.Max(float64(arg.Min), math.Min(float64(arg.Max), float64(arg.Initial)))
+
+	l := &AdaptiveLimiter{
+		name:    arg.Name,
+		min:     float64(arg.Min),
+		max:     float64(arg.Max),
+		gauge:   arg.Gauge,
+		limit:   initial,
+		changed: make(chan bool),
+	}
+	l.report()
+	return l
+}
+
+func (l *AdaptiveLimiter) Add(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		l.m.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			l.m.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.m.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *AdaptiveLimiter) Done() {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.inFlight--
+	l.broadcast()
+}
+
+func (l *AdaptiveLimiter) Observe(latency time.Duration, overloaded bool) {
+	now := time.Now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if !overloaded {
+		l.recent = average(l.recent, latency, recentWeight)
+		l.baseline = average(l.baseline, latency, baselineWeight)
+	}
+
+	if overloaded || l.recent > l.baseline*slowFactor {
+		// the work in flight during a cut reports the same trouble; cut once for all of it
+		if now.Add(-latency).Before(l.cutAt) {
+			return
+		}
+		l.cutAt = now
+		l.limit = math.Max(l.min, math.Floor(l.limit*decreaseFactor))
+		l.report()
+		return
+	}
+
+	l.limit = math.Min(l.max, l.limit+1/l.limit)
+	l.report()
+	l.broadcast()
+}
+
+// Limit returns the current limit
+func (l *AdaptiveLimiter) Limit() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return int(l.limit)
+}
+
+// average moves the moving average towards sample by weight; the first sample is taken as is
+func average(current time.Duration, sample time.Duration, weight float64) time.Duration {
+	if current == 0 {
+		return sample
+	}
+	return current + time.Duration(weight*float64(sample-current))
+}
+
+func (l *AdaptiveLimiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan bool)
+}
+
+func (l *AdaptiveLimiter) report() {
+	if l.gauge != nil {
+		l.gauge.Set(math.Floor(l.limit), l.name)
+	}
+}
@@ -0,0 +1,132 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveIncrease(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveArguments{Initial: 2, Min: 1, Max: 4})
+
+	// the limit grows by one for about a limit's worth of healthy work: 2.5, 2.9, 3.24
+	for i, want := range []int{2, 2, 3} {
+		l.Observe(10*time.Millisecond, false)
+		if got := l.Limit(); got != want {
+			t.Errorf("limit is %v after %v observations; want %v", got, i+1, want)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Observe(10*time.Millisecond, false)
+	}
+	if got := l.Limit(); got != 4 {
+		t.Errorf("limit is %v; want it clamped to the max of 4", got)
+	}
+}
+
+func TestAdaptiveDecrease(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveArguments{Initial: 8, Min: 3, Max: 8})
+
+	l.Observe(10*time.Millisecond, true)
+	if got := l.Limit(); got != 4 {
+		t.Errorf("limit is %v after overloaded work; want it halved to 4", got)
+	}
+
+	// work that started before the cut reports the same trouble
+	l.Observe(10*time.Millisecond, true)
+	if got := l.Limit(); got != 4 {
+		t.Errorf("limit is %v after overloaded work of the same window; want 4", got)
+	}
+
+	// work that started after the cut cuts again, but not below the min
+	time.Sleep(5 * time.Millisecond)
+	l.Observe(time.Millisecond, true)
+	if got := l.Limit(); got != 3 {
+		t.Errorf("limit is %v after overloaded work of a new window; want it clamped to the min of 3", got)
+	}
+}
+
+func TestAdaptiveSlowWork(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveArguments{Initial: 8, Min: 1, Max: 8})
+
+	for i := 0; i < 20; i++ {
+		l.Observe(10*time.Millisecond, false)
+	}
+	if got := l.Limit(); got != 8 {
+		t.Fatalf("limit is %v after healthy work; want 8", got)
+	}
+
+	// the recent latency follows quickly, the baseline slowly
+	for i := 0; i < 10 && l.Limit() == 8; i++ {
+		l.Observe(time.Second, false)
+	}
+	if got := l.Limit(); got != 4 {
+		t.Errorf("limit is %v after slow work; want it halved to 4", got)
+	}
+}
+
+func TestAdaptiveArguments(t *testing.T) {
+	tests := []struct {
+		arg  AdaptiveArguments
+		want int
+	}{
+		{AdaptiveArguments{Initial: 5, Min: 1, Max: 10}, 5},
+		{AdaptiveArguments{Initial: 50, Min: 1, Max: 10}, 10},
+		{AdaptiveArguments{Initial: 0, Min: 2, Max: 10}, 2},
+		{AdaptiveArguments{Initial: 0, Min: 0, Max: 0}, 1},
+	}
+
+	for _, test := range tests {
+		if got := NewAdaptiveLimiter(test.arg).Limit(); got != test.want {
+			t.Errorf("%+v: initial limit is %v; want %v", test.arg, got, test.want)
+		}
+	}
+}
+
+func TestAdaptiveAddBlocks(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveArguments{Initial: 2, Min: 1, Max: 2})
+	ctx := context.Background()
+
+	for i := 0; i < l.Limit(); i++ {
+		if err := l.Add(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	added := make(chan error)
+	go func() {
+		added <- l.Add(ctx)
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("added beyond the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l.Done()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Errorf("add returned %v once a slot was free", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add blocked after a slot became free")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		added <- l.Add(cancelled)
+	}()
+	cancel()
+
+	select {
+	case err := <-added:
+		if err != context.Canceled {
+			t.Errorf("add returned %v once ctx was cancelled; want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add blocked after ctx was cancelled")
+	}
+}
@@ -1,45 +1,34 @@
 package limit
 
-import "sync"
+import "context"
 
 type Limiter interface {
-	Add()
+	// Add waits for a free slot; returns the error of ctx if ctx is done first
+	Add(ctx context.Context) error
 	Done()
 }
 
 type limiter struct {
-	total   int8
-	amount  int8
-	waiting int8
-	done    chan bool
-	m       sync.Mutex
+	slots chan bool
 }
 
-func (l *limiter) Add() {
-	l.m.Lock()
-
-	if l.amount >= l.total {
-		l.waiting += 1
-		<-l.done
+func (l *limiter) Add(ctx context.Context) error {
+	select {
+	case l.slots <- true:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	l.amount += 1
-	l.m.Unlock()
 }
 
 func (l *limiter) Done() {
-	l.amount -= 1
-
-	if l.waiting > 0 {
-		l.waiting -= 1
-		l.done <- true
-	}
+	<-l.slots
 }
 
 type noopLimiter struct{}
 
-func (l *noopLimiter) Add()  {}
-func (l *noopLimiter) Done() {}
+func (l *noopLimiter) Add(ctx context.Context) error { return ctx.Err() }
+func (l *noopLimiter) Done()                         {}
 
 func NewLimiter(total int8) Limiter {
 	// -1 is uncapped
@@ -48,8 +37,6 @@ func NewLimiter(total int8) Limiter {
 	}
 
 	return &limiter{
-		total: total,
-		m:     sync.Mutex{},
-		done:  make(chan bool),
+		slots: make(chan bool, total),
 	}
 }
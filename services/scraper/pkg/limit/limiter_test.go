@@ -0,0 +1,41 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterWaitsForSlot(t *testing.T) {
+	l := NewLimiter(1)
+	if err := l.Add(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Add(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("added beyond the limit; %v", err)
+	}
+
+	l.Done()
+	if err := l.Add(context.Background()); err != nil {
+		t.Errorf("no slot after done; %v", err)
+	}
+}
+
+func TestUncappedLimiter(t *testing.T) {
+	l := NewLimiter(-1)
+	for i := 0; i < 200; i++ {
+		if err := l.Add(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Add(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("added once cancelled; %v", err)
+	}
+}
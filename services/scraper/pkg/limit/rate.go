@@ -0,0 +1,287 @@
+package limit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// AnyHost is the key of the rate of hosts without a rate of their own
+const AnyHost = "*"
+
+// a host that keeps throttling is backed off from throttleBackoff, doubling up to maxThrottleBackoff
+const (
+	throttleBackoff    = 2 * time.Second
+	maxThrottleBackoff = 5 * time.Minute
+)
+
+// Rate limits the requests to a single host
+type Rate struct {
+	// tokens added to the bucket per second; 0 is unlimited
+	RequestsPerSecond float64
+	// tokens the bucket holds, i.e. requests that may be sent at once after an idle period
+	Burst int
+	// least time between the starts of two requests
+	MinDelay time.Duration
+}
+
+// DefaultRates follow the api rules of 4chan, which ask for at most one request per
+// second; the board pages are fetched as politely, the image cdn is limited more
+// loosely and other hosts more loosely still. The rates are those of all replicas
+// together, see Share
+func DefaultRates() *Rates {
+	return &Rates{
+		hosts: map[string]Rate{
+			"a.4cdn.org":       {RequestsPerSecond: 1, Burst: 1, MinDelay: time.Second},
+			"boards.4chan.org": {RequestsPerSecond: 1, Burst: 1, MinDelay: time.Second},
+			"i.4cdn.org":       {RequestsPerSecond: 2, Burst: 2},
+		},
+		fallback: Rate{RequestsPerSecond: 5, Burst: 5},
+	}
+}
+
+// rateJson is a Rate as configured; nil fields keep the value of the rate it is parsed onto
+type rateJson struct {
+	RequestsPerSecond *float64 `json:"requests_per_second"`
+	Burst             *int     `json:"burst"`
+	MinDelayMs        *int64   `json:"min_delay_ms"`
+}
+
+func asJson(r Rate) rateJson {
+	minDelayMs := r.MinDelay.Milliseconds()
+	return rateJson{RequestsPerSecond: &r.RequestsPerSecond, Burst: &r.Burst, MinDelayMs: &minDelayMs}
+}
+
+func (j rateJson) onto(r Rate) (Rate, error) {
+	if j.RequestsPerSecond != nil {
+		r.RequestsPerSecond = *j.RequestsPerSecond
+	}
+	if j.Burst != nil {
+		r.Burst = *j.Burst
+	}
+	if j.MinDelayMs != nil {
+		r.MinDelay = time.Duration(*j.MinDelayMs) * time.Millisecond
+	}
+
+	if r.RequestsPerSecond < 0 {
+		return r, fmt.Errorf("requests_per_second must not be negative; got %v", r.RequestsPerSecond)
+	}
+	if r.RequestsPerSecond > 0 && r.Burst < 1 {
+		return r, fmt.Errorf("burst must be at least 1; got %v", r.Burst)
+	}
+	if r.MinDelay < 0 {
+		return r, fmt.Errorf("min_delay_ms must not be negative; got %v", r.MinDelay.Milliseconds())
+	}
+	return r, nil
+}
+
+// Rates holds the rate per host
+type Rates struct {
+	hosts    map[string]Rate
+	fallback Rate
+}
+
+// ParseRates reads the rate per host from json onto DefaultRates; the rate of
+// AnyHost replaces the rate of hosts without one of their own
+func ParseRates(raw string) (*Rates, error) {
+	rates := DefaultRates()
+	if raw == "" {
+		return rates, nil
+	}
+
+	js := map[string]rateJson{}
+	err := json.Unmarshal([]byte(raw), &js)
+	if err != nil {
+		return nil, err
+	}
+
+	if j, ok := js[AnyHost]; ok {
+		rates.fallback, err = j.onto(rates.fallback)
+		if err != nil {
+			return nil, fmt.Errorf("rate of %v; %w", AnyHost, err)
+		}
+	}
+
+	for host, j := range js {
+		if host == AnyHost {
+			continue
+		}
+
+		base, ok := rates.hosts[host]
+		if !ok {
+			base = rates.fallback
+		}
+
+		rates.hosts[host], err = j.onto(base)
+		if err != nil {
+			return nil, fmt.Errorf("rate of %v; %w", host, err)
+		}
+	}
+
+	return rates, nil
+}
+
+// For returns the rate of host
+func (r *Rates) For(host string) Rate {
+	if rate, ok := r.hosts[host]; ok {
+		return rate
+	}
+	return r.fallback
+}
+
+// share returns the share of r of one of replicas that send requests at the same time
+func (r Rate) share(replicas int) Rate {
+	r.RequestsPerSecond /= float64(replicas)
+	r.Burst = int(math.Max(1, math.Ceil(float64(r.Burst)/float64(replicas))))
+	r.MinDelay *= time.Duration(replicas)
+	return r
+}
+
+// Share returns the rates of one of replicas that send requests at the same time,
+// so that all of them together keep to r; the buckets of the replicas are not
+// coordinated, so requests of different replicas may still start at once
+func (r *Rates) Share(replicas int) *Rates {
+	if replicas <= 1 {
+		return r
+	}
+
+	shared := &Rates{hosts: map[string]Rate{}, fallback: r.fallback.share(replicas)}
+	for host, rate := range r.hosts {
+		shared.hosts[host] = rate.share(replicas)
+	}
+	return shared
+}
+
+// MarshalJSON lists the rates for the configuration snapshot of a run
+func (r *Rates) MarshalJSON() ([]byte, error) {
+	all := map[string]rateJson{AnyHost: asJson(r.fallback)}
+	for host, rate := range r.hosts {
+		all[host] = asJson(rate)
+	}
+	return json.Marshal(all)
+}
+
+// bucket is the token bucket of a host
+type bucket struct {
+	rate   Rate
+	tokens float64
+	// when tokens was last refilled
+	refilled time.Time
+	// no request starts before next, by the minimum delay or a backoff
+	next time.Time
+	// consecutive throttled responses
+	throttled int
+}
+
+// HostRateLimiter spaces the requests to every host by its rate; it does not cap
+// how many requests are in flight, which is what Limiter is for
+type HostRateLimiter struct {
+	rates   *Rates
+	m       sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewHostRateLimiter(rates *Rates) *HostRateLimiter {
+	if rates == nil {
+		rates = DefaultRates()
+	}
+	return &HostRateLimiter{rates: rates, buckets: map[string]*bucket{}}
+}
+
+func (l *HostRateLimiter) bucketOf(host string, now time.Time) *bucket {
+	b, ok := l.buckets[host]
+	if !ok {
+		rate := l.rates.For(host)
+		b = &bucket{rate: rate, tokens: float64(rate.Burst), refilled: now}
+		l.buckets[host] = b
+	}
+	return b
+}
+
+// reserve takes a token of b and returns when the request it is for may start
+func (b *bucket) reserve(now time.Time) time.Time {
+	at := now
+	if b.next.After(at) {
+		at = b.next
+	}
+
+	if b.rate.RequestsPerSecond > 0 {
+		elapsed := now.Sub(b.refilled).Seconds()
+		b.tokens = math.Min(float64(b.rate.Burst), b.tokens+elapsed*b.rate.RequestsPerSecond)
+		b.refilled = now
+
+		if b.tokens < 1 {
+			available := now.Add(time.Duration((1 - b.tokens) / b.rate.RequestsPerSecond * float64(time.Second)))
+			if available.After(at) {
+				at = available
+			}
+		}
+		b.tokens--
+	}
+
+	b.next = at.Add(b.rate.MinDelay)
+	return at
+}
+
+// Wait waits until a request to host may start; returns the error of ctx if ctx
+// is done first, in which case the turn of the request is lost
+func (l *HostRateLimiter) Wait(ctx context.Context, host string) error {
+	now := time.Now()
+
+	l.m.Lock()
+	at := l.bucketOf(host, now).reserve(now)
+	l.m.Unlock()
+
+	wait := at.Sub(now)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Throttled backs host off after it responded 429 or 503, for at least retryAfter;
+// the backoff doubles with every consecutive throttled response. Returns the backoff
+func (l *HostRateLimiter) Throttled(host string, retryAfter time.Duration) time.Duration {
+	now := time.Now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	b := l.bucketOf(host, now)
+	b.throttled++
+
+	backoff := throttleBackoff << (b.throttled - 1)
+	if b.throttled > 16 || backoff > maxThrottleBackoff {
+		backoff = maxThrottleBackoff
+	}
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+
+	if until := now.Add(backoff); until.After(b.next) {
+		b.next = until
+	}
+	return backoff
+}
+
+// Succeeded resets the backoff of host after it responded without throttling
+func (l *HostRateLimiter) Succeeded(host string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if b, ok := l.buckets[host]; ok {
+		b.throttled = 0
+	}
+}
@@ -0,0 +1,164 @@
+package limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	start := time.Date(2020, 11, 10, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		rate Rate
+		// offsets from start at which requests are reserved
+		at []time.Duration
+		// offsets from start at which the requests may start
+		want []time.Duration
+	}{
+		{
+			"burst then refill",
+			Rate{RequestsPerSecond: 2, Burst: 2},
+			[]time.Duration{0, 0, 0, 0},
+			[]time.Duration{0, 0, 500 * time.Millisecond, time.Second},
+		},
+		{
+			"refilled while idle",
+			Rate{RequestsPerSecond: 1, Burst: 1},
+			[]time.Duration{0, 3 * time.Second, 3 * time.Second},
+			[]time.Duration{0, 3 * time.Second, 4 * time.Second},
+		},
+		{
+			"refill capped at burst",
+			Rate{RequestsPerSecond: 1, Burst: 2},
+			[]time.Duration{0, 10 * time.Second, 10 * time.Second, 10 * time.Second},
+			[]time.Duration{0, 10 * time.Second, 10 * time.Second, 11 * time.Second},
+		},
+		{
+			"min delay",
+			Rate{RequestsPerSecond: 10, Burst: 10, MinDelay: time.Second},
+			[]time.Duration{0, 0, 1500 * time.Millisecond},
+			[]time.Duration{0, time.Second, 2 * time.Second},
+		},
+		{
+			"unlimited",
+			Rate{},
+			[]time.Duration{0, 0, 0},
+			[]time.Duration{0, 0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		b := &bucket{rate: test.rate, tokens: float64(test.rate.Burst), refilled: start}
+		for i, at := range test.at {
+			got := b.reserve(start.Add(at)).Sub(start)
+			if got != test.want[i] {
+				t.Errorf("%v: request %v may start at %v; want %v", test.name, i, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestThrottledBackoff(t *testing.T) {
+	l := NewHostRateLimiter(nil)
+
+	for i, want := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second} {
+		if got := l.Throttled("a.4cdn.org", 0); got != want {
+			t.Errorf("throttled response %v backs off %v; want %v", i+1, got, want)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Throttled("a.4cdn.org", 0)
+	}
+	if got := l.Throttled("a.4cdn.org", 0); got != maxThrottleBackoff {
+		t.Errorf("backs off %v after many throttled responses; want at most %v", got, maxThrottleBackoff)
+	}
+
+	l.Succeeded("a.4cdn.org")
+	if got := l.Throttled("a.4cdn.org", 0); got != throttleBackoff {
+		t.Errorf("backs off %v after a success; want %v", got, throttleBackoff)
+	}
+
+	// other hosts keep their own backoff
+	if got := l.Throttled("i.4cdn.org", 0); got != throttleBackoff {
+		t.Errorf("another host backs off %v; want %v", got, throttleBackoff)
+	}
+}
+
+func TestThrottledRetryAfter(t *testing.T) {
+	l := NewHostRateLimiter(nil)
+
+	if got := l.Throttled("a.4cdn.org", time.Minute); got != time.Minute {
+		t.Errorf("backs off %v; want the retry after of %v", got, time.Minute)
+	}
+	// a shorter retry after does not shorten the doubled backoff
+	if got := l.Throttled("a.4cdn.org", time.Second); got != 4*time.Second {
+		t.Errorf("backs off %v; want %v", got, 4*time.Second)
+	}
+
+	now := time.Now()
+	b := l.buckets["a.4cdn.org"]
+	if b.next.Before(now.Add(50 * time.Second)) {
+		t.Errorf("next request may start at %v; want the retry after to be kept", b.next)
+	}
+	if at := b.reserve(now); at.Before(now.Add(50 * time.Second)) {
+		t.Errorf("request reserved at %v during the backoff", at)
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates(`{"*": {"requests_per_second": 10}, "a.4cdn.org": {"min_delay_ms": 2000}, "example.org": {"burst": 3}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want Rate
+	}{
+		{"a.4cdn.org", Rate{RequestsPerSecond: 1, Burst: 1, MinDelay: 2 * time.Second}},
+		{"boards.4chan.org", Rate{RequestsPerSecond: 1, Burst: 1, MinDelay: time.Second}},
+		{"i.4cdn.org", Rate{RequestsPerSecond: 2, Burst: 2}},
+		{"example.org", Rate{RequestsPerSecond: 10, Burst: 3}},
+		{"other.org", Rate{RequestsPerSecond: 10, Burst: 5}},
+	}
+	for _, test := range tests {
+		if got := rates.For(test.host); got != test.want {
+			t.Errorf("rate of %v is %+v; want %+v", test.host, got, test.want)
+		}
+	}
+
+	for _, raw := range []string{
+		`{"*": {"requests_per_second": -1}}`,
+		`{"a.4cdn.org": {"burst": 0}}`,
+		`{"a.4cdn.org": {"min_delay_ms": -1}}`,
+		`not json`,
+	} {
+		if _, err := ParseRates(raw); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
+
+func TestShare(t *testing.T) {
+	rates := DefaultRates().Share(2)
+
+	tests := []struct {
+		host string
+		want Rate
+	}{
+		{"a.4cdn.org", Rate{RequestsPerSecond: 0.5, Burst: 1, MinDelay: 2 * time.Second}},
+		{"i.4cdn.org", Rate{RequestsPerSecond: 1, Burst: 1}},
+		{"other.org", Rate{RequestsPerSecond: 2.5, Burst: 3}},
+	}
+	for _, test := range tests {
+		if got := rates.For(test.host); got != test.want {
+			t.Errorf("shared rate of %v is %+v; want %+v", test.host, got, test.want)
+		}
+	}
+
+	if one := DefaultRates().Share(1); one.For("a.4cdn.org") != DefaultRates().For("a.4cdn.org") {
+		t.Error("a single replica does not keep the rates")
+	}
+}
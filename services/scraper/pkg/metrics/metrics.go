@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	kindCounter = "counter"
+	kindGauge   = "gauge"
+)
+
+// Registry holds the counters and gauges of a process and exposes them in the
+// Prometheus text exposition format
+type Registry struct {
+	m        sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// family is a metric with one sample per combination of label values
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	m          sync.Mutex
+	samples    map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// Counter only goes up
+type Counter struct {
+	f *family
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	f *family
+}
+
+// NewCounter registers a counter with labelNames; registering a name twice
+// returns the same counter
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{f: r.register(name, help, kindCounter, labelNames)}
+}
+
+// NewGauge registers a gauge with labelNames; registering a name twice returns
+// the same gauge
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{f: r.register(name, help, kindGauge, labelNames)}
+}
+
+func (r *Registry) register(name string, help string, kind string, labelNames []string) *family {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		if f.kind != kind || len(f.labelNames) != len(labelNames) {
+			panic(fmt.Errorf("metric %v is already registered as another %v", name, f.kind))
+		}
+		return f
+	}
+
+	f := &family{name: name, help: help, kind: kind, labelNames: labelNames, samples: map[string]*sample{}}
+	r.families[name] = f
+	return f
+}
+
+// Inc adds one to the sample of labelValues
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the sample of labelValues
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Errorf("counter %v cannot decrease; got %v", c.f.name, v))
+	}
+	c.f.update(labelValues, func(s *sample) { s.value += v })
+}
+
+// Set sets the sample of labelValues to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *sample) { s.value = v })
+}
+
+// Add adds v to the sample of labelValues
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *sample) { s.value += v })
+}
+
+func (f *family) update(labelValues []string, u func(s *sample)) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Errorf("metric %v has labels %v; got values %v", f.name, f.labelNames, labelValues))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	s, ok := f.samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string{}, labelValues...)}
+		f.samples[key] = s
+	}
+	u(s)
+}
+
+// WriteText writes every metric in the Prometheus text exposition format,
+// ordered by name and label values
+func (r *Registry) WriteText(w io.Writer) error {
+	r.m.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.m.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	buffered := bufio.NewWriter(w)
+	for _, f := range families {
+		f.writeText(buffered)
+	}
+	return buffered.Flush()
+}
+
+func (f *family) writeText(w *bufio.Writer) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.samples))
+	for key := range f.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.samples[key]
+		w.WriteString(f.name)
+		if len(f.labelNames) > 0 {
+			w.WriteString("{")
+			for i, name := range f.labelNames {
+				if i > 0 {
+					w.WriteString(",")
+				}
+				fmt.Fprintf(w, "%v=\"%v\"", name, escapeLabelValue(s.labelValues[i]))
+			}
+			w.WriteString("}")
+		}
+		fmt.Fprintf(w, " %v\n", formatValue(s.value))
+	}
+}
+
+// Handler serves the metrics in the Prometheus text exposition format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := r.WriteText(w)
+		if err != nil {
+			fmt.Printf("Failed to write metrics; %v\n", err)
+		}
+	})
+}
+
+// Serve serves the metrics at /metrics on addr in the background
+func (r *Registry) Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+
+	go func() {
+		fmt.Printf("Serving metrics on %v/metrics\n", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			fmt.Printf("Stopped serving metrics; %v\n", err)
+		}
+	}()
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
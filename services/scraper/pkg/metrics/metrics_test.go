@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounter("scraper_http_requests_total", "Requests sent\nper host", "host", "status")
+	requests.Inc("a.4cdn.org", "200")
+	requests.Inc("a.4cdn.org", "200")
+	requests.Add(0.5, "i.4cdn.org", "404")
+	requests.Inc(`quo"te\back`+"\nline", "500")
+
+	limit := r.NewGauge("scraper_concurrency_limit", "Current concurrency limit", "stage")
+	limit.Set(8, "downloads")
+	limit.Add(-3, "downloads")
+	limit.Set(math.Inf(1), "classifications")
+
+	unlabelled := r.NewGauge("scraper_up", `Whether the scraper runs; a \ is escaped`)
+	unlabelled.Set(1)
+	r.NewCounter("scraper_empty_total", "Counter without samples")
+
+	want := `# HELP scraper_concurrency_limit Current concurrency limit
+# TYPE scraper_concurrency_limit gauge
+scraper_concurrency_limit{stage="classifications"} +Inf
+scraper_concurrency_limit{stage="downloads"} 5
+# HELP scraper_empty_total Counter without samples
+# TYPE scraper_empty_total counter
+# HELP scraper_http_requests_total Requests sent\nper host
+# TYPE scraper_http_requests_total counter
+scraper_http_requests_total{host="a.4cdn.org",status="200"} 2
+scraper_http_requests_total{host="i.4cdn.org",status="404"} 0.5
+scraper_http_requests_total{host="quo\"te\\back\nline",status="500"} 1
+# HELP scraper_up Whether the scraper runs; a \\ is escaped
+# TYPE scraper_up gauge
+scraper_up 1
+`
+
+	buffer := &bytes.Buffer{}
+	err := r.WriteText(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != want {
+		t.Errorf("got\n%v\nwant\n%v", buffer.String(), want)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+
+	r.NewCounter("scraper_retries_total", "Retries", "host").Inc("a.4cdn.org")
+	r.NewCounter("scraper_retries_total", "Retries", "host").Inc("a.4cdn.org")
+
+	buffer := &bytes.Buffer{}
+	r.WriteText(buffer)
+	if !bytes.Contains(buffer.Bytes(), []byte(`scraper_retries_total{host="a.4cdn.org"} 2`)) {
+		t.Errorf("counter registered twice was not shared; got\n%v", buffer.String())
+	}
+
+	for name, f := range map[string]func(){
+		"as another kind":        func() { r.NewGauge("scraper_retries_total", "Retries", "host") },
+		"with other labels":      func() { r.NewCounter("scraper_retries_total", "Retries", "host", "status") },
+		"with too few values":    func() { r.NewCounter("scraper_retries_total", "Retries", "host").Inc() },
+		"decreasing the counter": func() { r.NewCounter("scraper_retries_total", "Retries", "host").Add(-1, "a.4cdn.org") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("did not panic %v", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("scraper_pages_total", "Pages").Inc()
+
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	response := recorder.Result()
+	if got := response.Header.Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content type is %v", got)
+	}
+	body, _ := io.ReadAll(response.Body)
+	if string(body) != "# HELP scraper_pages_total Pages\n# TYPE scraper_pages_total counter\nscraper_pages_total 1\n" {
+		t.Errorf("served %q", body)
+	}
+}
@@ -0,0 +1,89 @@
+package phash
+
+import "sync"
+
+// BKTree indexes hashes by hamming distance so near-duplicates can be found
+// without comparing against every stored hash
+type BKTree struct {
+	root *bkNode
+	m    sync.RWMutex
+}
+
+type bkNode struct {
+	hash     uint64
+	ids      []uint
+	children map[int]*bkNode
+}
+
+type Match struct {
+	ID       uint
+	Distance int
+}
+
+func NewBKTree() *BKTree {
+	return &BKTree{}
+}
+
+// Add indexes id by hash; adding the same id and hash again has no effect
+func (t *BKTree) Add(hash uint64, id uint) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, ids: []uint{id}, children: map[int]*bkNode{}}
+		return
+	}
+
+	node := t.root
+	for {
+		d := Distance(node.hash, hash)
+		if d == 0 {
+			for _, existing := range node.ids {
+				if existing == id {
+					return
+				}
+			}
+			node.ids = append(node.ids, id)
+			return
+		}
+
+		child, ok := node.children[d]
+		if !ok {
+			node.children[d] = &bkNode{hash: hash, ids: []uint{id}, children: map[int]*bkNode{}}
+			return
+		}
+		node = child
+	}
+}
+
+// Search returns every id whose hash is within maxDistance of hash
+func (t *BKTree) Search(hash uint64, maxDistance int) []Match {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	var matches []Match
+	if t.root == nil {
+		return matches
+	}
+
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		d := Distance(node.hash, hash)
+		if d <= maxDistance {
+			for _, id := range node.ids {
+				matches = append(matches, Match{ID: id, Distance: d})
+			}
+		}
+
+		for childDistance, child := range node.children {
+			if childDistance >= d-maxDistance && childDistance <= d+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+
+	return matches
+}
@@ -0,0 +1,78 @@
+package phash
+
+import (
+	"sort"
+	"testing"
+)
+
+func idsOf(matches []Match) []uint {
+	ids := []uint{}
+	for _, m := range matches {
+		ids = append(ids, m.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	tree := NewBKTree()
+	tree.Add(0b0000, 1)
+	tree.Add(0b0001, 2)
+	tree.Add(0b0011, 3)
+	tree.Add(0b0111, 4)
+	tree.Add(0b1111, 5)
+	tree.Add(0b0011, 6)
+	tree.Add(^uint64(0), 7)
+
+	tests := []struct {
+		name        string
+		hash        uint64
+		maxDistance int
+		want        []uint
+	}{
+		{"exact", 0b0011, 0, []uint{3, 6}},
+		{"within one", 0b0011, 1, []uint{2, 3, 4, 6}},
+		{"at the radius", 0b0000, 2, []uint{1, 2, 3, 6}},
+		{"beyond the radius", 0b0000, 3, []uint{1, 2, 3, 4, 6}},
+		{"far away", 0b0000, 59, []uint{1, 2, 3, 4, 5, 6}},
+		{"everything", 0b0000, 64, []uint{1, 2, 3, 4, 5, 6, 7}},
+		{"nothing near", ^uint64(0) >> 1, 0, []uint{}},
+	}
+
+	for _, test := range tests {
+		matches := tree.Search(test.hash, test.maxDistance)
+		got := idsOf(matches)
+		if len(got) != len(test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+		for _, m := range matches {
+			if m.Distance > test.maxDistance {
+				t.Errorf("%v: %v at distance %v is beyond %v", test.name, m.ID, m.Distance, test.maxDistance)
+			}
+		}
+	}
+}
+
+func TestSearchEmpty(t *testing.T) {
+	if matches := NewBKTree().Search(0, 64); len(matches) != 0 {
+		t.Errorf("empty tree matched %v", matches)
+	}
+}
+
+func TestAddTwice(t *testing.T) {
+	tree := NewBKTree()
+	tree.Add(0b0101, 1)
+	tree.Add(0b0101, 1)
+	tree.Add(0b0101, 2)
+
+	if got := idsOf(tree.Search(0b0101, 0)); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("got %v, want [1 2]", got)
+	}
+}
@@ -0,0 +1,134 @@
+package phash
+
+import (
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Decode reads a jpg, png or gif; for animated gifs only the first frame is returned
+func Decode(r io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// Distance is the hamming distance between two hashes
+func Distance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// DHash is the difference hash; each bit tells whether a pixel is brighter than
+// its right neighbour in a 9x8 grayscale thumbnail
+func DHash(img image.Image) uint64 {
+	pixels := grayscale(img, 9, 8)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if pixels[y*9+x] > pixels[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// PHash is the perceptual hash; each bit tells whether a low frequency DCT
+// coefficient of a 32x32 grayscale thumbnail is above the median
+func PHash(img image.Image) uint64 {
+	const size = 32
+	const lowSize = 8
+
+	pixels := grayscale(img, size, size)
+	coefficients := dct2d(pixels, size)
+
+	low := make([]float64, 0, lowSize*lowSize)
+	for y := 0; y < lowSize; y++ {
+		for x := 0; x < lowSize; x++ {
+			low = append(low, coefficients[y*size+x])
+		}
+	}
+
+	// the DC coefficient only reflects the average brightness
+	sorted := append([]float64{}, low[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for _, c := range low {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+
+	return hash
+}
+
+// grayscale scales img down to width x height by averaging the luminance of
+// all source pixels that fall into each target pixel
+func grayscale(img image.Image, width int, height int) []float64 {
+	bounds := img.Bounds()
+	sums := make([]float64, width*height)
+	counts := make([]float64, width*height)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		ty := (y - bounds.Min.Y) * height / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			tx := (x - bounds.Min.X) * width / bounds.Dx()
+
+			r, g, b, _ := img.At(x, y).RGBA()
+			sums[ty*width+tx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			counts[ty*width+tx]++
+		}
+	}
+
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= counts[i]
+		}
+	}
+
+	return sums
+}
+
+// dct2d is a type-II discrete cosine transform over a size x size matrix
+func dct2d(pixels []float64, size int) []float64 {
+	cos := make([]float64, size*size)
+	for u := 0; u < size; u++ {
+		for x := 0; x < size; x++ {
+			cos[u*size+x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / float64(2*size))
+		}
+	}
+
+	rows := make([]float64, size*size)
+	for y := 0; y < size; y++ {
+		for u := 0; u < size; u++ {
+			var sum float64
+			for x := 0; x < size; x++ {
+				sum += pixels[y*size+x] * cos[u*size+x]
+			}
+			rows[y*size+u] = sum
+		}
+	}
+
+	result := make([]float64, size*size)
+	for u := 0; u < size; u++ {
+		for v := 0; v < size; v++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				sum += rows[y*size+u] * cos[v*size+y]
+			}
+			result[v*size+u] = sum
+		}
+	}
+
+	return result
+}
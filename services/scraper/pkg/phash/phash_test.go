@@ -0,0 +1,87 @@
+package phash
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a    uint64
+		b    uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0b1011, 0b1011, 0},
+		{0b1011, 0b0001, 2},
+		{0, math.MaxUint64, 64},
+		{1 << 63, 1, 2},
+	}
+
+	for _, test := range tests {
+		if got := Distance(test.a, test.b); got != test.want {
+			t.Errorf("%b, %b: got %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// scene draws a gradient with a bright disc at (cx, cy) of radius r, all relative
+// to the size of the image, so scenes of any size show the same picture
+func scene(size int, cx float64, cy float64, r float64) image.Image {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			fx, fy := float64(x)/float64(size), float64(y)/float64(size)
+			v := 40 + 120*fx
+			if math.Hypot(fx-cx, fy-cy) < r {
+				v = 240
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(v)})
+		}
+	}
+	return img
+}
+
+func TestHashesAreStableOnResize(t *testing.T) {
+	hashes := map[string]func(image.Image) uint64{"pHash": PHash, "dHash": DHash}
+
+	for name, hash := range hashes {
+		original := hash(scene(256, 0.3, 0.4, 0.2))
+		tests := []struct {
+			name string
+			img  image.Image
+			near bool
+		}{
+			{"same size", scene(256, 0.3, 0.4, 0.2), true},
+			{"half size", scene(128, 0.3, 0.4, 0.2), true},
+			{"odd size", scene(97, 0.3, 0.4, 0.2), true},
+			{"other picture", scene(256, 0.75, 0.7, 0.15), false},
+		}
+
+		for _, test := range tests {
+			d := Distance(original, hash(test.img))
+			if test.near && d > 6 {
+				t.Errorf("%v of %v is at distance %v; want at most 6", name, test.name, d)
+			}
+			if !test.near && d <= 10 {
+				t.Errorf("%v of %v is at distance %v; want more than 10", name, test.name, d)
+			}
+		}
+	}
+}
+
+func TestHashOfNonSquareImage(t *testing.T) {
+	img := image.NewGray(image.Rect(10, 20, 310, 120))
+	for y := 20; y < 120; y++ {
+		for x := 10; x < 310; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8((x - 10) * 255 / 300)})
+		}
+	}
+
+	// brightness rises to the right, so no pixel is brighter than its right neighbour
+	if got := DHash(img); got != 0 {
+		t.Errorf("dHash of a horizontal gradient is %b; want 0", got)
+	}
+}
@@ -0,0 +1,308 @@
+package retry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// AnyHost is the key of the policy of hosts without a policy of their own
+const AnyHost = "*"
+
+// Policy decides whether and when a failed request is sent again
+type Policy struct {
+	// attempts including the first
+	MaxAttempts int
+	// lower bound of every backoff
+	BaseDelay time.Duration
+	// upper bound of a backoff, apart from a longer Retry-After
+	MaxDelay time.Duration
+	// no attempt is made later than MaxElapsed after the first; 0 is unlimited
+	MaxElapsed time.Duration
+	// response statuses that are retried; Retry-After is honored on 429 and 503
+	Statuses []int
+}
+
+// Default is the policy for public sites such as 4chan: patient, as a page that
+// is not fetched now is only fetched again on the next run
+func Default() Policy {
+	return Policy{
+		MaxAttempts: 6,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		MaxElapsed:  5 * time.Minute,
+		Statuses:    []int{http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+}
+
+// Service is the policy for services within the cluster such as the vision api:
+// quick, as failed work is retried by its job anyway
+func Service() Policy {
+	return Policy{
+		MaxAttempts: 4,
+		BaseDelay:   250 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		MaxElapsed:  30 * time.Second,
+		Statuses:    []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+}
+
+// policyJson is a Policy as configured; durations are in milliseconds and nil
+// fields keep the value of the policy it is parsed onto
+type policyJson struct {
+	MaxAttempts  *int   `json:"max_attempts"`
+	BaseDelayMs  *int64 `json:"base_delay_ms"`
+	MaxDelayMs   *int64 `json:"max_delay_ms"`
+	MaxElapsedMs *int64 `json:"max_elapsed_ms"`
+	Statuses     *[]int `json:"statuses"`
+}
+
+func asJson(p Policy) policyJson {
+	baseDelayMs, maxDelayMs, maxElapsedMs := p.BaseDelay.Milliseconds(), p.MaxDelay.Milliseconds(), p.MaxElapsed.Milliseconds()
+	return policyJson{MaxAttempts: &p.MaxAttempts, BaseDelayMs: &baseDelayMs, MaxDelayMs: &maxDelayMs, MaxElapsedMs: &maxElapsedMs, Statuses: &p.Statuses}
+}
+
+func (j policyJson) onto(p Policy) (Policy, error) {
+	if j.MaxAttempts != nil {
+		p.MaxAttempts = *j.MaxAttempts
+	}
+	if j.BaseDelayMs != nil {
+		p.BaseDelay = time.Duration(*j.BaseDelayMs) * time.Millisecond
+	}
+	if j.MaxDelayMs != nil {
+		p.MaxDelay = time.Duration(*j.MaxDelayMs) * time.Millisecond
+	}
+	if j.MaxElapsedMs != nil {
+		p.MaxElapsed = time.Duration(*j.MaxElapsedMs) * time.Millisecond
+	}
+	if j.Statuses != nil {
+		p.Statuses = *j.Statuses
+	}
+
+	if p.MaxAttempts < 1 {
+		return p, fmt.Errorf("max_attempts must be at least 1; got %v", p.MaxAttempts)
+	}
+	if p.BaseDelay <= 0 || p.MaxDelay < p.BaseDelay {
+		return p, fmt.Errorf("base_delay_ms must be positive and at most max_delay_ms; got %v and %v", p.BaseDelay, p.MaxDelay)
+	}
+	if p.MaxElapsed < 0 {
+		return p, fmt.Errorf("max_elapsed_ms must not be negative; got %v", p.MaxElapsed)
+	}
+	return p, nil
+}
+
+// ParsePolicy reads a policy from json onto fallback; an empty string results in fallback
+func ParsePolicy(raw string, fallback Policy) (Policy, error) {
+	if raw == "" {
+		return fallback, nil
+	}
+
+	var j policyJson
+	err := json.Unmarshal([]byte(raw), &j)
+	if err != nil {
+		return fallback, err
+	}
+
+	return j.onto(fallback)
+}
+
+// Policies holds the policy per destination host
+type Policies struct {
+	hosts    map[string]Policy
+	fallback Policy
+}
+
+// Parse reads the policy per host from json, each onto fallback; the policy of
+// AnyHost replaces fallback. An empty string results in fallback for every host
+func Parse(raw string, fallback Policy) (*Policies, error) {
+	policies := &Policies{hosts: map[string]Policy{}, fallback: fallback}
+	if raw == "" {
+		return policies, nil
+	}
+
+	js := map[string]policyJson{}
+	err := json.Unmarshal([]byte(raw), &js)
+	if err != nil {
+		return nil, err
+	}
+
+	if j, ok := js[AnyHost]; ok {
+		policies.fallback, err = j.onto(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("retry policy of %v; %w", AnyHost, err)
+		}
+	}
+
+	for host, j := range js {
+		if host == AnyHost {
+			continue
+		}
+
+		policies.hosts[host], err = j.onto(policies.fallback)
+		if err != nil {
+			return nil, fmt.Errorf("retry policy of %v; %w", host, err)
+		}
+	}
+
+	return policies, nil
+}
+
+// For returns the policy of host
+func (p *Policies) For(host string) Policy {
+	if policy, ok := p.hosts[host]; ok {
+		return policy
+	}
+	return p.fallback
+}
+
+// MarshalJSON lists the policies for the configuration snapshot of a run
+func (p *Policies) MarshalJSON() ([]byte, error) {
+	all := map[string]policyJson{AnyHost: asJson(p.fallback)}
+	for host, policy := range p.hosts {
+		all[host] = asJson(policy)
+	}
+	return json.Marshal(all)
+}
+
+// Do calls send once per attempt until its outcome is not retryable, the attempts
+// are used up, the next attempt would start after MaxElapsed or ctx is done. send
+// must build a new request every time so its body is sent again in full. Returns
+// the outcome of the last attempt, whose response status may still be retryable.
+// onRetry, which may be nil, is called before every wait for a next attempt
+func (p Policy) Do(ctx context.Context, send func(ctx context.Context) (*http.Response, error), onRetry func(attempt int, wait time.Duration, reason string)) (*http.Response, error) {
+	start := time.Now()
+	var wait time.Duration
+
+	for attempt := 1; ; attempt++ {
+		response, err := send(ctx)
+		if ctx.Err() != nil {
+			discard(response)
+			return nil, ctx.Err()
+		}
+
+		reason, retryAfter, retryable := p.classify(response, err)
+		if !retryable || attempt >= p.MaxAttempts {
+			return response, err
+		}
+
+		wait = p.backoff(wait)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+
+		if p.MaxElapsed > 0 && time.Since(start)+wait > p.MaxElapsed {
+			return response, err
+		}
+
+		discard(response)
+		if onRetry != nil {
+			onRetry(attempt, wait, reason)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// classify returns why the outcome of an attempt is retryable, and how long the
+// response asked to wait
+func (p Policy) classify(response *http.Response, err error) (reason string, retryAfter time.Duration, retryable bool) {
+	if err != nil {
+		return err.Error(), 0, RetryableError(err)
+	}
+
+	for _, status := range p.Statuses {
+		if response.StatusCode == status {
+			if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+				retryAfter, _ = RetryAfter(response.Header, time.Now())
+			}
+			return fmt.Sprintf("%v response", response.StatusCode), retryAfter, true
+		}
+	}
+
+	return "", 0, false
+}
+
+// backoff returns the wait before the next attempt given the previous wait, with
+// decorrelated jitter: random between BaseDelay and three times the previous wait
+func (p Policy) backoff(previous time.Duration) time.Duration {
+	if previous < p.BaseDelay {
+		previous = p.BaseDelay
+	}
+
+	upper := previous * 3
+	if upper > p.MaxDelay {
+		upper = p.MaxDelay
+	}
+	if upper <= p.BaseDelay {
+		return p.BaseDelay
+	}
+
+	return p.BaseDelay + time.Duration(rand.Int63n(int64(upper-p.BaseDelay)+1))
+}
+
+// RetryableError returns whether the request that failed with err may succeed
+// when it is sent again: timeouts, reset or refused connections and connections
+// closed before the response was complete
+func RetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// RetryAfter reads the Retry-After header, either in seconds or as a date
+func RetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if at.Before(now) {
+		return 0, true
+	}
+	return at.Sub(now), true
+}
+
+// discard reads what is left of the body of response so its connection is reused
+func discard(response *http.Response) {
+	if response == nil {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	response.Body.Close()
+}
@@ -0,0 +1,273 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// outcome is what the fake send returns on one attempt
+type outcome struct {
+	status     int
+	retryAfter string
+	err        error
+}
+
+func respond(o outcome) (*http.Response, error) {
+	if o.err != nil {
+		return nil, o.err
+	}
+	header := http.Header{}
+	if o.retryAfter != "" {
+		header.Set("Retry-After", o.retryAfter)
+	}
+	return &http.Response{StatusCode: o.status, Header: header, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func fast() Policy {
+	p := Default()
+	p.BaseDelay = time.Millisecond
+	p.MaxDelay = 4 * time.Millisecond
+	p.MaxElapsed = 0
+	return p
+}
+
+func TestDo(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		outcomes []outcome
+		// attempts made and the status or error of the last
+		attempts int
+		status   int
+		err      error
+	}{
+		{"success", fast(), []outcome{{status: 200}}, 1, 200, nil},
+		{"not retryable status", fast(), []outcome{{status: 404}, {status: 200}}, 1, 404, nil},
+		{"retryable status", fast(), []outcome{{status: 503}, {status: 502}, {status: 200}}, 3, 200, nil},
+		{"retryable error", fast(), []outcome{{err: syscall.ECONNRESET}, {err: timeoutError{}}, {status: 200}}, 3, 200, nil},
+		{"not retryable error", fast(), []outcome{{err: errors.New("bad request")}, {status: 200}}, 1, 0, errors.New("bad request")},
+		{
+			"attempts used up",
+			func() Policy { p := fast(); p.MaxAttempts = 2; return p }(),
+			[]outcome{{status: 503}, {status: 503}, {status: 200}},
+			2, 503, nil,
+		},
+		{
+			"status not in policy",
+			func() Policy { p := fast(); p.Statuses = []int{429}; return p }(),
+			[]outcome{{status: 503}, {status: 200}},
+			1, 503, nil,
+		},
+		{
+			"max elapsed",
+			func() Policy { p := fast(); p.MaxElapsed = 10 * time.Millisecond; return p }(),
+			[]outcome{{status: 429, retryAfter: "1"}, {status: 200}},
+			1, 429, nil,
+		},
+	}
+
+	for _, test := range tests {
+		attempts := 0
+		retries := 0
+		send := func(ctx context.Context) (*http.Response, error) {
+			o := test.outcomes[attempts]
+			attempts++
+			return respond(o)
+		}
+
+		response, err := test.policy.Do(context.Background(), send, func(attempt int, wait time.Duration, reason string) {
+			retries++
+		})
+
+		if attempts != test.attempts {
+			t.Errorf("%v: made %v attempts; want %v", test.name, attempts, test.attempts)
+		}
+		if retries != attempts-1 {
+			t.Errorf("%v: reported %v retries for %v attempts", test.name, retries, attempts)
+		}
+		if test.err != nil {
+			if err == nil || err.Error() != test.err.Error() {
+				t.Errorf("%v: returned %v; want %v", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || response.StatusCode != test.status {
+			t.Errorf("%v: returned %v, %v; want %v", test.name, response, err, test.status)
+		}
+	}
+}
+
+func TestDoHonorsRetryAfter(t *testing.T) {
+	p := fast()
+	outcomes := []outcome{{status: 429, retryAfter: "0"}, {status: 503, retryAfter: "1"}, {status: 200}}
+
+	attempts := 0
+	waits := []time.Duration{}
+	_, err := p.Do(context.Background(), func(ctx context.Context) (*http.Response, error) {
+		o := outcomes[attempts]
+		attempts++
+		return respond(o)
+	}, func(attempt int, wait time.Duration, reason string) {
+		waits = append(waits, wait)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waits[0] > p.MaxDelay {
+		t.Errorf("waited %v on a Retry-After of 0; want the backoff", waits[0])
+	}
+	if waits[1] != time.Second {
+		t.Errorf("waited %v on a Retry-After of 1; want 1s", waits[1])
+	}
+}
+
+func TestDoGivesUpOnCancel(t *testing.T) {
+	p := fast()
+	p.BaseDelay = time.Hour
+	p.MaxDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	_, err := p.Do(ctx, func(ctx context.Context) (*http.Response, error) {
+		attempts++
+		return respond(outcome{status: 503})
+	}, func(attempt int, wait time.Duration, reason string) {
+		cancel()
+	})
+
+	if !errors.Is(err, context.Canceled) || attempts != 1 {
+		t.Errorf("returned %v after %v attempts; want %v after 1", err, attempts, context.Canceled)
+	}
+}
+
+func TestBackoffBounds(t *testing.T) {
+	p := Policy{BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+
+	tests := []struct {
+		previous time.Duration
+		min      time.Duration
+		max      time.Duration
+	}{
+		{0, 10 * time.Millisecond, 30 * time.Millisecond},
+		{10 * time.Millisecond, 10 * time.Millisecond, 30 * time.Millisecond},
+		{20 * time.Millisecond, 10 * time.Millisecond, 60 * time.Millisecond},
+		{50 * time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond},
+		{time.Hour, 10 * time.Millisecond, 100 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 1000; i++ {
+			got := p.backoff(test.previous)
+			if got < test.min || got > test.max {
+				t.Fatalf("backoff after %v is %v; want between %v and %v", test.previous, got, test.min, test.max)
+			}
+		}
+	}
+
+	fixed := Policy{BaseDelay: time.Second, MaxDelay: time.Second}
+	if got := fixed.backoff(time.Second); got != time.Second {
+		t.Errorf("backoff of a fixed delay is %v; want 1s", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 11, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"Tue, 10 Nov 2020 12:00:30 GMT", 30 * time.Second, true},
+		{"Tue, 10 Nov 2020 11:59:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+
+	for _, test := range tests {
+		header := http.Header{}
+		if test.value != "" {
+			header.Set("Retry-After", test.value)
+		}
+		got, ok := RetryAfter(header, now)
+		if got != test.want || ok != test.ok {
+			t.Errorf("Retry-After %q: got %v, %v; want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestRetryableError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{timeoutError{}, true},
+		{fmt.Errorf("dial; %w", syscall.ECONNREFUSED), true},
+		{fmt.Errorf("read; %w", syscall.ECONNRESET), true},
+		{io.ErrUnexpectedEOF, true},
+		{context.Canceled, false},
+		{errors.New("tls: bad certificate"), false},
+	}
+
+	for _, test := range tests {
+		if got := RetryableError(test.err); got != test.want {
+			t.Errorf("%v: retryable is %v; want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	policies, err := Parse(`{
+		"*": {"max_attempts": 3},
+		"a.4cdn.org": {"base_delay_ms": 2000, "max_delay_ms": 10000},
+		"vision": {"statuses": [503]}
+	}`, Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := policies.For("a.4cdn.org")
+	if api.MaxAttempts != 3 || api.BaseDelay != 2*time.Second || api.MaxDelay != 10*time.Second || api.MaxElapsed != Default().MaxElapsed {
+		t.Errorf("policy of a.4cdn.org is %+v", api)
+	}
+	if vision := policies.For("vision"); len(vision.Statuses) != 1 || vision.Statuses[0] != 503 || vision.MaxAttempts != 3 {
+		t.Errorf("policy of vision is %+v", vision)
+	}
+	if other := policies.For("i.4cdn.org"); other.MaxAttempts != 3 || other.BaseDelay != Default().BaseDelay {
+		t.Errorf("policy of another host is %+v", other)
+	}
+
+	empty, err := Parse("", Service())
+	if err != nil || empty.For("a.4cdn.org").MaxAttempts != Service().MaxAttempts {
+		t.Errorf("empty policies are %+v, %v; want the fallback", empty, err)
+	}
+
+	for _, raw := range []string{
+		`{"*": {"max_attempts": 0}}`,
+		`{"a.4cdn.org": {"base_delay_ms": 0}}`,
+		`{"a.4cdn.org": {"base_delay_ms": 2000, "max_delay_ms": 1000}}`,
+		`{"a.4cdn.org": {"max_elapsed_ms": -1}}`,
+		`not json`,
+	} {
+		if _, err := Parse(raw, Default()); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package scope
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const Allow = "allow"
+const Deny = "deny"
+
+// regexPrefix marks a pattern as regular expression instead of glob
+const regexPrefix = "re:"
+
+// Rule allows or denies the urls matching all of its patterns; an empty pattern
+// matches anything. Patterns are globs, where * matches within a path segment
+// and ** across segments, or regular expressions when prefixed with "re:".
+// Both are anchored at the start and end
+type Rule struct {
+	Action string `json:"action"`
+	Scheme string `json:"scheme,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// matched against the encoded query, whose parameters are sorted by key
+	Query string `json:"query,omitempty"`
+
+	scheme *regexp.Regexp
+	host   *regexp.Regexp
+	path   *regexp.Regexp
+	query  *regexp.Regexp
+}
+
+// Rules are tried in order and the first matching rule wins; urls no rule
+// matches are denied
+type Rules []*Rule
+
+// Scope decides which pages are crawled and which images are downloaded
+type Scope struct {
+	Pages  Rules `json:"pages"`
+	Images Rules `json:"images"`
+}
+
+// Default crawls the 4chan boards over https and downloads jpg, gif and png images
+func Default() *Scope {
+	s := &Scope{
+		Pages: Rules{
+			{Action: Allow, Scheme: "https", Host: "boards.4chan.org"},
+		},
+		Images: Rules{
+			{Action: Allow, Path: `re:(?i).*\.(jpg|gif|png)`},
+		},
+	}
+
+	err := s.compile()
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Parse reads a scope from json; an empty string results in Default
+func Parse(raw string) (*Scope, error) {
+	if raw == "" {
+		return Default(), nil
+	}
+
+	s := &Scope{}
+	err := json.Unmarshal([]byte(raw), s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, s.compile()
+}
+
+func (s *Scope) compile() error {
+	if err := s.Pages.compile(); err != nil {
+		return fmt.Errorf("page rule %v", err)
+	}
+	if err := s.Images.compile(); err != nil {
+		return fmt.Errorf("image rule %v", err)
+	}
+	return nil
+}
+
+// AllowsPage returns whether the page at the absolute url raw may be crawled
+func (s *Scope) AllowsPage(raw string) bool {
+	return s.Pages.Allows(raw)
+}
+
+// AllowsImage returns whether the image at the absolute url raw may be downloaded
+func (s *Scope) AllowsImage(raw string) bool {
+	return s.Images.Allows(raw)
+}
+
+// Allows returns whether the first rule matching the absolute url raw allows it
+func (rs Rules) Allows(raw string) bool {
+	rule := rs.Match(raw)
+	return rule != nil && rule.Action == Allow
+}
+
+// Match returns the first rule matching the absolute url raw; nil if none does
+func (rs Rules) Match(raw string) *Rule {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil
+	}
+
+	for _, rule := range rs {
+		if rule.matches(u) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rs Rules) compile() (err error) {
+	for i, rule := range rs {
+		if rule.Action != Allow && rule.Action != Deny {
+			return fmt.Errorf("%v has action %q; must be allow or deny", i, rule.Action)
+		}
+
+		if rule.scheme, err = compile(rule.Scheme); err != nil {
+			return fmt.Errorf("%v scheme; %v", i, err)
+		}
+		if rule.host, err = compile(rule.Host); err != nil {
+			return fmt.Errorf("%v host; %v", i, err)
+		}
+		if rule.path, err = compile(rule.Path); err != nil {
+			return fmt.Errorf("%v path; %v", i, err)
+		}
+		if rule.query, err = compile(rule.Query); err != nil {
+			return fmt.Errorf("%v query; %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matches(u *url.URL) bool {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	return matches(r.scheme, strings.ToLower(u.Scheme)) &&
+		matches(r.host, strings.ToLower(u.Hostname())) &&
+		matches(r.path, path) &&
+		matches(r.query, u.Query().Encode())
+}
+
+func matches(pattern *regexp.Regexp, s string) bool {
+	return pattern == nil || pattern.MatchString(s)
+}
+
+// compile turns a glob, or a regular expression prefixed with "re:", into an
+// anchored regular expression; nil for the empty pattern
+func compile(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	if expression, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+		if expression == "" {
+			return nil, errors.New("empty regular expression")
+		}
+		return regexp.Compile("^(?:" + expression + ")$")
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
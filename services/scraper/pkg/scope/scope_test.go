@@ -0,0 +1,142 @@
+package scope
+
+import "testing"
+
+func TestDefaultPages(t *testing.T) {
+	s := Default()
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://boards.4chan.org/g/", Allow},
+		{"https://boards.4chan.org/g/2", Allow},
+		{"https://boards.4chan.org/g/catalog", Allow},
+		{"https://boards.4chan.org/g/archive", Allow},
+		{"https://boards.4chan.org/g/thread/76759434", Allow},
+		{"https://boards.4chan.org/g/thread/76759434/the-fglt", Allow},
+		{"https://BOARDS.4chan.org/g/", Allow},
+		{"http://boards.4chan.org/g/", Deny},
+		{"https://a.4cdn.org/g/catalog.json", Deny},
+		{"https://i.4cdn.org/g/1605032734427.jpg", Deny},
+		{"https://www.4chan.org/rules", Deny},
+		{"https://github.com/4chan/4chan-API", Deny},
+		{"https://boards.4chan.org.evil.example/g/", Deny},
+		{"not a url\x7f", Deny},
+	}
+
+	for _, test := range tests {
+		got := Deny
+		if s.AllowsPage(test.url) {
+			got = Allow
+		}
+		if got != test.want {
+			t.Errorf("page %v: got %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestDefaultImages(t *testing.T) {
+	s := Default()
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://i.4cdn.org/g/1605032734427.jpg", Allow},
+		{"https://i.4cdn.org/g/1605032734427.png", Allow},
+		{"https://i.4cdn.org/g/1605032734427.gif", Allow},
+		{"https://i.4cdn.org/g/1605032734427.JPG", Allow},
+		{"https://i.4cdn.org/g/1605032734427.PNG", Allow},
+		{"https://i.4cdn.org/g/1605032734427s.jpg", Allow},
+		{"https://i.4cdn.org/g/1605032734427.webm", Deny},
+		{"https://i.4cdn.org/g/1605032734427.pdf", Deny},
+		{"https://i.4cdn.org/g/1605032734427.jpg.webm", Deny},
+		{"https://boards.4chan.org/g/thread/76759434", Deny},
+	}
+
+	for _, test := range tests {
+		got := Deny
+		if s.AllowsImage(test.url) {
+			got = Allow
+		}
+		if got != test.want {
+			t.Errorf("image %v: got %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	s, err := Parse(`{
+		"pages": [
+			{"action": "deny", "path": "/*/archive"},
+			{"action": "deny", "host": "boards.4chan.org", "path": "/b/**"},
+			{"action": "allow", "scheme": "https", "host": "boards.4chan.org"},
+			{"action": "allow", "host": "re:(boards\\.)?4channel\\.org", "path": "/g/**"}
+		],
+		"images": [
+			{"action": "deny", "path": "re:.*s\\.jpg"},
+			{"action": "allow", "host": "i.4cdn.org", "path": "/*/*.jpg"}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := []struct {
+		url  string
+		want string
+	}{
+		{"https://boards.4chan.org/g/archive", Deny},
+		{"https://boards.4chan.org/b/", Deny},
+		{"https://boards.4chan.org/b/thread/1", Deny},
+		{"https://boards.4chan.org/pol/thread/1", Allow},
+		{"https://boards.4channel.org/g/thread/1", Allow},
+		{"https://4channel.org/g/", Allow},
+		{"https://boards.4channel.org/v/", Deny},
+	}
+	for _, test := range pages {
+		got := s.Pages.Match(test.url)
+		action := Deny
+		if got != nil {
+			action = got.Action
+		}
+		if action != test.want {
+			t.Errorf("page %v: got %v, want %v", test.url, action, test.want)
+		}
+	}
+
+	images := []struct {
+		url  string
+		want string
+	}{
+		{"https://i.4cdn.org/g/1605032734427.jpg", Allow},
+		{"https://i.4cdn.org/g/1605032734427s.jpg", Deny},
+		{"https://i.4cdn.org/g/sub/1605032734427.jpg", Deny},
+		{"https://is2.4chan.org/g/1605032734427.jpg", Deny},
+	}
+	for _, test := range images {
+		got := Deny
+		if s.AllowsImage(test.url) {
+			got = Allow
+		}
+		if got != test.want {
+			t.Errorf("image %v: got %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		`{"pages": [{"action": "maybe"}]}`,
+		`{"pages": [{"action": "allow", "path": "re:"}]}`,
+		`{"images": [{"action": "allow", "host": "re:("}]}`,
+		`not json`,
+	}
+
+	for _, raw := range tests {
+		if _, err := Parse(raw); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/canonical"
+	"go-find-pepe/pkg/limit"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Api discovers images through the read-only 4chan JSON API instead of
+// parsing the rendered board pages
+type Api struct {
+	apiUrl   string
+	imageUrl string
+	fetcher  *Fetcher
+	// enqueues a download for every image found
+	discover      func(ctx context.Context, hrefs []*imageHref) error
+	canonicalizer *canonical.Canonicalizer
+	run           *run
+	quotas        *quotas
+	threadLimit   int8
+}
+
+type apiPost struct {
+	No  int64  `json:"no"`
+	Tim int64  `json:"tim"`
+	Ext string `json:"ext"`
+	Md5 string `json:"md5"`
+}
+
+// apiThreadsPage is a page of catalog.json or threads.json; only the fields both
+// share are read
+type apiThreadsPage struct {
+	Page    int `json:"page"`
+	Threads []struct {
+		No           int64 `json:"no"`
+		LastModified int64 `json:"last_modified"`
+		Replies      int   `json:"replies"`
+	} `json:"threads"`
+}
+
+type apiThread struct {
+	Posts []apiPost `json:"posts"`
+}
+
+// Start enqueues a download for every image of the board of startHref, walking
+// every thread listed by catalog.json or threads.json; once ctx is done no more
+// threads are walked, while the images of threads already fetched are still
+// enqueued until work is done
+func (s *Api) Start(ctx context.Context, work context.Context, startHref string) {
+	wg := &sync.WaitGroup{}
+	wgU := WaitGroupHelper{WaitGroup: wg}
+
+	// seeds are validated by NewScraper
+	board, err := extractBoardFromHref(startHref)
+	if err != nil {
+		fmt.Printf("Failed to get board from startHref %v; ignoring; %v\n", startHref, err)
+		return
+	}
+
+	threads, err := s.listThreads(ctx, board)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Printf("Failed to list threads of %v; ignoring; %v\n", board, err)
+		}
+		return
+	}
+
+	threadLimiter := limit.NewLimiter(s.threadLimit)
+	for _, no := range threads {
+		no := no
+		wgU.Wrapper(func() {
+			if threadLimiter.Add(ctx) != nil {
+				return
+			}
+			defer threadLimiter.Done()
+			s.walkThread(ctx, work, board, no)
+		})
+	}
+
+	wg.Wait()
+}
+
+// listThreads returns the threads of board listed by catalog.json or threads.json,
+// each once; the catalog lists threads as they are bumped, threads.json by their
+// last modification, so a thread bumped while the lists are fetched is in either.
+// Returns an error only if neither list could be fetched
+func (s *Api) listThreads(ctx context.Context, board string) ([]int64, error) {
+	threads := []int64{}
+	listed := map[int64]bool{}
+	var errs []error
+
+	for _, list := range []string{"catalog.json", "threads.json"} {
+		var pages []apiThreadsPage
+		err := s.getJson(ctx, board, fmt.Sprintf("%v/%v/%v", s.apiUrl, board, list), &pages)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, page := range pages {
+			for _, thread := range page.Threads {
+				if !listed[thread.No] {
+					listed[thread.No] = true
+					threads = append(threads, thread.No)
+				}
+			}
+		}
+	}
+
+	if len(errs) == 2 {
+		return nil, fmt.Errorf("%w; %w", errs[0], errs[1])
+	}
+	if len(errs) == 1 && ctx.Err() == nil && !errors.Is(errs[0], ErrNotFound) {
+		fmt.Printf("Failed to get a thread list of %v; walking the other; %v\n", board, errs[0])
+	}
+	return threads, nil
+}
+
+// walkThread enqueues a download for every image of thread no, unless board
+// exhausted its quota
+func (s *Api) walkThread(ctx context.Context, work context.Context, board string, no int64) {
+	if s.quotas.exhausted(board) {
+		return
+	}
+	s.run.threadStarted(board)
+
+	var thread apiThread
+	err := s.getJson(ctx, board, fmt.Sprintf("%v/%v/thread/%v.json", s.apiUrl, board, no), &thread)
+	if err != nil {
+		// a thread that is not found was pruned or archived between listing and fetching
+		if ctx.Err() == nil && !errors.Is(err, ErrNotFound) {
+			fmt.Printf("Failed to get thread %v/%v; ignoring; %v\n", board, no, err)
+		}
+		return
+	}
+
+	hrefs := []*imageHref{}
+	for _, post := range thread.Posts {
+		hrefs = s.appendImageHref(hrefs, board, post)
+	}
+	err = s.discover(work, hrefs)
+	if err != nil && work.Err() == nil {
+		fmt.Printf("Failed to discover images of thread %v/%v; %v\n", board, no, err)
+	}
+}
+
+func (s *Api) appendImageHref(hrefs []*imageHref, board string, post apiPost) []*imageHref {
+	// posts without a file have neither tim nor ext
+	if post.Tim == 0 || post.Ext == "" {
+		return hrefs
+	}
+
+	href, err := s.canonicalizer.Canonicalize(fmt.Sprintf("%v/%v/%v%v", s.imageUrl, board, post.Tim, post.Ext))
+	if err != nil {
+		fmt.Printf("Failed to canonicalize image %v of %v; %v\n", post.Tim, board, err)
+		return hrefs
+	}
+
+	return append(hrefs, &imageHref{Href: href, Md5: post.Md5})
+}
+
+func (s *Api) getJson(ctx context.Context, board string, href string, v any) error {
+	request := Request{fetcher: s.fetcher, url: href, reuseConnection: true, method: "GET", run: s.run, board: board}
+	response, err := request.Do(ctx)
+	if errors.Is(err, ErrNotFound) {
+		s.run.pageNotFound(board)
+	}
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+	s.run.pageFetched(board)
+
+	data, err := io.ReadAll(response)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// boardOf returns the board of href, e.g. g for https://boards.4chan.org/g/ and
+// https://i.4cdn.org/g/123.jpg; empty if href has none
+func boardOf(href string) string {
+	board, _ := extractBoardFromHref(href)
+	return board
+}
+
+func extractBoardFromHref(href string) (string, error) {
+	parsed, err := url.Parse(fixMissingHttps(href))
+	if err != nil {
+		return "", err
+	}
+
+	board := strings.Split(strings.Trim(parsed.Path, "/"), "/")[0]
+	if board == "" {
+		return "", errors.New("href has no board")
+	}
+
+	return board, nil
+}
@@ -0,0 +1,210 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"go-find-pepe/pkg/canonical"
+	"go-find-pepe/pkg/limit"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newApiFixture serves the recorded api responses in testdata/api except for the
+// missing paths, and the requested paths
+func newApiFixture(t *testing.T, missing ...string) (*httptest.Server, *[]string) {
+	m := sync.Mutex{}
+	requested := []string{}
+
+	files := http.FileServer(http.Dir("testdata/api"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		requested = append(requested, r.URL.Path)
+		m.Unlock()
+		for _, path := range missing {
+			if r.URL.Path == path {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requested
+}
+
+func newTestApi(server *httptest.Server, discovered *[]*imageHref) *Api {
+	rates, _ := limit.ParseRates(`{"*": {"requests_per_second": 0}}`)
+	r := newRun()
+	m := sync.Mutex{}
+
+	return &Api{
+		apiUrl:   server.URL,
+		imageUrl: "https://i.4cdn.org",
+		fetcher:  NewFetcher(FetcherArguments{HostRates: rates}),
+		discover: func(ctx context.Context, hrefs []*imageHref) error {
+			m.Lock()
+			defer m.Unlock()
+			*discovered = append(*discovered, hrefs...)
+			return nil
+		},
+		canonicalizer: canonical.Default(),
+		run:           r,
+		quotas:        newQuotas(nil, nil, r),
+		threadLimit:   2,
+	}
+}
+
+func TestApiDiscoversEveryImageOnce(t *testing.T) {
+	server, requested := newApiFixture(t)
+	discovered := []*imageHref{}
+	api := newTestApi(server, &discovered)
+
+	api.Start(context.Background(), context.Background(), "https://boards.4chan.org/g/")
+
+	want := map[string]string{
+		"https://i.4cdn.org/g/1605032734427.png": "Y9mUa1FyaA0cZHl9FTvPCA==",
+		"https://i.4cdn.org/g/1605032781640.JPG": "q0oYq3sHhj7m1wQdmE9t6A==",
+		"https://i.4cdn.org/g/1605032830153.jpg": "2cJ3tbCrRCc8kF9FNHnzJQ==",
+		"https://i.4cdn.org/g/1605034320981.gif": "v6A9Yl0NZtUaWbHl4VlmZw==",
+	}
+
+	seen := map[string]int{}
+	for _, href := range discovered {
+		seen[href.Href]++
+		md5, ok := want[href.Href]
+		if !ok {
+			t.Errorf("discovered unexpected image %v", href.Href)
+			continue
+		}
+		if href.Md5 != md5 {
+			t.Errorf("image %v has md5 %v; want %v", href.Href, href.Md5, md5)
+		}
+	}
+	for href := range want {
+		if seen[href] != 1 {
+			t.Errorf("image %v discovered %v times; want once", href, seen[href])
+		}
+	}
+
+	threads := 0
+	for _, path := range *requested {
+		if strings.HasPrefix(path, "/g/thread/") {
+			threads++
+		}
+	}
+	// the catalog and threads.json both list two of the threads
+	if threads != 3 {
+		t.Errorf("requested %v threads; want each of the 3 once", threads)
+	}
+
+	c := api.run.peek("g")
+	if c == nil {
+		t.Fatal("run counted nothing on board g")
+	}
+	if got := c.threads.Load(); got != 3 {
+		t.Errorf("counted %v threads; want 3", got)
+	}
+	// catalog.json, threads.json and two threads; the third thread was pruned
+	if got := c.pagesFetched.Load(); got != 4 {
+		t.Errorf("counted %v fetched pages; want 4", got)
+	}
+	if got := c.notFound.Load(); got != 1 {
+		t.Errorf("counted %v pages not found; want 1", got)
+	}
+}
+
+func TestApiWalksCatalogWithoutThreadsList(t *testing.T) {
+	server, requested := newApiFixture(t, "/g/threads.json")
+	discovered := []*imageHref{}
+	api := newTestApi(server, &discovered)
+
+	api.Start(context.Background(), context.Background(), "https://boards.4chan.org/g/")
+
+	// the catalog lists the first two threads only
+	if len(discovered) != 4 {
+		t.Errorf("discovered %v images; want 4", len(discovered))
+	}
+	for _, path := range *requested {
+		if path == "/g/thread/76702277.json" {
+			t.Errorf("requested %v, which is listed by threads.json only", path)
+		}
+	}
+}
+
+func TestApiImagesOfRecordedThreads(t *testing.T) {
+	api := &Api{imageUrl: "https://i.4cdn.org", canonicalizer: canonical.Default()}
+
+	hrefs := []*imageHref{}
+	for _, no := range []string{"76759434", "76761088"} {
+		data, err := os.ReadFile("testdata/api/g/thread/" + no + ".json")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var thread apiThread
+		if err := json.Unmarshal(data, &thread); err != nil {
+			t.Fatal(err)
+		}
+		for _, post := range thread.Posts {
+			hrefs = api.appendImageHref(hrefs, "g", post)
+		}
+	}
+
+	want := map[string]string{
+		"https://i.4cdn.org/g/1605032734427.png": "Y9mUa1FyaA0cZHl9FTvPCA==",
+		"https://i.4cdn.org/g/1605032781640.JPG": "q0oYq3sHhj7m1wQdmE9t6A==",
+		"https://i.4cdn.org/g/1605032830153.jpg": "2cJ3tbCrRCc8kF9FNHnzJQ==",
+		"https://i.4cdn.org/g/1605034320981.gif": "v6A9Yl0NZtUaWbHl4VlmZw==",
+	}
+
+	if len(hrefs) != len(want) {
+		t.Errorf("found %v images; want %v", len(hrefs), len(want))
+	}
+	for _, href := range hrefs {
+		md5, ok := want[href.Href]
+		if !ok {
+			t.Errorf("found unexpected image %v", href.Href)
+			continue
+		}
+		if href.Md5 != md5 {
+			t.Errorf("image %v has md5 %v; want %v", href.Href, href.Md5, md5)
+		}
+	}
+}
+
+func TestApiIgnoresMissingBoard(t *testing.T) {
+	server, requested := newApiFixture(t)
+	discovered := []*imageHref{}
+	api := newTestApi(server, &discovered)
+
+	api.Start(context.Background(), context.Background(), "https://boards.4chan.org/v/")
+
+	if len(discovered) != 0 {
+		t.Errorf("discovered %v images of a board without threads", len(discovered))
+	}
+
+	sort.Strings(*requested)
+	if len(*requested) != 2 || (*requested)[0] != "/v/catalog.json" || (*requested)[1] != "/v/threads.json" {
+		t.Errorf("requested %v; want only /v/catalog.json and /v/threads.json", *requested)
+	}
+}
+
+func TestApiStopsWalkingOnceCancelled(t *testing.T) {
+	server, requested := newApiFixture(t)
+	discovered := []*imageHref{}
+	api := newTestApi(server, &discovered)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	api.Start(ctx, ctx, "https://boards.4chan.org/g/")
+
+	if len(discovered) != 0 || len(*requested) != 0 {
+		t.Errorf("discovered %v images with %v requests after cancellation", len(discovered), len(*requested))
+	}
+}
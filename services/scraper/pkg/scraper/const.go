@@ -1,13 +1,20 @@
 package scraper
 
+import "time"
+
 const ErrorDirectory = "data/error"
 
-const HtmlDir = "data/html"
-const ImageDir = "data/image"
+// key prefixes within the blob store
+const HtmlPrefix = "html"
+const ImagePrefix = "image"
+
+const MAX_RETRY_ATTEMPT = 10
 
-const PepeThreshold = 0.9
-const MaybeThreshold = 0.3
+const ApiUrl = "https://a.4cdn.org"
+const ApiImageUrl = "https://i.4cdn.org"
 
-const VisionImageKey = "file"
+const DiscoverySourceApi = "api"
+const DiscoverySourceHtml = "html"
 
-const MAX_RETRY_ATTEMPT = 10
+// how often a stage checks for work enqueued by other stages or replicas
+const LeasePollInterval = time.Second
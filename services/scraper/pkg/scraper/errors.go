@@ -0,0 +1,55 @@
+package scraper
+
+import (
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/classifier"
+	"net"
+	"net/http"
+)
+
+// ErrAlreadyExists is returned for an image that is already stored, by href or md5
+var ErrAlreadyExists = errors.New("already exists")
+
+// ErrNotFound is returned for a page or image that does not exist (anymore); also
+// matches an HTTPStatusError of a 404 response
+var ErrNotFound = errors.New("not found")
+
+// ErrDisallowed is returned for a page or image outside the crawl scope
+var ErrDisallowed = errors.New("disallowed by scope")
+
+// HTTPStatusError is returned for a response with another status than 200
+type HTTPStatusError struct {
+	Code int
+	Url  string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unsuccessful response %v for %v", e.Code, e.Url)
+}
+
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrNotFound && e.Code == http.StatusNotFound
+}
+
+// overloaded returns whether err suggests its destination is overloaded: a timeout,
+// a 429 or a 5xx response of a host or the classifier. A 500 of the classifier is
+// about the file instead, see classifier.ErrFaultyFile
+func overloaded(err error) bool {
+	var status *HTTPStatusError
+	if errors.As(err, &status) {
+		return busy(status.Code)
+	}
+
+	var classifierStatus *classifier.StatusError
+	if errors.As(err, &classifierStatus) {
+		return busy(classifierStatus.Code)
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func busy(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
@@ -0,0 +1,68 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/blob"
+	"go-find-pepe/pkg/classifier"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestHTTPStatusErrorIsNotFound(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&HTTPStatusError{Code: 404, Url: "https://boards.4chan.org/g/thread/1"}, true},
+		{fmt.Errorf("failed to GET; %w", &HTTPStatusError{Code: 404}), true},
+		{&HTTPStatusError{Code: 410}, false},
+		{&HTTPStatusError{Code: 503}, false},
+		{ErrNotFound, true},
+		{ErrAlreadyExists, false},
+	}
+
+	for _, test := range tests {
+		if got := errors.Is(test.err, ErrNotFound); got != test.want {
+			t.Errorf("%v is not found: %v; want %v", test.err, got, test.want)
+		}
+	}
+
+	var status *HTTPStatusError
+	err := fmt.Errorf("failed to GET; %w", &HTTPStatusError{Code: 503, Url: "https://a.4cdn.org/g/catalog.json"})
+	if !errors.As(err, &status) || status.Code != 503 {
+		t.Errorf("%v carries no status code 503", err)
+	}
+}
+
+func TestOverloaded(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&HTTPStatusError{Code: 429}, true},
+		{&HTTPStatusError{Code: 503}, true},
+		{&HTTPStatusError{Code: 404}, false},
+		{fmt.Errorf("failed to GET; %w", &HTTPStatusError{Code: 502}), true},
+		{fmt.Errorf("failed to POST; %w", &classifier.StatusError{Code: 503}), true},
+		{fmt.Errorf("failed to POST; %w", &classifier.StatusError{Code: 400}), false},
+		{classifier.ErrFaultyFile, false},
+		{fmt.Errorf("failed to read images/a.png; %w", blob.ErrNotFound), false},
+		{fmt.Errorf("failed to GET; %w", timeoutError{}), true},
+		{context.Canceled, false},
+		{errors.New("connection refused"), false},
+	}
+
+	for _, test := range tests {
+		if got := overloaded(test.err); got != test.want {
+			t.Errorf("overloaded(%v) is %v; want %v", test.err, got, test.want)
+		}
+	}
+}
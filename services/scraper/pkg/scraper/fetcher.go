@@ -0,0 +1,258 @@
+package scraper
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/limit"
+	"go-find-pepe/pkg/metrics"
+	"go-find-pepe/pkg/retry"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// ErrResponseTooLarge is returned for, or while reading, a response body larger
+// than the maximum response size
+var ErrResponseTooLarge = errors.New("response too large")
+
+type FetcherArguments struct {
+	// idle connections kept per host for reuse
+	MaxIdleConnsPerHost int
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// time to wait for the response headers after the request was written
+	ResponseHeaderTimeout time.Duration
+	// time a request may take, including reading the body
+	RequestTimeout time.Duration
+	// largest decoded response body that is read; 0 is unlimited
+	MaxResponseBytes int64
+	// retry policy per host; nil retries every host by retry.Default
+	RetryPolicies *retry.Policies
+	// rate limit per host; nil limits every host by limit.DefaultRates
+	HostRates *limit.Rates
+	Metrics   *metrics.Registry
+}
+
+// Fetcher sends the requests of every stage through one pooled transport
+type Fetcher struct {
+	client           *http.Client
+	maxResponseBytes int64
+	retryPolicies    *retry.Policies
+	rates            *limit.HostRateLimiter
+	requests         *metrics.Counter
+	connections      *metrics.Counter
+	tooLarge         *metrics.Counter
+	throttled        *metrics.Counter
+}
+
+func NewFetcher(arg FetcherArguments) *Fetcher {
+	dialer := &net.Dialer{Timeout: arg.DialTimeout, KeepAlive: 30 * time.Second}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   arg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   arg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: arg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		// bodies are decoded by the fetcher, which also accepts deflate
+		DisableCompression: true,
+	}
+
+	retryPolicies := arg.RetryPolicies
+	if retryPolicies == nil {
+		retryPolicies, _ = retry.Parse("", retry.Default())
+	}
+
+	registry := arg.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+
+	return &Fetcher{
+		client:           &http.Client{Transport: transport, Timeout: arg.RequestTimeout},
+		maxResponseBytes: arg.MaxResponseBytes,
+		retryPolicies:    retryPolicies,
+		rates:            limit.NewHostRateLimiter(arg.HostRates),
+		requests:         registry.NewCounter("scraper_http_requests_total", "Responses received per host and status code", "host", "code"),
+		connections:      registry.NewCounter("scraper_http_connections_total", "Connections used per host; reused is false for newly dialed connections", "host", "reused"),
+		tooLarge:         registry.NewCounter("scraper_http_responses_too_large_total", "Responses rejected for exceeding the maximum response size per host", "host"),
+		throttled:        registry.NewCounter("scraper_http_throttled_total", "429 and 503 responses that backed off their host", "host"),
+	}
+}
+
+// Do sends req once the rate of its host allows and returns the response with its
+// body decoded and limited to the maximum response size, and the round trip of req
+// up to the response headers, without waiting for the rate. raw wraps the body as
+// it is received, before decoding; it may be nil
+func (f *Fetcher) Do(req *http.Request, raw func(body io.ReadCloser) io.ReadCloser) (*http.Response, time.Duration, error) {
+	host := req.URL.Hostname()
+
+	err := f.rates.Wait(req.Context(), host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			f.connections.Inc(host, strconv.FormatBool(info.Reused))
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+
+	start := time.Now()
+	response, err := f.client.Do(req)
+	roundTrip := time.Since(start)
+	if err != nil {
+		return nil, roundTrip, err
+	}
+	f.requests.Inc(host, strconv.Itoa(response.StatusCode))
+
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		retryAfter, _ := retry.RetryAfter(response.Header, time.Now())
+		backoff := f.rates.Throttled(host, retryAfter)
+		f.throttled.Inc(host)
+		fmt.Printf("Backing off %v for %v after %v response\n", host, backoff, response.StatusCode)
+	} else {
+		f.rates.Succeeded(host)
+	}
+
+	if f.maxResponseBytes > 0 && response.ContentLength > f.maxResponseBytes {
+		response.Body.Close()
+		f.tooLarge.Inc(host)
+		return nil, roundTrip, fmt.Errorf("%w; %v bytes exceed %v", ErrResponseTooLarge, response.ContentLength, f.maxResponseBytes)
+	}
+
+	if raw != nil {
+		response.Body = raw(response.Body)
+	}
+
+	err = decode(response)
+	if err != nil {
+		response.Body.Close()
+		return nil, roundTrip, err
+	}
+
+	if f.maxResponseBytes > 0 {
+		response.Body = &limitedReadCloser{ReadCloser: response.Body, remaining: f.maxResponseBytes, onExceeded: func() { f.tooLarge.Inc(host) }}
+	}
+
+	return response, roundTrip, nil
+}
+
+// Client returns a Doer for the services of the scraper, such as the classifier:
+// requests go through the pooled transport with the request timeout and maximum
+// response size of f, but neither wait for the rate of their host nor are retried
+func (f *Fetcher) Client() *ServiceClient {
+	return &ServiceClient{fetcher: f}
+}
+
+// ServiceClient sends requests to a service through the transport of a Fetcher
+type ServiceClient struct {
+	fetcher *Fetcher
+}
+
+func (c *ServiceClient) Do(req *http.Request) (*http.Response, error) {
+	f := c.fetcher
+	host := req.URL.Hostname()
+
+	response, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	f.requests.Inc(host, strconv.Itoa(response.StatusCode))
+
+	if f.maxResponseBytes > 0 && response.ContentLength > f.maxResponseBytes {
+		response.Body.Close()
+		f.tooLarge.Inc(host)
+		return nil, fmt.Errorf("%w; %v bytes exceed %v", ErrResponseTooLarge, response.ContentLength, f.maxResponseBytes)
+	}
+	if f.maxResponseBytes > 0 {
+		response.Body = &limitedReadCloser{ReadCloser: response.Body, remaining: f.maxResponseBytes, onExceeded: func() { f.tooLarge.Inc(host) }}
+	}
+
+	return response, nil
+}
+
+// retryPolicy returns the retry policy of requests to host
+func (f *Fetcher) retryPolicy(host string) retry.Policy {
+	return f.retryPolicies.For(host)
+}
+
+// decode replaces the body of a gzip, deflate or brotli encoded response by its decoded content
+func decode(response *http.Response) error {
+	var decoded io.ReadCloser
+	var err error
+
+	switch strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(response.Body)
+	case "deflate":
+		decoded, err = zlib.NewReader(response.Body)
+	case "br":
+		decoded = io.NopCloser(brotli.NewReader(response.Body))
+	default:
+		return fmt.Errorf("unsupported content encoding %v", response.Header.Get("Content-Encoding"))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	response.Body = &decodedReadCloser{ReadCloser: decoded, raw: response.Body}
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	response.Uncompressed = true
+	return nil
+}
+
+// decodedReadCloser closes both the decoder and the body it decodes
+type decodedReadCloser struct {
+	io.ReadCloser
+	raw io.ReadCloser
+}
+
+func (d *decodedReadCloser) Close() error {
+	d.ReadCloser.Close()
+	return d.raw.Close()
+}
+
+// limitedReadCloser fails with ErrResponseTooLarge once more than remaining bytes are read
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining  int64
+	onExceeded func()
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+
+	// read one byte more than allowed to tell a body of exactly the maximum size apart
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.onExceeded()
+		return n + int(l.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
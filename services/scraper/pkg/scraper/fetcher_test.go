@@ -0,0 +1,161 @@
+package scraper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"go-find-pepe/pkg/limit"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func encode(t *testing.T, encoding string, content string) []byte {
+	buffer := &bytes.Buffer{}
+
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(buffer)
+	case "deflate":
+		w = zlib.NewWriter(buffer)
+	case "br":
+		w = brotli.NewWriter(buffer)
+	default:
+		return []byte(content)
+	}
+
+	_, err := w.Write([]byte(content))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func newTestFetcher(maxResponseBytes int64) *Fetcher {
+	rates, _ := limit.ParseRates(`{"*": {"requests_per_second": 0}}`)
+	return NewFetcher(FetcherArguments{HostRates: rates, MaxResponseBytes: maxResponseBytes})
+}
+
+func TestFetcherDecodes(t *testing.T) {
+	content := strings.Repeat("pepe ", 100)
+
+	for _, encoding := range []string{"", "identity", "gzip", "deflate", "br"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Accept-Encoding"); got != "gzip, deflate, br" {
+				t.Errorf("accepts encodings %v", got)
+			}
+			if encoding != "" {
+				w.Header().Set("Content-Encoding", encoding)
+			}
+			w.Write(encode(t, encoding, content))
+		}))
+
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		response, _, err := newTestFetcher(0).Do(req, nil)
+		if err != nil {
+			t.Errorf("%v: %v", encoding, err)
+			server.Close()
+			continue
+		}
+
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || string(body) != content {
+			t.Errorf("%v: decoded %q, %v", encoding, body, err)
+		}
+		server.Close()
+	}
+}
+
+func TestFetcherLimitsDecodedSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(encode(t, "br", strings.Repeat("0", 1000)))
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	response, _, err := newTestFetcher(100).Do(req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	_, err = io.ReadAll(response.Body)
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("read a decoded body above the maximum; %v", err)
+	}
+}
+
+func TestFetcherRejectsUnknownEncoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "zstd")
+		w.Write([]byte("?"))
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, _, err := newTestFetcher(0).Do(req, nil); err == nil {
+		t.Error("expected an error for an unsupported encoding")
+	}
+}
+
+func TestServiceClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		case "/large":
+			w.Write([]byte(strings.Repeat("pepe", 10)))
+		default:
+			w.Write([]byte(`{"score": 0.9}`))
+		}
+	}))
+	defer server.Close()
+
+	// the services are not rate limited like the hosts that are scraped
+	rates, err := limit.ParseRates(`{"*": {"requests_per_second": 0.001, "burst": 1}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewFetcher(FetcherArguments{HostRates: rates, MaxResponseBytes: 20, RequestTimeout: 100 * time.Millisecond}).Client()
+
+	get := func(path string) ([]byte, error) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		response, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		return io.ReadAll(response.Body)
+	}
+
+	for i := 0; i < 3; i++ {
+		body, err := get("/")
+		if err != nil || string(body) != `{"score": 0.9}` {
+			t.Fatalf("request %v got %q, %v", i, body, err)
+		}
+	}
+
+	if _, err := get("/large"); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("large response returned %v; want %v", err, ErrResponseTooLarge)
+	}
+
+	start := time.Now()
+	if _, err := get("/slow"); err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("slow response returned %v after %v; want a timeout", err, time.Since(start))
+	}
+}
@@ -1,42 +1,86 @@
 package scraper
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"go-find-pepe/pkg/blob"
 	"go-find-pepe/pkg/utils"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
-func writeFile(path string, file io.ReadCloser) {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Printf("An error has occurred while trying to store an file with name: %v \n", path)
-			panic(err)
-		}
-	}()
-
+func writeFile(path string, file io.Reader) error {
 	fmt.Printf("Writing file to %v\n", path)
 
 	dir := filepath.Dir(path)
 	err := os.MkdirAll(dir, os.ModePerm)
-	utils.Check(err)
+	if err != nil {
+		return err
+	}
 
 	f, err := os.Create(path)
-	utils.Check(err)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
 
 	_, err = io.Copy(f, file)
-	utils.Check(err)
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Successfully written file to %v\n", path)
+	return nil
 }
 
-func readFile(path string) io.ReadCloser {
-	file, err := os.Open(path)
-	utils.Check(err)
+// putContentAddressed streams file into store keyed by its SHA-256 as
+// prefix/ab/cd/<sha256>.<extension> so identical content is only stored once;
+// the content is spooled to a temporary file as the key is only known afterwards.
+// Returns the error that interrupted reading file, e.g. of a cancelled request, or
+// storing it, in which case nothing is stored
+func putContentAddressed(store blob.BlobStore, prefix string, extension string, file io.Reader) (key string, hash string, err error) {
+	tmp, err := os.CreateTemp("", "blob-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), file)
+	if err != nil {
+		return "", "", err
+	}
+
+	hash = hex.EncodeToString(hasher.Sum(nil))
+	key = path.Join(prefix, hash[0:2], hash[2:4], addExtension(hash, extension))
 
-	return file
+	_, err = store.Stat(key)
+	if err == nil {
+		fmt.Printf("File already stored at %v\n", key)
+		return
+	}
+	if !errors.Is(err, blob.ErrNotFound) {
+		return "", "", fmt.Errorf("failed to store a file in %v; %w", prefix, err)
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = store.Put(key, tmp, size)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store a file in %v; %w", prefix, err)
+	}
+
+	fmt.Printf("Successfully written file to %v\n", key)
+	return
 }
 
 func getProjectPath() string {
@@ -49,7 +93,17 @@ func addExtension(id string, extension string) string {
 	return fmt.Sprintf("%s.%s", id, extension)
 }
 
+// getExtension returns the lower-case extension of filename without the dot, as
+// the vision api only accepts lower-case extensions
 func getExtension(filename string) (extension string) {
-	extension = filepath.Ext(filename)[1:]
+	extension = strings.ToLower(filepath.Ext(filename)[1:])
 	return
 }
+
+// blobName is the file name key is classified under; the extension is lowered
+// for keys stored before getExtension lowered it
+func blobName(key string) string {
+	name := path.Base(key)
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + strings.ToLower(ext)
+}
@@ -0,0 +1,117 @@
+package scraper
+
+import (
+	"errors"
+	"go-find-pepe/pkg/blob"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGetExtension(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"https://i.4cdn.org/g/1.png", "png"},
+		{"https://i.4cdn.org/g/1.JPG", "jpg"},
+		{"https://i.4cdn.org/g/1.Gif", "gif"},
+	}
+
+	for _, test := range tests {
+		if got := getExtension(test.filename); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.filename, got, test.want)
+		}
+	}
+}
+
+func TestBlobName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"images/ab/abcdef.png", "abcdef.png"},
+		{"images/ab/abcdef.PNG", "abcdef.png"},
+		{"images/ab/ABCDEF.JPG", "ABCDEF.jpg"},
+	}
+
+	for _, test := range tests {
+		if got := blobName(test.key); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.key, got, test.want)
+		}
+	}
+}
+
+func TestPutContentAddressed(t *testing.T) {
+	store := blob.NewLocal(t.TempDir())
+
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"pepe", "images/7c/9e/7c9e7c1494b2684ab7c19d6aff737e460fa9e98d5a234da1310c97ddf5691834.png"},
+		// identical content is stored once
+		{"pepe", "images/7c/9e/7c9e7c1494b2684ab7c19d6aff737e460fa9e98d5a234da1310c97ddf5691834.png"},
+		{"wojak", "images/ef/aa/efaa37c791c7e79f04e976094fd6247f877fc89d2ff9bd75c159ddafa3083bfe.png"},
+	}
+
+	for _, test := range tests {
+		key, hash, err := putContentAddressed(store, "images", "png", strings.NewReader(test.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != test.want {
+			t.Errorf("%v: stored at %v, want %v", test.content, key, test.want)
+		}
+		if !strings.HasPrefix(key[strings.LastIndex(key, "/")+1:], hash+".") {
+			t.Errorf("%v: stored at %v, not at its hash %v", test.content, key, hash)
+		}
+
+		r, err := store.Get(key)
+		if err != nil {
+			t.Errorf("%v: %v", test.content, err)
+			continue
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if string(data) != test.content {
+			t.Errorf("%v: stored %q", test.content, data)
+		}
+	}
+
+	keys := 0
+	store.List("images/", func(blob.Info) { keys++ })
+	if keys != 2 {
+		t.Errorf("stored %v files; want 2", keys)
+	}
+}
+
+// interruptedReader fails after its content, like the body of a cancelled request
+type interruptedReader struct {
+	r io.Reader
+}
+
+func (i *interruptedReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	if err == io.EOF {
+		return n, errPutInterrupted
+	}
+	return n, err
+}
+
+var errPutInterrupted = errors.New("interrupted")
+
+func TestPutContentAddressedInterrupted(t *testing.T) {
+	store := blob.NewLocal(t.TempDir())
+
+	_, _, err := putContentAddressed(store, "images", "png", &interruptedReader{r: strings.NewReader("pepe")})
+	if !errors.Is(err, errPutInterrupted) {
+		t.Errorf("put returned %v; want %v", err, errPutInterrupted)
+	}
+
+	keys := 0
+	store.List("images/", func(blob.Info) { keys++ })
+	if keys != 0 {
+		t.Errorf("stored %v files of interrupted content", keys)
+	}
+}
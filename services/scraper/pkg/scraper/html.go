@@ -1,258 +1,428 @@
 package scraper
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"go-find-pepe/pkg/blob"
+	"go-find-pepe/pkg/canonical"
+	"go-find-pepe/pkg/constants"
 	"go-find-pepe/pkg/db"
 	"go-find-pepe/pkg/limit"
-	"go-find-pepe/pkg/utils"
+	"go-find-pepe/pkg/scope"
 	"io"
-	"path/filepath"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
 type Html struct {
-	allowedHrefSubstrings  []string
-	requiredHrefSubstrings []string
-	wg                     *sync.WaitGroup
-	done                   *sync.Mutex
-	imageHrefs             chan string
-	htmlLimit              int8
-	db                     *db.HtmlDbConnection
+	scope         *scope.Scope
+	fetcher       *Fetcher
+	downloads     *jobQueue
+	canonicalizer *canonical.Canonicalizer
+	run           *run
+	quotas        *quotas
+	htmlLimit     int8
+	// one of constants.TRAVERSAL_BFS, TRAVERSAL_DFS or TRAVERSAL_BEST_FIRST
+	traversal string
+	// pages deeper than maxDepth are not crawled; -1 is unlimited
+	maxDepth       int
+	pageTypeLimits map[string]PageTypeLimit
+	revisitAfter   time.Duration
+	worker         string
+	leaseTimeout   time.Duration
+	db             *db.HtmlDbConnection
+	frontier       *db.FrontierDbConnection
+	store          blob.BlobStore
 }
 
-type htmlResponse struct {
+// link is a link found on a page
+type link struct {
 	href string
-	body *io.ReadCloser
+	// estimated number of images of a linked thread
+	images int
 }
 
-func (s *Html) Start(startHref string) {
-	hrefs := make(chan string)
-	toBeScrapped := make(chan *db.Html)
+type htmlResponse struct {
+	href       string
+	servedFrom string
+	body       *io.ReadCloser
+}
 
-	done := make(chan bool)
-	wgU := WaitGroupHelper{WaitGroup: s.wg}
+// Start crawls the frontier, seeded with seedHrefs, until no url is left that is
+// pending or leased by any worker, apart from urls of boards that exhausted their
+// quota; leases abandoned by crashed workers are reclaimed. Once ctx is done no
+// more urls are leased and fetches in flight are given up, while the links of pages
+// already fetched are still enqueued until work is done. Start returns when the
+// crawls in flight returned and the urls they left leased were made pending again
+func (s *Html) Start(ctx context.Context, work context.Context, seedHrefs []string) {
+	wg := &sync.WaitGroup{}
+	wgU := WaitGroupHelper{WaitGroup: wg}
+
+	for _, seedHref := range seedHrefs {
+		err := s.enqueueSeed(ctx, seedHref)
+		if err != nil {
+			fmt.Printf("Failed to enqueue seed %v; %v\n", seedHref, err)
+		}
+	}
 
-	wgU.Wrapper(func() {
-		tx := s.db.CreateTransaction()
-		defer tx.Deferral()
+	htmlLimiter := limit.NewLimiter(s.htmlLimit)
+	held := keepAlive(work, s.leaseTimeout/3, s.heartbeat)
+	defer held.close()
+	defer s.release(context.WithoutCancel(ctx))
 
-		tx.FindAll(func(h *db.Html) {
-			s.wg.Add(1)
-			toBeScrapped <- h
-		})
-	})
+	var inFlight int64
+	// signals that a crawl finished and may have enqueued urls
+	crawled := make(chan bool, 1)
+	for {
+		if ctx.Err() != nil || htmlLimiter.Add(ctx) != nil {
+			wg.Wait()
+			fmt.Printf("HttpScraper stopped; %v\n", ctx.Err())
+			return
+		}
 
-	wgU.Wrapper(
-		func() {
-			request, err := s.getHttp(startHref)
+		excluded := db.FrontierExclusion{
+			PageTypes: s.quotas.exhaustedPageTypes(),
+			Boards:    s.quotas.exhaustedBoards(),
+		}
+		frontier, err := s.lease(ctx, excluded)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Failed to lease a url; %v\n", err)
+		}
+		if frontier != nil {
+			s.run.pageLeased(frontier.PageType)
+			if frontier.PageType == constants.PAGE_THREAD {
+				s.run.threadStarted(frontier.Board)
+			}
+			held.add(frontier.ID)
+			atomic.AddInt64(&inFlight, 1)
+			wgU.Wrapper(func() {
+				defer func() {
+					held.release(frontier.ID)
+					atomic.AddInt64(&inFlight, -1)
+					htmlLimiter.Done()
+					select {
+					case crawled <- true:
+					default:
+					}
+				}()
 
-			if err != nil {
-				if err.Error() == "html already exists" {
-					fmt.Printf("startHref already exists %v; continuing\n", startHref)
-					return
+				err := s.crawl(ctx, work, frontier)
+				if err != nil && work.Err() == nil {
+					// the lease expires and the url is crawled again
+					fmt.Printf("Failed to record crawl of %v; %v\n", frontier.Url, err)
 				}
+			})
+			continue
+		}
+		htmlLimiter.Done()
 
-				panic(fmt.Errorf("failed to get startHref %v; %v", startHref, err))
-			}
+		nextAt, err := s.nextDueAt(ctx, excluded)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Failed to find the next due url; %v\n", err)
+		}
+		if err == nil && nextAt == nil && atomic.LoadInt64(&inFlight) == 0 {
+			wg.Wait()
+			fmt.Println("HttpScraper exited")
+			return
+		}
 
-			path := s.storeHtml(request)
-			s.wg.Add(1)
-			toBeScrapped <- path
-		},
-	)
+		wait := LeasePollInterval
+		if nextAt != nil && time.Until(*nextAt) < wait {
+			wait = time.Until(*nextAt)
+		}
 
-	go func() {
-		s.done.Lock()
-		done <- true
-	}()
+		select {
+		case <-crawled:
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
 
-	htmlLimiter := limit.NewLimiter(s.htmlLimit)
+func (s *Html) enqueueSeed(ctx context.Context, href string) error {
+	seed, err := s.canonicalizer.Canonicalize(href)
+	if err != nil {
+		return err
+	}
 
-	s.wg.Done()
-	for {
-		select {
-		case <-done:
-			s.cleanup()
-			fmt.Println("HttpScraper exited")
-			return
-		case html := <-toBeScrapped:
-			func() {
-				defer s.wg.Done()
-				wgU.Wrapper(func() {
-					file := readFile(html.FilePath)
-					defer file.Close()
-					s.findHtmlHref(html.Href, file, hrefs)
-				})
-
-				wgU.Wrapper(func() {
-					file := readFile(html.FilePath)
-					defer file.Close()
-					s.findImageHref(html.Href, file, s.imageHrefs)
-				})
-			}()
-		case href := <-hrefs:
-			wgU.Wrapper(func() {
-				htmlLimiter.Add()
-				defer s.wg.Done()
-				defer htmlLimiter.Done()
-
-				response, err := s.getHttp(href)
-				if err != nil {
-					if err.Error() == "not found" {
-						// store something so it does not get picked up again
-						file := io.NopCloser(strings.NewReader("404"))
-						response = &htmlResponse{body: &file, href: href}
-					} else if err.Error() == "http unallowed source" || err.Error() == "html already exists" {
-						return
-					} else if err.Error() == "unsuccessful response" {
-						fmt.Printf("Failed request %v; ignoring\n", href)
-						return
-					} else {
-						panic(err)
-					}
-				}
+	tx := s.frontier.CreateTransaction(ctx)
+	defer tx.Deferral()
 
-				defer (*response.body).Close()
-				path := s.storeHtml(response)
+	return tx.EnqueueSeed(db.NewFrontier{
+		Url:      seed,
+		PageType: pageTypeOf(seed),
+		Board:    boardOf(seed),
+		Priority: s.priority(0, pageTypeOf(seed), 0),
+	})
+}
 
-				s.wg.Add(1)
-				toBeScrapped <- path
-			})
+// priority orders the frontier according to the traversal; images is the
+// estimated number of images of a thread
+func (s *Html) priority(depth int, pageType string, images int) int {
+	switch s.traversal {
+	case constants.TRAVERSAL_DFS:
+		return depth
+	case constants.TRAVERSAL_BEST_FIRST:
+		if pageType == constants.PAGE_THREAD {
+			return images
 		}
+		return -depth
+	default:
+		return -depth
 	}
 }
 
-func (s *Html) cleanup() {
-	fmt.Printf("Beginning to delete html database\n")
-	tx := s.db.CreateTransaction()
-	tx.DeleteAll()
-	defer tx.Commit()
+// withinDepth returns whether a page of pageType at depth may be crawled
+func (s *Html) withinDepth(depth int, pageType string) bool {
+	if s.maxDepth >= 0 && depth > s.maxDepth {
+		return false
+	}
 
-	fmt.Printf("Cleaned html database\n")
+	limit, ok := s.pageTypeLimits[pageType]
+	return !ok || limit.MaxDepth == nil || depth <= *limit.MaxDepth
 }
 
-func (s *Html) findHtmlHref(parentHref string, reader io.Reader, output chan string) *Html {
-	doc, err := goquery.NewDocumentFromReader(reader)
-	utils.Check(err)
+func (s *Html) lease(ctx context.Context, excluded db.FrontierExclusion) (*db.Frontier, error) {
+	tx := s.frontier.CreateTransaction(ctx)
+	defer tx.Deferral()
 
-	doc.Find("a").Each(func(i int, selection *goquery.Selection) {
-		href, exists := selection.Attr("href")
-		if !exists {
-			return
-		}
+	return tx.Lease(s.worker, s.leaseTimeout, excluded)
+}
 
-		unallowed := [6]string{"javascript", "#", " ", "<", ">", ":"}
-		for _, s := range unallowed {
-			if strings.Contains(href, s) {
-				return
-			}
-		}
+// release makes the urls this worker still holds pending again; a url is only
+// held after its crawl returned if the crawl was interrupted
+func (s *Html) release(ctx context.Context) {
+	tx := s.frontier.CreateTransaction(ctx)
+	defer tx.Deferral()
 
-		if !strings.Contains(href, "/") {
-			return
-		}
+	count, err := tx.Release(s.worker)
+	if err != nil {
+		fmt.Printf("Failed to release interrupted urls; %v\n", err)
+		return
+	}
+	if count > 0 {
+		fmt.Printf("Released %v interrupted urls\n", count)
+	}
+}
 
-		cleanedHref := fixMissingHttps(href)
-		hostname := getHostname(cleanedHref)
-		if hostname == "" && cleanedHref[0] != '/' {
-			cleanedHref = parentHref + cleanedHref
-		}
-		s.wg.Add(1)
-		output <- cleanedHref
-	})
+func (s *Html) heartbeat(ctx context.Context, IDs []uint) error {
+	tx := s.frontier.CreateTransaction(ctx)
+	defer tx.Deferral()
 
-	return s
+	return tx.Heartbeat(IDs, s.worker, s.leaseTimeout)
 }
 
-func (s *Html) findImageHref(parentHref string, reader io.Reader, output chan string) *Html {
-	doc, err := goquery.NewDocumentFromReader(reader)
-	utils.Check(err)
+func (s *Html) nextDueAt(ctx context.Context, excluded db.FrontierExclusion) (*time.Time, error) {
+	tx := s.frontier.CreateTransaction(ctx)
+	defer tx.Deferral()
 
-	fileSelection := doc.Find("div .file").Find("div .fileText")
-	fileSelection.Find("a").Each(func(i int, selection *goquery.Selection) {
-		href, exists := selection.Attr("href")
-		if !exists {
-			return
-		}
+	return tx.NextDueAt(excluded)
+}
 
-		unallowed := [6]string{"javascript", "#", " ", "<", ">", ":"}
-		for _, s := range unallowed {
-			if strings.Contains(href, s) {
-				return
-			}
+// crawl fetches the page of frontier; a crawl interrupted by ctx leaves frontier
+// leased, so its lease expires and it is crawled again. Once the page is stored,
+// its links and images are enqueued and frontier is completed unless work is done.
+// Returns the error that prevented recording the outcome of the crawl, which
+// leaves frontier leased too
+func (s *Html) crawl(ctx context.Context, work context.Context, frontier *db.Frontier) error {
+	response, err := s.getHttp(ctx, frontier.Url, frontier.Board)
+	if err != nil {
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, ErrNotFound):
+			s.run.pageNotFound(frontier.Board)
+			return s.fail(ctx, frontier)
+		case errors.Is(err, ErrDisallowed), errors.Is(err, ErrResponseTooLarge):
+			fmt.Printf("Failed to get %v; %v\n", frontier.Url, err)
+			return s.fail(ctx, frontier)
+		default:
+			return s.backoff(ctx, frontier)
 		}
+	}
 
-		cleanedHref := fixMissingHttps(href)
-		hostname := getHostname(cleanedHref)
-		if hostname == "" && cleanedHref[0] != '/' {
-			cleanedHref = parentHref + cleanedHref
+	defer (*response.body).Close()
+	html, err := s.storeHtml(ctx, response)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
 		}
+		fmt.Printf("Failed to read %v; %v\n", frontier.Url, err)
+		return s.backoff(ctx, frontier)
+	}
+	s.run.pageFetched(frontier.Board)
 
-		s.wg.Add(1)
-		output <- cleanedHref
-	})
+	doc, err := s.parseHtml(html)
+	if err != nil {
+		fmt.Printf("Failed to parse %v; %v\n", frontier.Url, err)
+		return s.fail(work, frontier)
+	}
 
-	return s
+	// relative links are relative to where the page was served from after redirects
+	err = s.enqueue(work, frontier, s.findHtmlHref(response.servedFrom, doc))
+	if err != nil {
+		return err
+	}
+	err = discoverImages(work, s.downloads, s.run, s.findImageHref(response.servedFrom, doc))
+	if err != nil {
+		return err
+	}
+	return s.complete(work, frontier)
 }
 
-func (s *Html) getHttp(href string) (*htmlResponse, error) {
-	if s.doesHtmlExist(href) {
-		return nil, errors.New("html already exists")
+func (s *Html) parseHtml(html *db.Html) (*goquery.Document, error) {
+	file, err := s.store.Get(html.Key)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
 
-	cleanedHref := fixMissingHttps(href)
-	hostname := getHostname(cleanedHref)
+	return goquery.NewDocumentFromReader(file)
+}
+
+func (s *Html) enqueue(ctx context.Context, parent *db.Frontier, links []link) error {
+	depth := parent.Depth + 1
 
-	correctAllowedSubstrings := stringShouldContainOneFilter(hostname, s.allowedHrefSubstrings)
-	correctRequiredSubstrings := stringShouldContainAllFilters(cleanedHref, s.requiredHrefSubstrings)
+	news := []db.NewFrontier{}
+	for _, l := range links {
+		pageType := pageTypeOf(l.href)
+		if !s.scope.AllowsPage(l.href) || !s.withinDepth(depth, pageType) {
+			continue
+		}
 
-	if !correctAllowedSubstrings || !correctRequiredSubstrings {
-		return nil, errors.New("http unallowed source")
+		news = append(news, db.NewFrontier{
+			Url:            l.href,
+			Depth:          depth,
+			PageType:       pageType,
+			Board:          boardOf(l.href),
+			Priority:       s.priority(depth, pageType, l.images),
+			DiscoveredFrom: parent.Url,
+		})
 	}
 
-	request := Request{url: cleanedHref, reuseConnection: true, method: "GET"}
-	response, statusCode, success := request.Do(1)
+	tx := s.frontier.CreateTransaction(ctx)
+	defer tx.Deferral()
 
-	if statusCode == 404 {
-		return nil, errors.New("not found")
-	}
+	return tx.Enqueue(news)
+}
+
+func (s *Html) complete(ctx context.Context, frontier *db.Frontier) error {
+	tx := s.frontier.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	return tx.Complete(frontier.ID, s.worker, s.revisitAfter)
+}
 
-	if !success {
-		return nil, errors.New("unsuccessful response")
+// backoff retries frontier with exponential backoff; fails it once it was
+// attempted MAX_RETRY_ATTEMPT times
+func (s *Html) backoff(ctx context.Context, frontier *db.Frontier) error {
+	if frontier.Attempts >= MAX_RETRY_ATTEMPT {
+		fmt.Printf("Failed request %v %v times; giving up\n", frontier.Url, frontier.Attempts)
+		return s.fail(ctx, frontier)
 	}
 
-	return &htmlResponse{body: &response, href: href}, nil
+	backoff := calculateExponentialBackoffInSec(uint8(frontier.Attempts))
+	fmt.Printf("Failed request %v; retrying after %v\n", frontier.Url, backoff)
+	return s.retry(ctx, frontier, time.Second*time.Duration(backoff))
 }
 
-func (s *Html) storeHtml(r *htmlResponse) *db.Html {
-	tx := s.db.CreateTransaction()
+func (s *Html) retry(ctx context.Context, frontier *db.Frontier, after time.Duration) error {
+	tx := s.frontier.CreateTransaction(ctx)
 	defer tx.Deferral()
 
-	path := s.newPath()
-	html := tx.Create(db.NewHtml{
-		FilePath: path,
-		Href:     r.href,
-		Board:    "",
+	return tx.Retry(frontier.ID, s.worker, after)
+}
+
+func (s *Html) fail(ctx context.Context, frontier *db.Frontier) error {
+	tx := s.frontier.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	return tx.Fail(frontier.ID, s.worker)
+}
+
+// findHtmlHref returns the canonical urls of the links on the page at base
+func (s *Html) findHtmlHref(base string, doc *goquery.Document) []link {
+	links := []link{}
+
+	doc.Find("a").Each(func(i int, selection *goquery.Selection) {
+		href, exists := selection.Attr("href")
+		if !exists {
+			return
+		}
+
+		resolved, err := s.canonicalizer.Resolve(base, href)
+		if err != nil {
+			return
+		}
+		l := link{href: resolved}
+		if s.traversal == constants.TRAVERSAL_BEST_FIRST && pageTypeOf(resolved) == constants.PAGE_THREAD {
+			l.images = estimateImages(selection)
+		}
+		links = append(links, l)
 	})
 
-	writeFile(path, *r.body)
-	return html
+	return links
 }
 
-func (s *Html) doesHtmlExist(href string) bool {
-	tx := s.db.CreateTransaction()
-	defer tx.Deferral()
-	return tx.ExistsByHref(href)
+// findImageHref returns the canonical urls of the files posted on the page at base
+func (s *Html) findImageHref(base string, doc *goquery.Document) []*imageHref {
+	hrefs := []*imageHref{}
+
+	doc.Find("div .file").Each(func(i int, file *goquery.Selection) {
+		href, exists := file.Find("div .fileText").Find("a").Attr("href")
+		if !exists {
+			return
+		}
+
+		// the thumbnail carries the base64 md5 of the full file
+		md5, _ := file.Find("img").Attr("data-md5")
+
+		resolved, err := s.canonicalizer.Resolve(base, href)
+		if err != nil {
+			return
+		}
+
+		hrefs = append(hrefs, &imageHref{Href: resolved, Md5: md5})
+	})
+
+	return hrefs
 }
 
-func (s *Html) newPath() (path string) {
-	fileName := createUniqueId()
-	fileName = addExtension(fileName, "html")
+func (s *Html) getHttp(ctx context.Context, href string, board string) (*htmlResponse, error) {
+	if !s.scope.AllowsPage(href) {
+		return nil, fmt.Errorf("page %v; %w", href, ErrDisallowed)
+	}
+
+	cleanedHref := fixMissingHttps(href)
+
+	request := Request{fetcher: s.fetcher, url: cleanedHref, reuseConnection: true, method: "GET", run: s.run, board: board}
+	response, err := request.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &htmlResponse{body: &response, href: href, servedFrom: request.servedFrom}, nil
+}
+
+// storeHtml returns the error that interrupted reading or storing the response
+func (s *Html) storeHtml(ctx context.Context, r *htmlResponse) (*db.Html, error) {
+	key, hash, err := putContentAddressed(s.store, HtmlPrefix, "html", *r.body)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := s.db.CreateTransaction(ctx)
+	defer tx.Deferral()
 
-	path = filepath.Join(getProjectPath(), HtmlDir, fileName)
-	return
+	return tx.Create(db.NewHtml{
+		Key:    key,
+		Href:   r.href,
+		Board:  boardOf(r.href),
+		Sha256: hash,
+		RunID:  s.run.id(),
+	}), nil
 }
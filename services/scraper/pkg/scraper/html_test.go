@@ -0,0 +1,129 @@
+package scraper
+
+import (
+	"go-find-pepe/pkg/canonical"
+	"go-find-pepe/pkg/constants"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+const threadPage = `<html><body><div class="thread">
+<div class="file">
+	<div class="fileText">File: <a href="//i.4cdn.org/g/1605032734427.png">tux.png</a></div>
+	<a class="fileThumb" href="//i.4cdn.org/g/1605032734427.png"><img src="//i.4cdn.org/g/1605032734427s.jpg" data-md5="Y9mUa1FyaA0cZHl9FTvPCA=="></a>
+</div>
+<div class="file">
+	<div class="fileText">File: <a href="//i.4cdn.org/g/1605032830153.jpg">screenshot.jpg</a></div>
+</div>
+<div class="file">
+	<div class="fileText">File: <a href="javascript:void(0)">hidden.jpg</a></div>
+</div>
+</div></body></html>`
+
+func parsePage(t *testing.T, page string) *goquery.Document {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// findImages returns the images findImageHref finds on page
+func findImages(t *testing.T, page string) []*imageHref {
+	return (&Html{canonicalizer: canonical.Default()}).findImageHref("https://boards.4chan.org/g/thread/76759434", parsePage(t, page))
+}
+
+func TestFindImageHrefCarriesMd5(t *testing.T) {
+	want := []imageHref{
+		{Href: "https://i.4cdn.org/g/1605032734427.png", Md5: "Y9mUa1FyaA0cZHl9FTvPCA=="},
+		{Href: "https://i.4cdn.org/g/1605032830153.jpg", Md5: ""},
+	}
+
+	got := findImages(t, threadPage)
+	if len(got) != len(want) {
+		t.Fatalf("found %v images; want %v", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i] != want[i] {
+			t.Errorf("image %v: got %+v, want %+v", i, *got[i], want[i])
+		}
+	}
+}
+
+const boardPage = `<html><body>
+<a href="//boards.4chan.org/g/2">2</a>
+<a href="thread/76759434">Reply</a>
+<a href="javascript:void(0)">Hide</a>
+<a href="#top">Top</a>
+<a href="catalog">Catalog</a>
+<a>no href</a>
+</body></html>`
+
+func TestFindHtmlHref(t *testing.T) {
+	want := []string{
+		"https://boards.4chan.org/g/2",
+		"https://boards.4chan.org/g/thread/76759434",
+		"https://boards.4chan.org/g",
+		"https://boards.4chan.org/g/catalog",
+	}
+
+	links := (&Html{canonicalizer: canonical.Default()}).findHtmlHref("https://boards.4chan.org/g/", parsePage(t, boardPage))
+	got := []string{}
+	for _, l := range links {
+		got = append(got, l.href)
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	tests := []struct {
+		traversal string
+		depth     int
+		pageType  string
+		images    int
+		want      int
+	}{
+		{constants.TRAVERSAL_BFS, 2, constants.PAGE_THREAD, 10, -2},
+		{constants.TRAVERSAL_DFS, 2, constants.PAGE_THREAD, 10, 2},
+		{constants.TRAVERSAL_BEST_FIRST, 2, constants.PAGE_THREAD, 10, 10},
+		{constants.TRAVERSAL_BEST_FIRST, 2, constants.PAGE_INDEX, 10, -2},
+	}
+
+	for _, test := range tests {
+		s := &Html{traversal: test.traversal}
+		if got := s.priority(test.depth, test.pageType, test.images); got != test.want {
+			t.Errorf("%v of a %v at depth %v: got %v, want %v", test.traversal, test.pageType, test.depth, got, test.want)
+		}
+	}
+}
+
+func TestWithinDepth(t *testing.T) {
+	one := 1
+	s := &Html{maxDepth: 2, pageTypeLimits: map[string]PageTypeLimit{constants.PAGE_ARCHIVE: {MaxDepth: &one}}}
+
+	tests := []struct {
+		depth    int
+		pageType string
+		want     bool
+	}{
+		{2, constants.PAGE_THREAD, true},
+		{3, constants.PAGE_THREAD, false},
+		{1, constants.PAGE_ARCHIVE, true},
+		{2, constants.PAGE_ARCHIVE, false},
+	}
+
+	for _, test := range tests {
+		if got := s.withinDepth(test.depth, test.pageType); got != test.want {
+			t.Errorf("%v at depth %v: got %v, want %v", test.pageType, test.depth, got, test.want)
+		}
+	}
+
+	unlimited := &Html{maxDepth: -1}
+	if !unlimited.withinDepth(100, constants.PAGE_THREAD) {
+		t.Error("a page is too deep without a max depth")
+	}
+}
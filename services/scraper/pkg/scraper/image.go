@@ -1,236 +1,500 @@
 package scraper
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"go-find-pepe/pkg/blob"
+	"go-find-pepe/pkg/classifier"
 	"go-find-pepe/pkg/constants"
 	"go-find-pepe/pkg/db"
 	"go-find-pepe/pkg/limit"
-	"go-find-pepe/pkg/utils"
+	"go-find-pepe/pkg/phash"
+	"go-find-pepe/pkg/scope"
+	"go-find-pepe/pkg/taxonomy"
 	"io"
-	"io/ioutil"
-	"path/filepath"
-	"regexp"
+	"strconv"
 	"sync"
+	"time"
+
+	"gorm.io/gorm"
 )
 
 type Image struct {
-	allowedImageTypes []string
-	visionApiUrl      string
-	wg                *sync.WaitGroup
-	done              *sync.Mutex
-	imageHrefs        chan string
-	imageLimit        int8
-	classifyLimit     int8
-	db                *db.ImageDbConnection
+	scope             *scope.Scope
+	classifier        classifier.Classifier
+	fetcher           *Fetcher
+	downloads         *jobQueue
+	classifications   *jobQueue
+	run               *run
+	quotas            *quotas
+	downloadLimiter   limit.Limiter
+	classifyLimiter   limit.Limiter
+	classifyBatchSize int
+	classifyBatchWait time.Duration
+	// model classifications are expected to come from
+	model           string
+	taxonomy        *taxonomy.Taxonomy
+	db              *db.ImageDbConnection
+	store           blob.BlobStore
+	hashes          *phash.BKTree
+	maxHashDistance int
+	// latest update of a hashed image that was loaded into hashes
+	hashesLoadedUntil time.Time
+}
+
+// imageHref is the payload of an image download job
+type imageHref struct {
+	Href string `json:"href"`
+	// base64 encoded md5 of the file as provided by 4chan; empty if unknown
+	Md5 string `json:"md5"`
 }
 
 type imageResponse struct {
 	href string
+	md5  string
 	body *io.ReadCloser
 }
 
-type visionResponse struct {
-	Score float32 `json:"score"`
-}
+// discoverImages enqueues a download job, keyed by the href, for every href that
+// was not enqueued before; the others count as skipped on their board
+func discoverImages(ctx context.Context, downloads *jobQueue, r *run, hrefs []*imageHref) error {
+	jobsPerBoard := map[string][]db.NewJob{}
+	for _, href := range hrefs {
+		board := boardOf(href.Href)
+		jobsPerBoard[board] = append(jobsPerBoard[board], db.NewJob{Key: href.Href, Payload: encodePayload(href), Board: board})
+	}
 
-func (s *Image) Start() {
-	toBeClassified := make(chan *db.Image)
+	for board, jobs := range jobsPerBoard {
+		enqueued, err := downloads.enqueue(ctx, jobs, false)
+		if err != nil {
+			return fmt.Errorf("failed to enqueue downloads of %v; %w", board, err)
+		}
 
-	done := make(chan bool)
-	wgU := WaitGroupHelper{WaitGroup: s.wg}
+		r.imagesFound(board, len(jobs))
+		for i := enqueued; i < int64(len(jobs)); i++ {
+			r.imageSkipped(board)
+		}
+	}
+	return nil
+}
 
-	wgU.Wrapper(func() {
-		tx := s.db.CreateImageTransaction()
+// Start downloads the images discovered until discovered is closed, and classifies
+// them and every stored image that is still unclassified. Once ctx is done no more
+// work is leased; work in flight continues until work is done
+func (s *Image) Start(ctx context.Context, work context.Context, discovered <-chan bool) {
+	err := s.enqueueClassifications(ctx, false, func(cb func(*db.Image)) error {
+		tx := s.db.CreateImageTransaction(ctx)
 		defer tx.Deferral()
+		return tx.FindAllUnclassified(cb)
+	})
+	if err != nil && ctx.Err() == nil {
+		// the images are found unclassified again by the next run
+		fmt.Printf("Failed to enqueue unclassified images; %v\n", err)
+	}
 
-		tx.FindAllUnclassified(func(i *db.Image) {
-			s.wg.Add(1)
-			toBeClassified <- i
+	stopLoadingHashes := s.keepLoadingHashes(work)
+	defer stopLoadingHashes()
+
+	downloaded := make(chan bool)
+	wg := &sync.WaitGroup{}
+	wgU := WaitGroupHelper{WaitGroup: wg}
+
+	wgU.Wrapper(func() {
+		defer close(downloaded)
+		s.downloads.drain(ctx, work, discovered, s.downloadLimiter, 1, 0, func(ctx context.Context, jobs []*db.Job) {
+			for _, job := range jobs {
+				err := s.download(ctx, job)
+				if err != nil && ctx.Err() == nil {
+					// the lease expires and the image is downloaded again
+					fmt.Printf("Failed to record download %v; %v\n", job.Key, err)
+				}
+			}
 		})
 	})
+	wgU.Wrapper(func() {
+		s.classify(ctx, work, downloaded)
+	})
 
-	hrefLimiter := limit.NewLimiter(s.imageLimit)
-	classifyLimiter := limit.NewLimiter(s.classifyLimit)
+	wg.Wait()
+	fmt.Println("ImageScraper exited")
+}
 
-	go func() {
-		s.done.Lock()
-		done <- true
-	}()
+// Reclassify sends every image classified by another model than the current
+// one, or in one of categories, through the classification again
+func (s *Image) Reclassify(ctx context.Context, work context.Context, categories []string) {
+	if s.model == "" {
+		fmt.Printf("No current model configured; only reclassifying categories %v\n", categories)
+	}
 
-	s.wg.Done()
-	for {
-		select {
-		case <-done:
-			fmt.Println("ImageScraper exited")
-			return
-		case img := <-toBeClassified:
-			wgU.Wrapper(func() {
-				classifyLimiter.Add()
-				defer s.wg.Done()
-				defer classifyLimiter.Done()
-				s.classifyImage(img)
-			})
-
-		case href := <-s.imageHrefs:
-			wgU.Wrapper(func() {
-				hrefLimiter.Add()
-
-				defer s.wg.Done()
-				defer hrefLimiter.Done()
-
-				response, err := s.getImage(href)
-
-				if err != nil {
-					if err.Error() == "image type not allowed" || err.Error() == "image already exists" {
-						return
-					} else if err.Error() == "unsuccessful response" {
-						fmt.Printf("Failed request %v; ignoring\n", href)
-						return
-					} else {
-						panic(err)
-					}
-				}
-				defer (*response.body).Close()
+	err := s.enqueueClassifications(ctx, true, func(cb func(*db.Image)) error {
+		tx := s.db.CreateImageTransaction(ctx)
+		defer tx.Deferral()
+		return tx.FindAllToReclassify(s.model, categories, cb)
+	})
+	if err != nil {
+		fmt.Printf("Failed to enqueue images to reclassify; %v\n", err)
+		return
+	}
+
+	nothingUpstream := make(chan bool)
+	close(nothingUpstream)
+	s.classify(ctx, work, nothingUpstream)
+
+	fmt.Println("ImageScraper exited")
+}
+
+// enqueueClassifications enqueues a classification job for every image findAll
+// selects; reopen classifies images with a finished job again. Stops enqueueing
+// at the first error
+func (s *Image) enqueueClassifications(ctx context.Context, reopen bool, findAll func(cb func(*db.Image)) error) error {
+	const batchSize = 500
 
-				s.wg.Add(1)
-				toBeClassified <- s.storeImageResponse(response)
-			})
+	jobs := []db.NewJob{}
+	var enqueueErr error
+	err := findAll(func(i *db.Image) {
+		if enqueueErr != nil {
+			return
+		}
+		jobs = append(jobs, db.NewJob{Key: strconv.FormatUint(uint64(i.ID), 10), Board: i.Board})
+		if len(jobs) >= batchSize {
+			_, enqueueErr = s.classifications.enqueue(ctx, jobs, reopen)
+			jobs = []db.NewJob{}
 		}
+	})
+	if err != nil {
+		return err
 	}
+	if enqueueErr != nil {
+		return enqueueErr
+	}
+
+	_, err = s.classifications.enqueue(ctx, jobs, reopen)
+	return err
 }
 
-func (s *Image) classifyImage(img *db.Image) {
-	file := readFile(img.FilePath)
-	defer file.Close()
+// classify classifies the images of classification jobs in batches until upstream
+// is closed and no job is left
+func (s *Image) classify(ctx context.Context, work context.Context, upstream <-chan bool) {
+	s.classifications.drain(ctx, work, upstream, s.classifyLimiter, s.classifyBatchSize, s.classifyBatchWait, func(ctx context.Context, jobs []*db.Job) {
+		// the lease of a job whose outcome is not recorded expires, and its image is
+		// classified again
+		record := func(job *db.Job, err error) {
+			if err != nil {
+				fmt.Printf("Failed to record classification of image %v; %v\n", job.Key, err)
+			}
+		}
 
-	probability, err := s.retrieveImageProbability(img.FilePath, file)
+		imgs := []*db.Image{}
+		imgJobs := []*db.Job{}
+		for _, job := range jobs {
+			img, err := s.findImageOfJob(ctx, job)
+			if err != nil {
+				fmt.Printf("Failed to find image %v of classification job; %v\n", job.Key, err)
+				continue
+			}
+			if img == nil {
+				fmt.Printf("Image %v of classification job no longer exists\n", job.Key)
+				record(job, s.classifications.fail(ctx, job))
+				continue
+			}
+			imgs = append(imgs, img)
+			imgJobs = append(imgJobs, job)
+		}
 
-	if err != nil {
-		if err.Error() == "faulty file" {
-			fmt.Printf("Unsuccessful POST %v; faulty image %v\n", s.visionApiUrl, img.ID)
-			s.updateClassificationById(img.ID, constants.CATEGORY_FAULTY, 0)
+		errs := s.classifyImages(ctx, imgs)
+		if ctx.Err() != nil {
+			// the leases expire and the images are classified again
 			return
-		} else {
-			panic(err)
 		}
-	}
 
-	var category string
-	if probability >= PepeThreshold {
-		category = constants.CATEGORY_PEPE
-	} else if probability >= MaybeThreshold {
-		category = constants.CATEGORY_MAYBE
-	} else {
-		category = constants.CATEGORY_NON_PEPE
-	}
+		for i, job := range imgJobs {
+			if errs[i] != nil {
+				fmt.Printf("Failed to classify image %v; %v\n", imgs[i].ID, errs[i])
+				record(job, s.classifications.retry(ctx, job))
+				continue
+			}
+			record(job, s.classifications.complete(ctx, job))
+		}
+	})
+}
 
-	s.updateClassificationById(img.ID, category, probability)
-	fmt.Printf("Successfully formatted %v; category: %v; probability: %v \n", img.ID, category, probability)
+// observe reports how work went to limiter if it adapts to that; work interrupted
+// by ctx says nothing about its destination
+func observe(ctx context.Context, limiter limit.Limiter, latency time.Duration, overloaded bool) {
+	feedback, ok := limiter.(limit.Feedback)
+	if !ok || ctx.Err() != nil {
+		return
+	}
+	feedback.Observe(latency, overloaded)
 }
 
-func (s *Image) updateClassificationById(id uint, category string, classification float32) {
-	tx := s.db.CreateImageTransaction()
+// findImageOfJob returns nil if the image of job does not exist (anymore)
+func (s *Image) findImageOfJob(ctx context.Context, job *db.Job) (*db.Image, error) {
+	ID, err := strconv.ParseUint(job.Key, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+
+	tx := s.db.CreateImageTransaction(ctx)
 	defer tx.Deferral()
-	err := tx.UpdateById(id, db.NewImage{Classification: classification, Category: category})
-	utils.Check(err)
+
+	img, err := tx.FindOneByID(uint(ID))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return img, err
 }
 
-func (s *Image) storeImageResponse(r *imageResponse) *db.Image {
-	tx := s.db.CreateImageTransaction()
-	defer tx.Deferral()
+// download handles an image download job; images that need a classification get
+// a classification job. A download interrupted by ctx leaves job leased, so its
+// lease expires and it is downloaded again. Returns the error that prevented
+// recording the outcome of the download, which leaves job leased too
+func (s *Image) download(ctx context.Context, job *db.Job) error {
+	var img imageHref
+	err := decodePayload(job, &img)
+	if err != nil {
+		fmt.Printf("Failed to decode download job %v; %v\n", job.Key, err)
+		return s.downloads.fail(ctx, job)
+	}
 
-	ext := getExtension(r.href)
-	path := s.newPath(ext)
+	response, err := s.getImage(ctx, &img, job.Board)
+	if err != nil {
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, ErrAlreadyExists):
+			s.run.imageSkipped(job.Board)
+			return s.downloads.complete(ctx, job)
+		case errors.Is(err, ErrDisallowed), errors.Is(err, ErrNotFound), errors.Is(err, ErrResponseTooLarge):
+			fmt.Printf("Failed to get %v; %v\n", img.Href, err)
+			return s.downloads.fail(ctx, job)
+		default:
+			fmt.Printf("Failed request %v; %v\n", img.Href, err)
+			return s.downloads.retry(ctx, job)
+		}
+	}
+	defer (*response.body).Close()
 
-	i := tx.Create(db.NewImage{
-		FilePath: path,
-		Category: constants.CATEGORY_UNCLASSIFIED,
-		Href:     r.href,
-		Board:    s.extractBoard(r.href),
-	})
+	i, err := s.storeImageResponse(ctx, response)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		fmt.Printf("Failed to read %v; %v\n", img.Href, err)
+		return s.downloads.retry(ctx, job)
+	}
+
+	// a duplicate by content was counted as skipped by storeImageResponse
+	if i != nil {
+		s.run.imageDownloaded(job.Board)
+
+		if !s.reuseNearDuplicateClassification(ctx, i) {
+			_, err = s.classifications.enqueue(ctx, []db.NewJob{{Key: strconv.FormatUint(uint64(i.ID), 10), Board: i.Board}}, false)
+			if err != nil {
+				// the image is found unclassified by the next run
+				fmt.Printf("Failed to enqueue classification of %v; %v\n", i.ID, err)
+			}
+		}
+	}
 
-	writeFile(path, *r.body)
-	return i
+	return s.downloads.complete(ctx, job)
 }
 
-func (s *Image) getImage(href string) (*imageResponse, error) {
-	cleanedHref := fixMissingHttps(href)
+// classifyImages returns, per image, the error that prevented its classification
+func (s *Image) classifyImages(ctx context.Context, imgs []*db.Image) []error {
+	if len(imgs) == 0 {
+		return nil
+	}
 
-	correctRequiredSubstrings := stringShouldContainOneFilter(cleanedHref, s.allowedImageTypes)
-	if !correctRequiredSubstrings {
-		return nil, errors.New("image type not allowed")
+	errs := make([]error, len(imgs))
+	readable := []*db.Image{}
+	blobs := []classifier.Blob{}
+	for i, img := range imgs {
+		blob, err := s.readBlob(img)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to read %v; %w", img.Key, err)
+			continue
+		}
+		readable = append(readable, img)
+		blobs = append(blobs, blob)
 	}
 
-	if s.doesImageExist(cleanedHref) {
-		return nil, errors.New("image already exists")
+	start := time.Now()
+	results, classifyErrs := classifier.ClassifyBatch(ctx, s.classifier, blobs)
+	if len(blobs) > 0 {
+		// the classifier retried already, so an overloaded failure left suggests it is
+		// struggling; batches differ in size, so the latency is taken per image
+		failed := false
+		for _, err := range classifyErrs {
+			failed = failed || overloaded(err)
+		}
+		observe(ctx, s.classifyLimiter, time.Since(start)/time.Duration(len(blobs)), failed)
+	}
+	for i, j := 0, 0; i < len(imgs); i++ {
+		if errs[i] != nil {
+			continue
+		}
+		errs[i] = s.classifyImage(ctx, readable[j], results[j], classifyErrs[j])
+		j++
 	}
+	return errs
+}
 
-	request := Request{url: cleanedHref, reuseConnection: true, method: "GET"}
-	response, _, success := request.Do(1)
+func (s *Image) readBlob(img *db.Image) (classifier.Blob, error) {
+	file, err := s.store.Get(img.Key)
+	if err != nil {
+		return classifier.Blob{}, err
+	}
+	defer file.Close()
 
-	if !success {
-		return nil, errors.New("unsuccessful response")
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return classifier.Blob{}, err
 	}
 
-	return &imageResponse{href: href, body: &response}, nil
+	return classifier.Blob{Name: blobName(img.Key), Data: data}, nil
 }
 
-func (s *Image) retrieveImageProbability(filePath string, file io.ReadCloser) (float32, error) {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Printf("An error has occurred while trying to classify an image with name: %v \n", filePath)
-			panic(err)
+func (s *Image) classifyImage(ctx context.Context, img *db.Image, result classifier.Result, err error) error {
+	if err != nil {
+		if errors.Is(err, classifier.ErrFaultyFile) {
+			fmt.Printf("Unsuccessful classification; faulty image %v\n", img.ID)
+			return s.updateClassification(ctx, img, constants.CATEGORY_FAULTY, 0, nil, result.Model, constants.SOURCE_MODEL)
 		}
-	}()
+		return err
+	}
 
-	b, w := createSingleFileMultiPart(VisionImageKey, filePath, file)
-	ct := w.FormDataContentType()
+	category, probability := s.taxonomy.Categorize(result.Scores)
 
-	request := Request{url: s.visionApiUrl, reuseConnection: true, method: "POST", body: b, contentType: &ct}
+	err = s.updateClassification(ctx, img, category, probability, result.Scores, result.Model, constants.SOURCE_MODEL)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Successfully formatted %v; category: %v; probability: %v; model: %v \n", img.ID, category, probability, result.Model)
+	return nil
+}
 
-	var do func(nRetry uint8) (float32, error)
-	do = func(nRetry uint8) (float32, error) {
-		response, statusCode, success := request.Do(nRetry)
+func (s *Image) updateClassification(ctx context.Context, img *db.Image, category string, classification float32, scores map[string]float32, model string, source string) error {
+	labels, err := json.Marshal(scores)
+	if err != nil {
+		return err
+	}
 
-		// assume that if 500 was returned; something is wrong with the file
-		if statusCode == 500 {
-			return 0, fmt.Errorf("faulty file")
-		}
+	tx := s.db.CreateImageTransaction(ctx)
+	defer tx.Deferral()
+	err = tx.Classify(db.NewClassification{
+		ImageID:  img.ID,
+		Model:    model,
+		Score:    classification,
+		Labels:   string(labels),
+		Category: category,
+		Source:   source,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store classification; %w", err)
+	}
 
-		if !success {
-			// retry the request; not 500 or 200, most likely some temporary error
-			return do(nRetry + 1)
-		}
+	s.run.imageClassified(img.Board, category)
+	return nil
+}
+
+// storeImageResponse returns nil if the same content is already stored under another
+// href, and the error that interrupted reading or storing the response
+func (s *Image) storeImageResponse(ctx context.Context, r *imageResponse) (*db.Image, error) {
+	ext := getExtension(r.href)
+	key, hash, err := putContentAddressed(s.store, ImagePrefix, ext, *r.body)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := s.db.CreateImageTransaction(ctx)
+	defer tx.Deferral()
+
+	i, created, err := tx.CreateUnlessSha256Exists(db.NewImage{
+		Key:      key,
+		Category: constants.CATEGORY_UNCLASSIFIED,
+		Href:     r.href,
+		Board:    boardOf(r.href),
+		MD5:      r.md5,
+		Sha256:   hash,
+		RunID:    s.run.id(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		return i, nil
+	}
 
-		data, err := ioutil.ReadAll(response)
-		utils.Check(err)
+	tx.CreateSighting(db.NewSighting{
+		ImageID: i.ID,
+		Href:    r.href,
+		Board:   boardOf(r.href),
+	})
+	fmt.Printf("Image %v already exists by sha256 %v; recorded sighting\n", r.href, hash)
+	s.run.imageSkipped(boardOf(r.href))
+	return nil, nil
+}
 
-		var vRes visionResponse
-		err = json.Unmarshal(data, &vRes)
-		utils.Check(err)
+func (s *Image) getImage(ctx context.Context, img *imageHref, board string) (*imageResponse, error) {
+	href := img.Href
+	cleanedHref := fixMissingHttps(href)
 
-		return vRes.Score, nil
+	if !s.scope.AllowsImage(cleanedHref) {
+		return nil, fmt.Errorf("image %v; %w", href, ErrDisallowed)
 	}
 
-	return do(1)
+	if s.doesImageExist(ctx, cleanedHref) {
+		return nil, fmt.Errorf("image %v; %w", href, ErrAlreadyExists)
+	}
+
+	if img.Md5 != "" {
+		found, err := s.recordSightingByMD5(ctx, img.Md5, href)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			fmt.Printf("Image %v already exists by md5 %v; recorded sighting\n", href, img.Md5)
+			return nil, fmt.Errorf("image %v by md5; %w", href, ErrAlreadyExists)
+		}
+	}
+
+	request := Request{fetcher: s.fetcher, url: cleanedHref, reuseConnection: true, method: "GET", run: s.run, board: board}
+	response, err := request.Do(ctx)
+	observe(ctx, s.downloadLimiter, request.roundTrip, overloaded(err))
+	if err != nil {
+		return nil, err
+	}
+
+	return &imageResponse{href: href, md5: img.Md5, body: &response}, nil
 }
 
-func (s *Image) doesImageExist(href string) bool {
-	tx := s.db.CreateImageTransaction()
+func (s *Image) doesImageExist(ctx context.Context, href string) bool {
+	tx := s.db.CreateImageTransaction(ctx)
 	defer tx.Deferral()
 	return tx.ExistsByHref(href)
 }
 
-func (s *Image) newPath(extension string) (path string) {
-	fileName := createUniqueId()
-	fileName = addExtension(fileName, extension)
-	path = filepath.Join(getProjectPath(), ImageDir, fileName)
-	return
-}
+// recordSightingByMD5 stores a sighting of href for the image with the given md5;
+// returns false if no such image exists yet
+func (s *Image) recordSightingByMD5(ctx context.Context, md5 string, href string) (bool, error) {
+	tx := s.db.CreateImageTransaction(ctx)
+	defer tx.Deferral()
 
-func (s *Image) extractBoard(href string) string {
-	re := regexp.MustCompile(`org/(.+)/`)
-	return re.FindStringSubmatch(href)[1]
+	i, err := tx.FindOneByMD5(md5)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	tx.CreateSighting(db.NewSighting{
+		ImageID: i.ID,
+		Href:    href,
+		Board:   boardOf(href),
+	})
+	return true, nil
 }
@@ -0,0 +1,98 @@
+package scraper
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-find-pepe/pkg/constants"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// PageTypeLimit limits the crawl of one page type; nil fields do not limit
+type PageTypeLimit struct {
+	// pages deeper than MaxDepth are not crawled
+	MaxDepth *int `json:"max_depth"`
+	// at most MaxPages pages are crawled per run; like a BoardQuota, the runs in
+	// progress at the same time share it
+	MaxPages *int `json:"max_pages"`
+}
+
+// ParsePageTypeLimits reads the limits per page type from json; an empty string results in no limits
+func ParsePageTypeLimits(raw string) (map[string]PageTypeLimit, error) {
+	limits := map[string]PageTypeLimit{}
+	if raw == "" {
+		return limits, nil
+	}
+
+	err := json.Unmarshal([]byte(raw), &limits)
+	if err != nil {
+		return nil, err
+	}
+
+	for pageType := range limits {
+		switch pageType {
+		case constants.PAGE_INDEX, constants.PAGE_CATALOG, constants.PAGE_THREAD, constants.PAGE_ARCHIVE, constants.PAGE_OTHER:
+		default:
+			return nil, fmt.Errorf("unknown page type %v", pageType)
+		}
+	}
+
+	return limits, nil
+}
+
+var omittedImagesRegex = regexp.MustCompile(`(\d+) images? omitted`)
+
+// pageTypeOf tags the page at href by its path, e.g. /g/, /g/2, /g/catalog,
+// /g/thread/123 and /g/archive
+func pageTypeOf(href string) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return constants.PAGE_OTHER
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if segments[0] == "" {
+		return constants.PAGE_OTHER
+	}
+
+	if len(segments) == 1 {
+		return constants.PAGE_INDEX
+	}
+
+	switch segments[1] {
+	case "catalog":
+		return constants.PAGE_CATALOG
+	case "thread":
+		return constants.PAGE_THREAD
+	case "archive":
+		return constants.PAGE_ARCHIVE
+	}
+
+	if _, err := strconv.Atoi(segments[1]); err == nil && len(segments) == 2 {
+		return constants.PAGE_INDEX
+	}
+	return constants.PAGE_OTHER
+}
+
+// estimateImages returns the number of images of the thread link is shown in on
+// a board page: the files shown plus the images the summary says are omitted
+func estimateImages(link *goquery.Selection) int {
+	thread := link.Closest("div.thread")
+	if thread.Length() == 0 {
+		return 0
+	}
+
+	images := thread.Find("div.file").Length()
+
+	match := omittedImagesRegex.FindStringSubmatch(thread.Find("span.summary").Text())
+	if match != nil {
+		omitted, _ := strconv.Atoi(match[1])
+		images += omitted
+	}
+
+	return images
+}
@@ -0,0 +1,83 @@
+package scraper
+
+import (
+	"go-find-pepe/pkg/constants"
+	"testing"
+)
+
+func TestPageTypeOf(t *testing.T) {
+	tests := []struct {
+		href string
+		want string
+	}{
+		{"https://boards.4chan.org/g", constants.PAGE_INDEX},
+		{"https://boards.4chan.org/g/2", constants.PAGE_INDEX},
+		{"https://boards.4chan.org/g/catalog", constants.PAGE_CATALOG},
+		{"https://boards.4chan.org/g/thread/76759434", constants.PAGE_THREAD},
+		{"https://boards.4chan.org/g/thread/76759434/the-fglt", constants.PAGE_THREAD},
+		{"https://boards.4chan.org/g/archive", constants.PAGE_ARCHIVE},
+		{"https://boards.4chan.org/", constants.PAGE_OTHER},
+		{"https://boards.4chan.org/g/2/3", constants.PAGE_OTHER},
+		{"https://boards.4chan.org/g/rules", constants.PAGE_OTHER},
+	}
+
+	for _, test := range tests {
+		if got := pageTypeOf(test.href); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.href, got, test.want)
+		}
+	}
+}
+
+func TestParsePageTypeLimits(t *testing.T) {
+	limits, err := ParsePageTypeLimits(`{"thread": {"max_pages": 10}, "archive": {"max_depth": 1}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *limits[constants.PAGE_THREAD].MaxPages != 10 || limits[constants.PAGE_THREAD].MaxDepth != nil {
+		t.Errorf("limit of threads is %+v; want 10 pages", limits[constants.PAGE_THREAD])
+	}
+	if *limits[constants.PAGE_ARCHIVE].MaxDepth != 1 {
+		t.Errorf("limit of archives is %+v; want depth 1", limits[constants.PAGE_ARCHIVE])
+	}
+
+	if limits, err := ParsePageTypeLimits(""); err != nil || len(limits) != 0 {
+		t.Errorf("empty limits are %v, %v; want none", limits, err)
+	}
+
+	for _, raw := range []string{`{"board": {"max_pages": 1}}`, `not json`} {
+		if _, err := ParsePageTypeLimits(raw); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
+
+func TestEstimateImages(t *testing.T) {
+	page := parsePage(t, `<html><body>
+<div class="thread">
+	<div class="file"></div>
+	<span class="summary">12 replies and 5 images omitted.</span>
+	<a id="omitted" href="thread/76759434">Reply</a>
+	<div class="file"></div>
+</div>
+<div class="thread">
+	<div class="file"></div>
+	<a id="single" href="thread/76761088">Reply</a>
+</div>
+<a id="outside" href="catalog">Catalog</a>
+</body></html>`)
+
+	tests := []struct {
+		id   string
+		want int
+	}{
+		{"omitted", 7},
+		{"single", 1},
+		{"outside", 0},
+	}
+
+	for _, test := range tests {
+		if got := estimateImages(page.Find("#" + test.id)); got != test.want {
+			t.Errorf("%v: estimated %v images, want %v", test.id, got, test.want)
+		}
+	}
+}
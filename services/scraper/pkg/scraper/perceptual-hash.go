@@ -0,0 +1,192 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/constants"
+	"go-find-pepe/pkg/db"
+	"go-find-pepe/pkg/phash"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// hashes stored by other replicas are loaded into the near-duplicate index every
+	// hashRefreshInterval, so near-duplicates they downloaded are found too
+	hashRefreshInterval = 30 * time.Second
+	// hashes are loaded again from hashRefreshOverlap before the latest update that
+	// was loaded, as replicas stamp updates by their own clocks
+	hashRefreshOverlap = time.Minute
+)
+
+// loadPerceptualHashes adds every image hashed since the previous load, by any
+// replica, to the near-duplicate index; the first load adds every hashed image
+func (s *Image) loadPerceptualHashes(ctx context.Context) error {
+	tx := s.db.CreateImageTransaction(ctx)
+	defer tx.Deferral()
+
+	since := time.Time{}
+	if !s.hashesLoadedUntil.IsZero() {
+		since = s.hashesLoadedUntil.Add(-hashRefreshOverlap)
+	}
+
+	count := 0
+	err := tx.FindAllWithPerceptualHash(since, func(i *db.Image) {
+		s.hashes.Add(uint64(*i.PHash), i.ID)
+		if i.UpdatedAt.After(s.hashesLoadedUntil) {
+			s.hashesLoadedUntil = i.UpdatedAt
+		}
+		count++
+	})
+	if err != nil {
+		return err
+	}
+
+	if since.IsZero() {
+		fmt.Printf("Loaded %v perceptual hashes\n", count)
+	}
+	return nil
+}
+
+// keepLoadingHashes loads the perceptual hashes stored since the previous load
+// every hashRefreshInterval until ctx is done or the returned func is called
+func (s *Image) keepLoadingHashes(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		ticker := time.NewTicker(hashRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := s.loadPerceptualHashes(ctx)
+				if err != nil && ctx.Err() == nil {
+					fmt.Printf("Failed to load perceptual hashes; %v\n", err)
+				}
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// hashImage stores the perceptual hashes of img; returns false if img could not be read or decoded
+func (s *Image) hashImage(ctx context.Context, img *db.Image) bool {
+	file, err := s.store.Get(img.Key)
+	if err != nil {
+		fmt.Printf("Failed to read %v for perceptual hashing; %v\n", img.ID, err)
+		return false
+	}
+	defer file.Close()
+
+	decoded, err := phash.Decode(file)
+	if err != nil {
+		fmt.Printf("Failed to decode %v for perceptual hashing; %v\n", img.ID, err)
+		return false
+	}
+
+	pHash := int64(phash.PHash(decoded))
+	dHash := int64(phash.DHash(decoded))
+	img.PHash = &pHash
+	img.DHash = &dHash
+
+	tx := s.db.CreateImageTransaction(ctx)
+	defer tx.Deferral()
+	err = tx.UpdateById(img.ID, db.NewImage{PHash: &pHash, DHash: &dHash})
+	if err != nil {
+		fmt.Printf("Failed to store perceptual hashes of %v; %v\n", img.ID, err)
+		return false
+	}
+
+	return true
+}
+
+// reuseNearDuplicateClassification copies the classification of an already classified
+// near-duplicate onto img; returns false if there is none and img must be classified.
+// A near-duplicate is within maxHashDistance by pHash, confirmed by dHash so that
+// images that only share their low frequencies are not taken for each other
+func (s *Image) reuseNearDuplicateClassification(ctx context.Context, img *db.Image) bool {
+	if !s.hashImage(ctx, img) {
+		return false
+	}
+
+	hash := uint64(*img.PHash)
+	defer s.hashes.Add(hash, img.ID)
+
+	matches := s.hashes.Search(hash, s.maxHashDistance)
+	if len(matches) == 0 {
+		return false
+	}
+
+	tx := s.db.CreateImageTransaction(ctx)
+	defer tx.Deferral()
+
+	var closest *db.Image
+	closestDistance := s.maxHashDistance + 1
+	for _, match := range matches {
+		if match.Distance >= closestDistance {
+			continue
+		}
+
+		candidate, err := tx.FindOneByID(match.ID)
+		if err != nil {
+			continue
+		}
+
+		if candidate.Category == constants.CATEGORY_UNCLASSIFIED || candidate.Category == constants.CATEGORY_FAULTY {
+			continue
+		}
+
+		if !s.confirmedByDHash(img, candidate) {
+			continue
+		}
+
+		closest = candidate
+		closestDistance = match.Distance
+	}
+
+	if closest == nil {
+		return false
+	}
+
+	// images classified before the history was kept have no labels to copy
+	labels := ""
+	reused, err := tx.FindLatestClassification(closest.ID)
+	if err == nil {
+		labels = reused.Labels
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		fmt.Printf("Failed to find classification of %v to reuse for %v; %v\n", closest.ID, img.ID, err)
+		return false
+	}
+
+	err = tx.Classify(db.NewClassification{
+		ImageID:  img.ID,
+		Model:    closest.ModelVersion,
+		Score:    closest.Classification,
+		Labels:   labels,
+		Category: closest.Category,
+		Source:   constants.SOURCE_DEDUP,
+	})
+	if err != nil {
+		fmt.Printf("Failed to reuse classification of %v for %v; %v\n", closest.ID, img.ID, err)
+		return false
+	}
+	s.run.imageClassified(img.Board, closest.Category)
+
+	fmt.Printf("Image %v is a near-duplicate of %v at distance %v; category: %v\n", img.ID, closest.ID, closestDistance, closest.Category)
+	return true
+}
+
+// confirmedByDHash returns whether the dHashes of img and candidate are within
+// maxHashDistance; false if either has none
+func (s *Image) confirmedByDHash(img *db.Image, candidate *db.Image) bool {
+	if img.DHash == nil || candidate.DHash == nil {
+		return false
+	}
+	return phash.Distance(uint64(*img.DHash), uint64(*candidate.DHash)) <= s.maxHashDistance
+}
@@ -0,0 +1,35 @@
+package scraper
+
+import (
+	"go-find-pepe/pkg/db"
+	"testing"
+)
+
+func withDHash(hash *int64) *db.Image {
+	return &db.Image{NewImage: db.NewImage{DHash: hash}}
+}
+
+func TestConfirmedByDHash(t *testing.T) {
+	s := &Image{maxHashDistance: 2}
+	hash := func(h int64) *int64 { return &h }
+
+	tests := []struct {
+		name      string
+		img       *int64
+		candidate *int64
+		want      bool
+	}{
+		{"same", hash(0b1011), hash(0b1011), true},
+		{"within distance", hash(0b1011), hash(0b0001), true},
+		{"beyond distance", hash(0b1011), hash(0b0100), false},
+		{"image without dHash", nil, hash(0b1011), false},
+		{"candidate without dHash", hash(0b1011), nil, false},
+	}
+
+	for _, test := range tests {
+		got := s.confirmedByDHash(withDHash(test.img), withDHash(test.candidate))
+		if got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-find-pepe/pkg/db"
+	"go-find-pepe/pkg/limit"
+	"go-find-pepe/pkg/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// leases keeps the leases a worker holds alive until they are released
+type leases struct {
+	m    sync.Mutex
+	ids  map[uint]bool
+	beat func(ctx context.Context, IDs []uint) error
+	stop chan bool
+}
+
+// keepAlive calls beat with the held ids every interval until close is called or
+// ctx is done
+func keepAlive(ctx context.Context, interval time.Duration, beat func(ctx context.Context, IDs []uint) error) *leases {
+	l := &leases{ids: map[uint]bool{}, beat: beat, stop: make(chan bool)}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := l.beat(ctx, l.held())
+				if err != nil {
+					fmt.Printf("Failed to extend leases; %v\n", err)
+				}
+			}
+		}
+	}()
+
+	return l
+}
+
+func (l *leases) add(IDs ...uint) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, ID := range IDs {
+		l.ids[ID] = true
+	}
+}
+
+func (l *leases) release(IDs ...uint) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, ID := range IDs {
+		delete(l.ids, ID)
+	}
+}
+
+func (l *leases) held() []uint {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	IDs := make([]uint, 0, len(l.ids))
+	for ID := range l.ids {
+		IDs = append(IDs, ID)
+	}
+	return IDs
+}
+
+func (l *leases) close() {
+	close(l.stop)
+}
+
+// jobQueue leases one kind of job from the job table on behalf of worker;
+// replicas lease from the same table without doing the same work twice
+type jobQueue struct {
+	kind         string
+	worker       string
+	leaseTimeout time.Duration
+	db           *db.JobDbConnection
+	// returns the boards whose jobs are not leased; may be nil
+	excludedBoards func() []string
+}
+
+func (q *jobQueue) excluded() []string {
+	if q.excludedBoards == nil {
+		return []string{}
+	}
+	return q.excludedBoards()
+}
+
+// enqueue returns the number of jobs that became pending
+func (q *jobQueue) enqueue(ctx context.Context, news []db.NewJob, reopen bool) (int64, error) {
+	for i := range news {
+		news[i].Kind = q.kind
+	}
+
+	tx := q.db.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	return tx.Enqueue(news, reopen)
+}
+
+func (q *jobQueue) lease(ctx context.Context, n int) ([]*db.Job, error) {
+	tx := q.db.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	leased, err := tx.Lease(q.kind, q.worker, n, q.leaseTimeout, q.excluded())
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*db.Job, len(leased))
+	for i := range leased {
+		jobs[i] = &leased[i]
+	}
+	return jobs, nil
+}
+
+func (q *jobQueue) complete(ctx context.Context, job *db.Job) error {
+	tx := q.db.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	return tx.Complete(job.ID, q.worker)
+}
+
+// retry makes job pending again with exponential backoff; fails it once it
+// was attempted MAX_RETRY_ATTEMPT times
+func (q *jobQueue) retry(ctx context.Context, job *db.Job) error {
+	if job.Attempts >= MAX_RETRY_ATTEMPT {
+		fmt.Printf("Failed %v job %v %v times; giving up\n", q.kind, job.Key, job.Attempts)
+		return q.fail(ctx, job)
+	}
+
+	backoff := calculateExponentialBackoffInSec(uint8(job.Attempts))
+	fmt.Printf("Failed %v job %v; retrying after %v\n", q.kind, job.Key, backoff)
+
+	tx := q.db.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	return tx.Retry(job.ID, q.worker, time.Second*time.Duration(backoff))
+}
+
+func (q *jobQueue) fail(ctx context.Context, job *db.Job) error {
+	tx := q.db.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	return tx.Fail(job.ID, q.worker)
+}
+
+func (q *jobQueue) nextDueAt(ctx context.Context) (*time.Time, error) {
+	tx := q.db.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	return tx.NextDueAt(q.kind, q.excluded())
+}
+
+// release makes the jobs this worker still holds pending again; a job is only
+// held after its handler returned if the handler was interrupted
+func (q *jobQueue) release(ctx context.Context) {
+	tx := q.db.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	count, err := tx.Release(q.kind, q.worker)
+	if err != nil {
+		fmt.Printf("Failed to release interrupted %v jobs; %v\n", q.kind, err)
+		return
+	}
+	if count > 0 {
+		fmt.Printf("Released %v interrupted %v jobs\n", count, q.kind)
+	}
+}
+
+func (q *jobQueue) heartbeat(ctx context.Context, IDs []uint) error {
+	tx := q.db.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	return tx.Heartbeat(IDs, q.worker, q.leaseTimeout)
+}
+
+// drain leases batches of at most batchSize jobs and hands them to handle, as many
+// at a time as limiter allows, until upstream is closed and no job is left that
+// is pending or leased by any worker. A partial batch waits batchWait for more
+// jobs while upstream is open. Jobs of excluded boards are left pending. handle is
+// given work and must complete, retry or fail every job, unless work is done. Once
+// ctx is done no more jobs are leased, and drain returns when the handled batches
+// returned; jobs that were interrupted by work are made pending again
+func (q *jobQueue) drain(ctx context.Context, work context.Context, upstream <-chan bool, limiter limit.Limiter, batchSize int, batchWait time.Duration, handle func(ctx context.Context, jobs []*db.Job)) {
+	wg := &sync.WaitGroup{}
+	wgU := WaitGroupHelper{WaitGroup: wg}
+
+	held := keepAlive(work, q.leaseTimeout/3, q.heartbeat)
+	defer held.close()
+	defer q.release(context.WithoutCancel(work))
+
+	var inFlight int64
+	// signals that a batch was handled and may have enqueued jobs
+	handled := make(chan bool, 1)
+
+	for {
+		upstreamDone := isClosed(upstream)
+
+		if ctx.Err() != nil || limiter.Add(ctx) != nil {
+			wg.Wait()
+			return
+		}
+
+		jobs, err := q.lease(ctx, batchSize)
+		if err == nil && len(jobs) > 0 && len(jobs) < batchSize && !upstreamDone && batchWait > 0 && sleep(ctx, batchWait) == nil {
+			var more []*db.Job
+			more, err = q.lease(ctx, batchSize-len(jobs))
+			jobs = append(jobs, more...)
+		}
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Failed to lease %v jobs; %v\n", q.kind, err)
+		}
+
+		if len(jobs) > 0 {
+			IDs := make([]uint, len(jobs))
+			for i, job := range jobs {
+				IDs[i] = job.ID
+			}
+			held.add(IDs...)
+
+			atomic.AddInt64(&inFlight, 1)
+			wgU.Wrapper(func() {
+				defer func() {
+					held.release(IDs...)
+					atomic.AddInt64(&inFlight, -1)
+					limiter.Done()
+					select {
+					case handled <- true:
+					default:
+					}
+				}()
+
+				handle(work, jobs)
+			})
+			continue
+		}
+		limiter.Done()
+
+		nextAt, err := q.nextDueAt(ctx)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Failed to find the next due %v job; %v\n", q.kind, err)
+		}
+		if err == nil && upstreamDone && nextAt == nil && atomic.LoadInt64(&inFlight) == 0 {
+			wg.Wait()
+			return
+		}
+
+		wait := LeasePollInterval
+		if nextAt != nil && time.Until(*nextAt) < wait {
+			wait = time.Until(*nextAt)
+		}
+
+		var upstreamClosed <-chan bool
+		if !upstreamDone {
+			upstreamClosed = upstream
+		}
+
+		select {
+		case <-handled:
+		case <-upstreamClosed:
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// encodePayload json encodes the arguments of a job
+func encodePayload(v any) string {
+	payload, err := json.Marshal(v)
+	utils.Check(err)
+	return string(payload)
+}
+
+func decodePayload(job *db.Job, v any) error {
+	return json.Unmarshal([]byte(job.Payload), v)
+}
+
+// sleep waits for d; returns the error of ctx if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isClosed returns whether c is closed without blocking; only closing is ever
+// signalled on c
+func isClosed(c <-chan bool) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
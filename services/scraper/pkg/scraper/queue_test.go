@@ -0,0 +1,105 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"go-find-pepe/pkg/db"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	m := sync.Mutex{}
+	beats := [][]uint{}
+	held := keepAlive(context.Background(), time.Millisecond, func(ctx context.Context, IDs []uint) error {
+		sort.Slice(IDs, func(i, j int) bool { return IDs[i] < IDs[j] })
+		m.Lock()
+		defer m.Unlock()
+		beats = append(beats, IDs)
+		return nil
+	})
+
+	held.add(1, 2, 3)
+	held.release(2)
+	time.Sleep(20 * time.Millisecond)
+	held.close()
+	// a beat may still be in flight while closing
+	time.Sleep(5 * time.Millisecond)
+
+	m.Lock()
+	count := len(beats)
+	last := beats[len(beats)-1]
+	m.Unlock()
+
+	if len(last) != 2 || last[0] != 1 || last[1] != 3 {
+		t.Errorf("extended leases %v; want 1 and 3", last)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	m.Lock()
+	defer m.Unlock()
+	if len(beats) != count {
+		t.Errorf("extended leases %v more times after close", len(beats)-count)
+	}
+}
+
+func TestKeepAliveStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	beats := make(chan bool, 100)
+	held := keepAlive(ctx, time.Millisecond, func(ctx context.Context, IDs []uint) error {
+		beats <- true
+		return nil
+	})
+	defer held.close()
+
+	<-beats
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	for len(beats) > 0 {
+		<-beats
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if len(beats) != 0 {
+		t.Errorf("extended leases %v times after ctx was done", len(beats))
+	}
+}
+
+func TestSleep(t *testing.T) {
+	if err := sleep(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("sleep returned %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := sleep(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("sleep returned %v; want %v", err, context.Canceled)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("sleep waited once ctx was done")
+	}
+}
+
+func TestIsClosed(t *testing.T) {
+	c := make(chan bool)
+	if isClosed(c) {
+		t.Error("open channel is closed")
+	}
+	close(c)
+	if !isClosed(c) {
+		t.Error("closed channel is open")
+	}
+}
+
+func TestPayload(t *testing.T) {
+	href := imageHref{Href: "https://i.4cdn.org/g/1605032734427.png", Md5: "Y9mUa1FyaA0cZHl9FTvPCA=="}
+
+	var payload imageHref
+	decodePayload(&db.Job{NewJob: db.NewJob{Payload: encodePayload(&href)}}, &payload)
+	if payload != href {
+		t.Errorf("decoded %+v; want %+v", payload, href)
+	}
+}
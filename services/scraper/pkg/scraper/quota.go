@@ -0,0 +1,308 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-find-pepe/pkg/constants"
+	"go-find-pepe/pkg/db"
+	"sync"
+	"time"
+)
+
+// AnyBoard is the key of the quota of boards without a quota of their own
+const AnyBoard = "*"
+
+// a run shares its usage of the quotas with the other runs in progress every
+// usageSyncInterval; a run that did not share for usageStaleAfter is taken to have crashed
+const (
+	usageSyncInterval = 2 * time.Second
+	usageStaleAfter   = time.Minute
+)
+
+// BoardQuota limits what a run does on one board; nil fields do not limit. The
+// runs in progress at the same time, e.g. the replicas of a deployment, share a
+// quota. Work in flight when a quota is exhausted is finished, and the usage of
+// other runs is known up to usageSyncInterval late, so a quota may be exceeded by
+// up to the concurrency limit
+type BoardQuota struct {
+	// at most MaxThreads thread pages are crawled, or threads walked through the api
+	MaxThreads *int64 `json:"max_threads"`
+	// at most MaxImages images are downloaded
+	MaxImages *int64 `json:"max_images"`
+	// at most MaxBytes bytes are transferred
+	MaxBytes *int64 `json:"max_bytes"`
+	// the board is not worked on MaxWallTimeMs after the run started
+	MaxWallTimeMs *int64 `json:"max_wall_time_ms"`
+}
+
+// ParseBoardQuotas reads the quota per board from json; the quota of AnyBoard applies
+// to every field a board does not limit itself. An empty string results in no quotas
+func ParseBoardQuotas(raw string) (map[string]BoardQuota, error) {
+	limits := map[string]BoardQuota{}
+	if raw == "" {
+		return limits, nil
+	}
+
+	err := json.Unmarshal([]byte(raw), &limits)
+	if err != nil {
+		return nil, err
+	}
+
+	for board, limit := range limits {
+		for _, v := range []*int64{limit.MaxThreads, limit.MaxImages, limit.MaxBytes, limit.MaxWallTimeMs} {
+			if v != nil && *v < 0 {
+				return nil, fmt.Errorf("quota of board %v must not be negative; got %v", board, *v)
+			}
+		}
+	}
+
+	return limits, nil
+}
+
+// usageKey identifies a counter of a board
+type usageKey struct {
+	counter string
+	key     string
+}
+
+// quotas tells which boards and page types exhausted their quota during run,
+// counting what the other runs in progress used as well
+type quotas struct {
+	limits         map[string]BoardQuota
+	pageTypeLimits map[string]PageTypeLimit
+	run            *run
+	// shares the usage between runs; nil shares nothing
+	usages *db.UsageDbConnection
+	m      sync.Mutex
+	// boards of which the exhaustion was reported
+	reported map[string]bool
+	// usage of run that was shared
+	shared map[usageKey]int64
+	// usage of the other runs in progress as of the last sync
+	others map[usageKey]int64
+}
+
+func newQuotas(limits map[string]BoardQuota, pageTypeLimits map[string]PageTypeLimit, r *run) *quotas {
+	return &quotas{
+		limits:         limits,
+		pageTypeLimits: pageTypeLimits,
+		run:            r,
+		reported:       map[string]bool{},
+		shared:         map[usageKey]int64{},
+		others:         map[usageKey]int64{},
+	}
+}
+
+// limitOf returns the quota of board, completed by the quota of AnyBoard
+func (q *quotas) limitOf(board string) BoardQuota {
+	limit := q.limits[board]
+	fallback := q.limits[AnyBoard]
+
+	if limit.MaxThreads == nil {
+		limit.MaxThreads = fallback.MaxThreads
+	}
+	if limit.MaxImages == nil {
+		limit.MaxImages = fallback.MaxImages
+	}
+	if limit.MaxBytes == nil {
+		limit.MaxBytes = fallback.MaxBytes
+	}
+	if limit.MaxWallTimeMs == nil {
+		limit.MaxWallTimeMs = fallback.MaxWallTimeMs
+	}
+	return limit
+}
+
+// exhausted returns whether the run may no longer work on board
+func (q *quotas) exhausted(board string) bool {
+	if len(q.limits) == 0 {
+		return false
+	}
+
+	limit := q.limitOf(board)
+	c := q.run.peek(board)
+	if c == nil {
+		c = newCounters()
+	}
+
+	reason := ""
+	switch {
+	case limit.MaxThreads != nil && q.used(constants.USAGE_THREADS, board, c.threads.Load()) >= *limit.MaxThreads:
+		reason = fmt.Sprintf("%v threads", *limit.MaxThreads)
+	case limit.MaxImages != nil && q.used(constants.USAGE_IMAGES, board, c.downloaded.Load()) >= *limit.MaxImages:
+		reason = fmt.Sprintf("%v images", *limit.MaxImages)
+	case limit.MaxBytes != nil && q.used(constants.USAGE_BYTES, board, c.bytesTransferred.Load()) >= *limit.MaxBytes:
+		reason = fmt.Sprintf("%v bytes", *limit.MaxBytes)
+	case limit.MaxWallTimeMs != nil && time.Since(q.run.started) >= time.Duration(*limit.MaxWallTimeMs)*time.Millisecond:
+		reason = fmt.Sprintf("%vms wall time", *limit.MaxWallTimeMs)
+	default:
+		return false
+	}
+
+	q.m.Lock()
+	defer q.m.Unlock()
+	if !q.reported[board] {
+		q.reported[board] = true
+		fmt.Printf("Board %v exhausted its quota of %v; stopping work on it\n", board, reason)
+	}
+	return true
+}
+
+// used returns own plus what the other runs in progress used of counter of board
+func (q *quotas) used(counter string, board string, own int64) int64 {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	return own + q.others[usageKey{counter: counter, key: board}]
+}
+
+// exhaustedBoards returns the boards with a quota of their own, or that any run in
+// progress worked on, that exhausted their quota
+func (q *quotas) exhaustedBoards() []string {
+	if len(q.limits) == 0 {
+		return []string{}
+	}
+
+	boards := map[string]bool{}
+	for _, board := range q.run.boardNames() {
+		boards[board] = true
+	}
+	for board := range q.limits {
+		if board != AnyBoard {
+			boards[board] = true
+		}
+	}
+	q.m.Lock()
+	for key := range q.others {
+		if key.counter != constants.USAGE_PAGES {
+			boards[key.key] = true
+		}
+	}
+	q.m.Unlock()
+
+	exhausted := []string{}
+	for board := range boards {
+		if q.exhausted(board) {
+			exhausted = append(exhausted, board)
+		}
+	}
+	return exhausted
+}
+
+// exhaustedPageTypes returns the page types of which MaxPages pages were leased
+func (q *quotas) exhaustedPageTypes() []string {
+	exhausted := []string{}
+	for pageType, limit := range q.pageTypeLimits {
+		if limit.MaxPages != nil && q.used(constants.USAGE_PAGES, pageType, q.run.leasedPages(pageType)) >= int64(*limit.MaxPages) {
+			exhausted = append(exhausted, pageType)
+		}
+	}
+	return exhausted
+}
+
+// limitsPages returns whether any page type is limited to MaxPages
+func (q *quotas) limitsPages() bool {
+	for _, limit := range q.pageTypeLimits {
+		if limit.MaxPages != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// own returns what run used of the quotas
+func (q *quotas) own() map[usageKey]int64 {
+	own := map[usageKey]int64{}
+	for pageType := range q.pageTypeLimits {
+		own[usageKey{counter: constants.USAGE_PAGES, key: pageType}] = q.run.leasedPages(pageType)
+	}
+	for _, board := range q.run.boardNames() {
+		c := q.run.board(board)
+		own[usageKey{counter: constants.USAGE_THREADS, key: board}] = c.threads.Load()
+		own[usageKey{counter: constants.USAGE_IMAGES, key: board}] = c.downloaded.Load()
+		own[usageKey{counter: constants.USAGE_BYTES, key: board}] = c.bytesTransferred.Load()
+	}
+	return own
+}
+
+// unshared returns what run used since its usage was last shared
+func (q *quotas) unshared(own map[usageKey]int64) []db.RunUsage {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	added := []db.RunUsage{}
+	for key, value := range own {
+		if delta := value - q.shared[key]; delta != 0 {
+			added = append(added, db.RunUsage{Counter: key.counter, Key: key.key, Value: delta})
+		}
+	}
+	return added
+}
+
+// synced records that own was shared, and what the other runs in progress used
+func (q *quotas) synced(own map[usageKey]int64, others []db.RunUsage) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	q.shared = own
+	q.others = map[usageKey]int64{}
+	for _, usage := range others {
+		q.others[usageKey{counter: usage.Counter, key: usage.Key}] = usage.Value
+	}
+}
+
+// sync shares what run used since the last sync, and reads what the other runs in
+// progress used
+func (q *quotas) sync(ctx context.Context) error {
+	ID := q.run.id()
+	if q.usages == nil || ID == nil {
+		return nil
+	}
+
+	own := q.own()
+
+	tx := q.usages.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	err := tx.Add(*ID, q.unshared(own))
+	if err != nil {
+		return err
+	}
+
+	others, err := tx.FindOfOtherRuns(*ID, time.Now().Add(-usageStaleAfter))
+	if err != nil {
+		return err
+	}
+
+	q.synced(own, others)
+	return nil
+}
+
+// keepSyncing syncs every usageSyncInterval until ctx is done or the returned
+// func is called; nothing is synced without quotas
+func (q *quotas) keepSyncing(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	if len(q.limits) == 0 && !q.limitsPages() {
+		return cancel
+	}
+
+	go func() {
+		ticker := time.NewTicker(usageSyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := q.sync(ctx)
+				if err != nil && ctx.Err() == nil {
+					fmt.Printf("Failed to share the usage of the quotas; %v\n", err)
+				}
+			}
+		}
+	}()
+
+	return cancel
+}
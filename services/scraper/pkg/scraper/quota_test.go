@@ -0,0 +1,183 @@
+package scraper
+
+import (
+	"go-find-pepe/pkg/constants"
+	"go-find-pepe/pkg/db"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func quota(threads, images, bytes, wallTimeMs *int64) BoardQuota {
+	return BoardQuota{MaxThreads: threads, MaxImages: images, MaxBytes: bytes, MaxWallTimeMs: wallTimeMs}
+}
+
+func of(v int64) *int64 {
+	return &v
+}
+
+func TestParseBoardQuotas(t *testing.T) {
+	limits, err := ParseBoardQuotas(`{"g": {"max_images": 10}, "*": {"max_threads": 5, "max_images": 100}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := newQuotas(limits, nil, newRun())
+	g := q.limitOf("g")
+	if *g.MaxImages != 10 || *g.MaxThreads != 5 || g.MaxBytes != nil {
+		t.Errorf("quota of g is %+v; want 10 images and 5 threads", g)
+	}
+	v := q.limitOf("v")
+	if *v.MaxImages != 100 || *v.MaxThreads != 5 {
+		t.Errorf("quota of v is %+v; want the quota of %v", v, AnyBoard)
+	}
+
+	for _, raw := range []string{`{"g": {"max_images": -1}}`, `not json`} {
+		if _, err := ParseBoardQuotas(raw); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
+
+func TestQuotaCutOff(t *testing.T) {
+	tests := []struct {
+		name  string
+		quota BoardQuota
+		// counts the run on board g
+		count func(r *run)
+		// what the other runs in progress used
+		others []db.RunUsage
+		want   bool
+	}{
+		{"nothing done", quota(of(1), of(1), of(1), nil), func(r *run) {}, nil, false},
+		{"below max threads", quota(of(2), nil, nil, nil), func(r *run) { r.threadStarted("g") }, nil, false},
+		{"at max threads", quota(of(2), nil, nil, nil), func(r *run) { r.threadStarted("g"); r.threadStarted("g") }, nil, true},
+		{"at max images", quota(nil, of(1), nil, nil), func(r *run) { r.imageDownloaded("g") }, nil, true},
+		{"other board", quota(nil, of(1), nil, nil), func(r *run) { r.imageDownloaded("v") }, nil, false},
+		{"zero quota", quota(nil, nil, of(0), nil), func(r *run) {}, nil, true},
+		{"wall time", quota(nil, nil, nil, of(0)), func(r *run) {}, nil, true},
+		{
+			"shared with other runs",
+			quota(of(2), nil, nil, nil),
+			func(r *run) { r.threadStarted("g") },
+			[]db.RunUsage{{Counter: constants.USAGE_THREADS, Key: "g", Value: 1}},
+			true,
+		},
+		{
+			"other runs on other boards",
+			quota(of(2), nil, nil, nil),
+			func(r *run) { r.threadStarted("g") },
+			[]db.RunUsage{{Counter: constants.USAGE_THREADS, Key: "v", Value: 5}},
+			false,
+		},
+		{
+			"other runs below max bytes",
+			quota(nil, nil, of(100), nil),
+			func(r *run) {},
+			[]db.RunUsage{{Counter: constants.USAGE_BYTES, Key: "g", Value: 99}},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		r := newRun()
+		test.count(r)
+		q := newQuotas(map[string]BoardQuota{"g": test.quota}, nil, r)
+		q.synced(map[usageKey]int64{}, test.others)
+
+		if got := q.exhausted("g"); got != test.want {
+			t.Errorf("%v: exhausted is %v; want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNoQuotas(t *testing.T) {
+	r := newRun()
+	r.threadStarted("g")
+	q := newQuotas(nil, nil, r)
+
+	if q.exhausted("g") || len(q.exhaustedBoards()) != 0 {
+		t.Error("a board without a quota was exhausted")
+	}
+}
+
+func TestWallTimeStartsAtBegin(t *testing.T) {
+	r := newRun()
+	// the scraper took an hour to set up
+	r.started = time.Now().Add(-time.Hour)
+	q := newQuotas(map[string]BoardQuota{"g": quota(nil, nil, nil, of(time.Minute.Milliseconds()))}, nil, r)
+
+	if !q.exhausted("g") {
+		t.Error("wall time is not exhausted an hour after the run was created")
+	}
+
+	r.begin()
+	if q.exhausted("g") {
+		t.Error("wall time is exhausted right after the run began")
+	}
+}
+
+func TestExhaustedBoards(t *testing.T) {
+	r := newRun()
+	r.imageDownloaded("g")
+	r.imageDownloaded("v")
+	q := newQuotas(map[string]BoardQuota{"*": quota(nil, of(1), nil, nil), "pol": quota(nil, nil, nil, of(time.Hour.Milliseconds()))}, nil, r)
+	// only other runs worked on b
+	q.synced(map[usageKey]int64{}, []db.RunUsage{{Counter: constants.USAGE_IMAGES, Key: "b", Value: 1}})
+
+	exhausted := q.exhaustedBoards()
+	sort.Strings(exhausted)
+	if strings.Join(exhausted, ",") != "b,g,v" {
+		t.Errorf("exhausted boards are %v; want b, g and v", exhausted)
+	}
+}
+
+func TestQuotasShareOnlyNewUsage(t *testing.T) {
+	r := newRun()
+	r.threadStarted("g")
+	r.imageDownloaded("g")
+	q := newQuotas(map[string]BoardQuota{"g": quota(of(10), nil, nil, nil)}, nil, r)
+
+	own := q.own()
+	added := q.unshared(own)
+	if len(added) != 2 {
+		t.Fatalf("shares %+v; want a thread and an image", added)
+	}
+	q.synced(own, nil)
+
+	if added := q.unshared(q.own()); len(added) != 0 {
+		t.Errorf("shares %+v again", added)
+	}
+
+	r.threadStarted("g")
+	r.threadStarted("g")
+	added = q.unshared(q.own())
+	if len(added) != 1 || added[0] != (db.RunUsage{Counter: constants.USAGE_THREADS, Key: "g", Value: 2}) {
+		t.Errorf("shares %+v; want the 2 new threads", added)
+	}
+}
+
+func TestExhaustedPageTypes(t *testing.T) {
+	maxPages := 2
+	r := newRun()
+	q := newQuotas(nil, map[string]PageTypeLimit{constants.PAGE_THREAD: {MaxPages: &maxPages}, constants.PAGE_INDEX: {}}, r)
+
+	r.pageLeased(constants.PAGE_THREAD)
+	r.pageLeased(constants.PAGE_INDEX)
+	r.pageLeased(constants.PAGE_INDEX)
+	r.pageLeased(constants.PAGE_INDEX)
+	if exhausted := q.exhaustedPageTypes(); len(exhausted) != 0 {
+		t.Errorf("exhausted page types are %v below the max", exhausted)
+	}
+
+	// a page leased by another run in progress counts as well
+	q.synced(map[usageKey]int64{}, []db.RunUsage{{Counter: constants.USAGE_PAGES, Key: constants.PAGE_THREAD, Value: 1}})
+	if exhausted := q.exhaustedPageTypes(); len(exhausted) != 1 || exhausted[0] != constants.PAGE_THREAD {
+		t.Errorf("exhausted page types are %v; want %v", exhausted, constants.PAGE_THREAD)
+	}
+
+	if boards := q.exhaustedBoards(); len(boards) != 0 {
+		t.Errorf("page types were taken for boards %v", boards)
+	}
+}
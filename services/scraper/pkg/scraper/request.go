@@ -2,20 +2,22 @@ package scraper
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"go-find-pepe/pkg/utils"
 	"io"
 	"math"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"time"
 )
 
+// getHostname returns the host of rawurl; empty if rawurl cannot be parsed
 func getHostname(rawurl string) string {
 	parsed, err := url.Parse(rawurl)
-	utils.Check(err)
+	if err != nil {
+		return ""
+	}
 	return parsed.Hostname()
 }
 
@@ -32,113 +34,92 @@ func fixMissingHttps(url string) string {
 }
 
 type Request struct {
+	fetcher         *Fetcher
 	url             string
 	reuseConnection bool
 	method          string
-	body            io.Reader
-	contentType     *string
+	// sent in full on every attempt
+	body        []byte
+	contentType *string
+	// counts retries and transferred bytes of board; may be nil
+	run   *run
+	board string
+	// url the response was served from after redirects; set by Do
+	servedFrom string
+	// round trip of the last attempt, without waiting for the rate of the host or
+	// between retries; set by Do
+	roundTrip time.Duration
 }
 
-func (r *Request) Do(nAttempt uint8) (reader io.ReadCloser, statusCode int, success bool) {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Printf("An error has occurred while trying to retrieve href: %v %v\n", r.method, r.url)
-			panic(err)
-		}
-	}()
-
-	if nAttempt >= MAX_RETRY_ATTEMPT {
-		panic(fmt.Errorf("failed to %v %v after MAX_ATTEMPT=%v", r.method, r.url, MAX_RETRY_ATTEMPT))
-	}
-
-	retry := func() (response io.ReadCloser, statusCode int, success bool) {
-		backoff := calculateExponentialBackoffInSec(nAttempt)
-		fmt.Printf("Retrying %v %v after %v\n", r.method, r.url, backoff)
-		time.Sleep(time.Second * time.Duration(backoff))
-		return r.Do(nAttempt + 1)
-	}
-
+// Do sends the request, retrying by the retry policy of its host, and returns the
+// body of a 200 response. Other responses result in an HTTPStatusError; the request
+// and backoff waits are given up once ctx is done, which results in the error of ctx
+func (r *Request) Do(ctx context.Context) (io.ReadCloser, error) {
 	fmt.Printf("Fetching %v %v\n", r.method, r.url)
 
-	client := &http.Client{}
-	req, _ := http.NewRequest(r.method, r.url, r.body)
-
-	req.Header.Add("User-Agent", "PostmanRuntime/7.29.3")
-	req.Header.Add("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
-	req.Header.Add("Accept-Language", "en-US,en;q=0.5")
-	if r.contentType != nil {
-		req.Header.Set("Content-Type", *r.contentType)
-	}
-
-	if r.reuseConnection {
-		req.Header.Add("Connection", "keep-alive")
-	} else {
-		req.Close = true
-	}
-
-	response, err := client.Do(req)
+	policy := r.fetcher.retryPolicy(getHostname(r.url))
+	response, err := policy.Do(ctx, r.send, func(attempt int, wait time.Duration, reason string) {
+		fmt.Printf("Retrying %v %v after %v; attempt %v failed with %v\n", r.method, r.url, wait, attempt, reason)
+		r.run.requestRetried(r.board)
+	})
 
-	success = false
 	if err != nil {
-		msg := err.Error()
-
-		if stringShouldContainOneFilter(msg, []string{"timeout", "connection reset"}) {
-			fmt.Printf("Failed to %v %v; timeout\n", r.method, r.url)
-			return retry()
-		}
-
-		if stringShouldContainOneFilter(msg, []string{"connection refused"}) {
-			fmt.Printf("Failed to %v %v; connection refused\n", r.method, r.url)
-			return retry()
-		}
-
-		if stringShouldContainOneFilter(msg, []string{"EOF"}) {
-			fmt.Printf("Failed to %v %v; EOF\n", r.method, r.url)
-			return retry()
+		if ctx.Err() != nil {
+			fmt.Printf("Gave up %v %v; %v\n", r.method, r.url, ctx.Err())
+			return nil, ctx.Err()
 		}
 
-		fmt.Printf("Failed to %v %v; unknown error %v\n", r.method, r.url, msg)
-		return
+		fmt.Printf("Failed to %v %v; %v\n", r.method, r.url, err)
+		return nil, fmt.Errorf("failed to %v %v; %w", r.method, r.url, err)
 	}
 
-	statusCode = response.StatusCode
-	reader = response.Body
+	r.servedFrom = response.Request.URL.String()
 
-	if response.StatusCode == 503 {
-		fmt.Printf("Failed to %v %v; 503 response\n", r.method, r.url)
-		return retry()
-	}
-
-	if response.StatusCode == 404 {
-		fmt.Printf("Failed to %v %v; 404 response\n", r.method, r.url)
-		return
-	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		fmt.Printf("Failed to %v %v; %v response\n", r.method, r.url, response.StatusCode)
 
-	if response.StatusCode != 200 {
-		path := filepath.Join(getProjectPath(), ErrorDirectory, fmt.Sprintf("%v/%v%v%v", response.StatusCode, r.url, time.Now().UTC(), ".html"))
-		writeFile(path, reader)
-		return
+		if response.StatusCode != http.StatusNotFound {
+			path := filepath.Join(getProjectPath(), ErrorDirectory, fmt.Sprintf("%v/%v%v%v", response.StatusCode, r.url, time.Now().UTC(), ".html"))
+			err = writeFile(path, response.Body)
+			if err != nil {
+				fmt.Printf("Failed to write response of %v %v; %v\n", r.method, r.url, err)
+			}
+		}
+		return nil, &HTTPStatusError{Code: response.StatusCode, Url: r.url}
 	}
 
 	fmt.Printf("Successfully fetched %v %v \n", r.method, r.url)
-	success = true
-	return
+	return response.Body, nil
 }
 
-func createSingleFileMultiPart(key string, fileName string, file io.ReadCloser) (*bytes.Buffer, *multipart.Writer) {
-	var b bytes.Buffer
-	writer := multipart.NewWriter(&b)
+// send makes one attempt with a new request, so the body is sent again in full
+func (r *Request) send(ctx context.Context) (*http.Response, error) {
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
 
-	part, err := writer.CreateFormFile(key, fileName)
-	utils.Check(err)
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, body)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = io.Copy(part, file)
-	utils.Check(err)
+	req.Header.Add("User-Agent", "PostmanRuntime/7.29.3")
+	req.Header.Add("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
+	req.Header.Add("Accept-Language", "en-US,en;q=0.5")
+	if r.contentType != nil {
+		req.Header.Set("Content-Type", *r.contentType)
+	}
 
-	err = writer.Close()
-	utils.Check(err)
+	// pooled connections are kept alive unless the request asks otherwise
+	req.Close = !r.reuseConnection
 
-	return &b, writer
+	response, roundTrip, err := r.fetcher.Do(req, func(body io.ReadCloser) io.ReadCloser {
+		return r.run.countBytes(r.board, body)
+	})
+	r.roundTrip = roundTrip
+	return response, err
 }
 
 func calculateExponentialBackoffInSec(a uint8) float64 {
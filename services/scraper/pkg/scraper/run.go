@@ -0,0 +1,316 @@
+package scraper
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-find-pepe/pkg/constants"
+	"go-find-pepe/pkg/db"
+	"go-find-pepe/pkg/utils"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counters count what a run did, in total or on one board
+type counters struct {
+	threads          atomic.Int64
+	pagesFetched     atomic.Int64
+	notFound         atomic.Int64
+	imagesDiscovered atomic.Int64
+	skippedExisting  atomic.Int64
+	downloaded       atomic.Int64
+	faulty           atomic.Int64
+	bytesTransferred atomic.Int64
+	retries          atomic.Int64
+	m                sync.Mutex
+	classified       map[string]int64
+}
+
+func newCounters() *counters {
+	return &counters{classified: map[string]int64{}}
+}
+
+func (c *counters) classifiedCopy() map[string]int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	classified := make(map[string]int64, len(c.classified))
+	for category, count := range c.classified {
+		classified[category] = count
+	}
+	return classified
+}
+
+func (c *counters) board() db.BoardCounters {
+	return db.BoardCounters{
+		Threads:          c.threads.Load(),
+		PagesFetched:     c.pagesFetched.Load(),
+		NotFound:         c.notFound.Load(),
+		ImagesDiscovered: c.imagesDiscovered.Load(),
+		SkippedExisting:  c.skippedExisting.Load(),
+		Downloaded:       c.downloaded.Load(),
+		Classified:       c.classifiedCopy(),
+		Faulty:           c.faulty.Load(),
+		BytesTransferred: c.bytesTransferred.Load(),
+		Retries:          c.retries.Load(),
+	}
+}
+
+// run counts what the current scraper execution does, in total and per board;
+// every method is safe to call on a nil run
+type run struct {
+	ID      uint
+	total   *counters
+	m       sync.Mutex
+	boards  map[string]*counters
+	started time.Time
+	// pages leased per page type
+	leased map[string]int64
+}
+
+func newRun() *run {
+	return &run{total: newCounters(), boards: map[string]*counters{}, leased: map[string]int64{}, started: time.Now()}
+}
+
+// begin starts the clock of the run, so the time spent setting up the scraper does
+// not count towards the wall time of the run; returns when the run started
+func (r *run) begin() time.Time {
+	r.started = time.Now()
+	return r.started
+}
+
+func (r *run) id() *uint {
+	if r == nil || r.ID == 0 {
+		return nil
+	}
+	return &r.ID
+}
+
+// count applies f to the total counters and to those of board
+func (r *run) count(board string, f func(c *counters)) {
+	if r == nil {
+		return
+	}
+
+	f(r.total)
+	f(r.board(board))
+}
+
+func (r *run) board(board string) *counters {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	c, ok := r.boards[board]
+	if !ok {
+		c = newCounters()
+		r.boards[board] = c
+	}
+	return c
+}
+
+// peek returns the counters of board without adding board to the run; nil if the
+// run did nothing on board
+func (r *run) peek(board string) *counters {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.boards[board]
+}
+
+// boardNames returns the boards the run did anything on
+func (r *run) boardNames() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	boards := make([]string, 0, len(r.boards))
+	for board := range r.boards {
+		boards = append(boards, board)
+	}
+	return boards
+}
+
+func (r *run) threadStarted(board string) {
+	r.count(board, func(c *counters) { c.threads.Add(1) })
+}
+
+func (r *run) pageLeased(pageType string) {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.leased[pageType]++
+}
+
+// leasedPages returns the number of pages of pageType the run leased
+func (r *run) leasedPages(pageType string) int64 {
+	if r == nil {
+		return 0
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.leased[pageType]
+}
+
+func (r *run) pageFetched(board string) {
+	r.count(board, func(c *counters) { c.pagesFetched.Add(1) })
+}
+
+func (r *run) pageNotFound(board string) {
+	r.count(board, func(c *counters) { c.notFound.Add(1) })
+}
+
+func (r *run) imagesFound(board string, n int) {
+	r.count(board, func(c *counters) { c.imagesDiscovered.Add(int64(n)) })
+}
+
+func (r *run) imageSkipped(board string) {
+	r.count(board, func(c *counters) { c.skippedExisting.Add(1) })
+}
+
+func (r *run) imageDownloaded(board string) {
+	r.count(board, func(c *counters) { c.downloaded.Add(1) })
+}
+
+// imageClassified counts an image classified as category; faulty images are only
+// counted as faulty
+func (r *run) imageClassified(board string, category string) {
+	if category == constants.CATEGORY_FAULTY {
+		r.imageFaulty(board)
+		return
+	}
+
+	r.count(board, func(c *counters) {
+		c.m.Lock()
+		defer c.m.Unlock()
+		c.classified[category]++
+	})
+}
+
+func (r *run) imageFaulty(board string) {
+	r.count(board, func(c *counters) { c.faulty.Add(1) })
+}
+
+func (r *run) requestRetried(board string) {
+	r.count(board, func(c *counters) { c.retries.Add(1) })
+}
+
+// countBytes counts the bytes read from body as transferred for board
+func (r *run) countBytes(board string, body io.ReadCloser) io.ReadCloser {
+	if r == nil {
+		return body
+	}
+	return &countingReadCloser{ReadCloser: body, total: r.total, board: r.board(board)}
+}
+
+func (r *run) counters() db.RunCounters {
+	total := r.total.board()
+
+	classified, err := json.Marshal(total.Classified)
+	utils.Check(err)
+
+	boards := map[string]db.BoardCounters{}
+	for _, board := range r.boardNames() {
+		boards[board] = r.board(board).board()
+	}
+
+	boardsJson, err := json.Marshal(boards)
+	utils.Check(err)
+
+	return db.RunCounters{
+		Threads:          total.Threads,
+		PagesFetched:     total.PagesFetched,
+		NotFound:         total.NotFound,
+		ImagesDiscovered: total.ImagesDiscovered,
+		SkippedExisting:  total.SkippedExisting,
+		Downloaded:       total.Downloaded,
+		Classified:       string(classified),
+		Faulty:           total.Faulty,
+		BytesTransferred: total.BytesTransferred,
+		Retries:          total.Retries,
+		Boards:           string(boardsJson),
+	}
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	total *counters
+	board *counters
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.total.bytesTransferred.Add(int64(n))
+	c.board.bytesTransferred.Add(int64(n))
+	return n, err
+}
+
+// PrintRunSummary prints the counters of a run, in total and per board
+func PrintRunSummary(r *db.Run) {
+	finished := "unfinished"
+	duration := ""
+	if r.FinishedAt != nil {
+		finished = r.FinishedAt.UTC().Format(time.RFC3339)
+		duration = fmt.Sprintf(" (%v)", r.FinishedAt.Sub(r.StartedAt).Round(time.Second))
+	}
+
+	exitReason := r.ExitReason
+	if exitReason == "" {
+		exitReason = "none"
+	}
+
+	fmt.Printf("Run %v: %v - %v%v; exit reason: %v; seeds: %v\n",
+		r.ID, r.StartedAt.UTC().Format(time.RFC3339), finished, duration, exitReason, r.SeedHrefs)
+
+	classified := map[string]int64{}
+	if r.Classified != "" {
+		utils.Check(json.Unmarshal([]byte(r.Classified), &classified))
+	}
+
+	printCounters("  ", db.BoardCounters{
+		Threads:          r.Threads,
+		PagesFetched:     r.PagesFetched,
+		NotFound:         r.NotFound,
+		ImagesDiscovered: r.ImagesDiscovered,
+		SkippedExisting:  r.SkippedExisting,
+		Downloaded:       r.Downloaded,
+		Classified:       classified,
+		Faulty:           r.Faulty,
+		BytesTransferred: r.BytesTransferred,
+		Retries:          r.Retries,
+	})
+
+	boards := map[string]db.BoardCounters{}
+	if r.Boards != "" {
+		utils.Check(json.Unmarshal([]byte(r.Boards), &boards))
+	}
+
+	for _, board := range sortedKeys(boards) {
+		fmt.Printf("  board %v:\n", board)
+		printCounters("    ", boards[board])
+	}
+}
+
+func printCounters(indent string, c db.BoardCounters) {
+	fmt.Printf("%vthreads: %v; pages fetched: %v; 404s: %v; retries: %v; bytes transferred: %v\n",
+		indent, c.Threads, c.PagesFetched, c.NotFound, c.Retries, c.BytesTransferred)
+	fmt.Printf("%vimages discovered: %v; skipped as existing: %v; downloaded: %v; faulty: %v\n",
+		indent, c.ImagesDiscovered, c.SkippedExisting, c.Downloaded, c.Faulty)
+
+	for _, category := range sortedKeys(c.Classified) {
+		fmt.Printf("%vclassified %v: %v\n", indent, category, c.Classified[category])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
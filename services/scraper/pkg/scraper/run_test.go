@@ -0,0 +1,99 @@
+package scraper
+
+import (
+	"encoding/json"
+	"go-find-pepe/pkg/constants"
+	"go-find-pepe/pkg/db"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRunCounters(t *testing.T) {
+	r := newRun()
+	r.threadStarted("g")
+	r.pageFetched("g")
+	r.pageFetched("v")
+	r.pageNotFound("v")
+	r.imagesFound("g", 3)
+	r.imageSkipped("g")
+	r.imageDownloaded("g")
+	r.imageClassified("g", "pepe")
+	r.imageClassified("g", "pepe")
+	r.imageClassified("v", "non-pepe")
+	r.imageFaulty("g")
+	r.requestRetried("v")
+
+	body := r.countBytes("g", io.NopCloser(strings.NewReader("pepe")))
+	if _, err := io.ReadAll(body); err != nil {
+		t.Fatal(err)
+	}
+
+	c := r.counters()
+	if c.Threads != 1 || c.PagesFetched != 2 || c.NotFound != 1 || c.ImagesDiscovered != 3 || c.SkippedExisting != 1 ||
+		c.Downloaded != 1 || c.Faulty != 1 || c.Retries != 1 || c.BytesTransferred != 4 {
+		t.Errorf("counters are %+v", c)
+	}
+	if c.Classified != `{"non-pepe":1,"pepe":2}` {
+		t.Errorf("classified %v; want 2 pepe and 1 non-pepe", c.Classified)
+	}
+
+	boards := map[string]db.BoardCounters{}
+	if err := json.Unmarshal([]byte(c.Boards), &boards); err != nil {
+		t.Fatal(err)
+	}
+	if g := boards["g"]; g.PagesFetched != 1 || g.BytesTransferred != 4 || g.Classified["pepe"] != 2 {
+		t.Errorf("counters of g are %+v", g)
+	}
+	if v := boards["v"]; v.PagesFetched != 1 || v.NotFound != 1 || v.Retries != 1 || v.Classified["non-pepe"] != 1 {
+		t.Errorf("counters of v are %+v", v)
+	}
+}
+
+func TestNilRun(t *testing.T) {
+	var r *run
+	r.pageFetched("g")
+	r.imageClassified("g", "pepe")
+
+	if r.id() != nil {
+		t.Errorf("nil run has id %v", *r.id())
+	}
+
+	body := io.NopCloser(strings.NewReader("pepe"))
+	if r.countBytes("g", body) != body {
+		t.Error("nil run wraps the body")
+	}
+}
+
+func TestImageClassifiedCountsFaultyOnce(t *testing.T) {
+	r := newRun()
+	r.imageClassified("g", "pepe")
+	r.imageClassified("g", constants.CATEGORY_FAULTY)
+	r.imageClassified("v", constants.CATEGORY_FAULTY)
+
+	tests := []struct {
+		name       string
+		c          *counters
+		faulty     int64
+		classified map[string]int64
+	}{
+		{"total", r.total, 2, map[string]int64{"pepe": 1}},
+		{"g", r.peek("g"), 1, map[string]int64{"pepe": 1}},
+		{"v", r.peek("v"), 1, map[string]int64{}},
+	}
+
+	for _, test := range tests {
+		if got := test.c.faulty.Load(); got != test.faulty {
+			t.Errorf("%v: got %v faulty, want %v", test.name, got, test.faulty)
+		}
+		classified := test.c.classifiedCopy()
+		if len(classified) != len(test.classified) {
+			t.Errorf("%v: got classified %v, want %v", test.name, classified, test.classified)
+		}
+		for category, want := range test.classified {
+			if classified[category] != want {
+				t.Errorf("%v: got %v classified %v, want %v", test.name, classified[category], category, want)
+			}
+		}
+	}
+}
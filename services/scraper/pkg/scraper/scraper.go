@@ -1,83 +1,386 @@
 package scraper
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"go-find-pepe/pkg/blob"
+	"go-find-pepe/pkg/canonical"
+	"go-find-pepe/pkg/classifier"
+	"go-find-pepe/pkg/constants"
 	"go-find-pepe/pkg/db"
 	"go-find-pepe/pkg/environment"
+	"go-find-pepe/pkg/limit"
+	"go-find-pepe/pkg/metrics"
+	"go-find-pepe/pkg/phash"
+	"go-find-pepe/pkg/retry"
+	"go-find-pepe/pkg/scope"
+	"go-find-pepe/pkg/taxonomy"
+	"go-find-pepe/pkg/utils"
+	"math"
+	"os"
+	"strings"
 	"sync"
+	"time"
+)
+
+// NewScraper waits classifierHealthWait for the classifier to become healthy, checking
+// again after classifierHealthBackoff, doubling up to classifierMaxHealthBackoff
+const (
+	classifierHealthWait       = 2 * time.Minute
+	classifierHealthBackoff    = time.Second
+	classifierMaxHealthBackoff = 15 * time.Second
 )
 
 type Scraper struct {
-	htmlScraper  *Html
-	imageScraper *Image
-	wg           *sync.WaitGroup
-	done         *sync.Mutex
+	htmlScraper          *Html
+	apiScraper           *Api
+	imageScraper         *Image
+	discoverySource      string
+	seedHrefs            []string
+	reclassifyCategories []string
+	// time downloads and classifications in flight get to finish once the run is stopped
+	shutdownGrace time.Duration
+	runs          *db.RunDbConnection
+	run           *run
+	quotas        *quotas
+	// json snapshot of the configuration, recorded with every run
+	config string
 }
 
 type NewScraperArguments struct {
 	environment.ScraperEnv
-	AllowedHrefSubstrings  []string
-	RequiredHrefSubstrings []string
-	AllowedImageTypes      []string
 	*db.DbConnection
+	BlobStore  blob.BlobStore
+	Classifier classifier.Classifier
+	// version of the current model; images of other versions are reclassified
+	ClassifierModel string
+	Taxonomy        *taxonomy.Taxonomy
+	// pages that are crawled and images that are downloaded
+	Scope          *scope.Scope
+	PageTypeLimits map[string]PageTypeLimit
+	// quota per board, or AnyBoard
+	BoardQuotas map[string]BoardQuota
+	// sends the requests of every stage; the Client of Fetcher is meant for the
+	// requests of Classifier
+	Fetcher *Fetcher
+	// retry policies and rate limits Fetcher was created with; recorded with the run
+	RetryPolicies *retry.Policies
+	HostRates     *limit.Rates
+	// registry of the metrics of the scraper; may be nil
+	Metrics *metrics.Registry
 }
 
-func NewScraper(arg NewScraperArguments) *Scraper {
-	imageHrefs := make(chan string)
+// NewScraper returns an error if a seed names no board, or the classifier does not
+// become healthy in time
+func NewScraper(ctx context.Context, arg NewScraperArguments) (*Scraper, error) {
+	seedHrefs := make([]string, len(arg.Seeds))
+	for i, seed := range arg.Seeds {
+		href, err := seedHref(seed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed %v; %w", seed, err)
+		}
+		seedHrefs[i] = href
+	}
 
-	mutex := &sync.Mutex{}
-	wg := &sync.WaitGroup{}
+	err := waitForClassifier(ctx, arg.Classifier, classifierHealthWait, classifierHealthBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("classifier is not healthy; %w", err)
+	}
+
+	// identifies the leases of this replica
+	hostname, _ := os.Hostname()
+	worker := fmt.Sprintf("%v-%v", hostname, createUniqueId())
 
-	r := Request{url: fmt.Sprintf("%v/health", arg.VisionApiUrl), reuseConnection: false, method: "GET"}
-	_, _, success := r.Do(1)
-	if !success {
-		panic("Failed to do VISION_API_URL health")
+	registry := arg.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
 	}
 
+	r := newRun()
+	q := newQuotas(arg.BoardQuotas, arg.PageTypeLimits, r)
+	q.usages = arg.InitUsage()
+	fetcher := arg.Fetcher
+	canonicalizer := canonical.Default()
+
+	jobs := arg.InitJob()
+	downloads := &jobQueue{kind: constants.JOB_IMAGE_DOWNLOAD, worker: worker, leaseTimeout: arg.LeaseTimeout, db: jobs, excludedBoards: q.exhaustedBoards}
+	classifications := &jobQueue{kind: constants.JOB_CLASSIFY, worker: worker, leaseTimeout: arg.LeaseTimeout, db: jobs}
+
 	html := &Html{
-		allowedHrefSubstrings:  arg.AllowedHrefSubstrings,
-		requiredHrefSubstrings: arg.RequiredHrefSubstrings,
-		wg:                     wg,
-		done:                   mutex,
-		imageHrefs:             imageHrefs,
-		htmlLimit:              arg.HtmlLimit,
-		db:                     arg.InitHtml(),
+		scope:          arg.Scope,
+		fetcher:        fetcher,
+		downloads:      downloads,
+		canonicalizer:  canonicalizer,
+		run:            r,
+		quotas:         q,
+		htmlLimit:      arg.HtmlLimit,
+		traversal:      arg.Traversal,
+		maxDepth:       int(arg.MaxDepth),
+		pageTypeLimits: arg.PageTypeLimits,
+		revisitAfter:   arg.FrontierRevisitAfter,
+		worker:         worker,
+		leaseTimeout:   arg.LeaseTimeout,
+		db:             arg.InitHtml(),
+		frontier:       arg.InitFrontier(),
+		store:          arg.BlobStore,
+	}
+	api := &Api{
+		apiUrl:   ApiUrl,
+		imageUrl: ApiImageUrl,
+		fetcher:  fetcher,
+		discover: func(ctx context.Context, hrefs []*imageHref) error {
+			return discoverImages(ctx, downloads, r, hrefs)
+		},
+		canonicalizer: canonicalizer,
+		run:           r,
+		quotas:        q,
+		threadLimit:   arg.HtmlLimit,
 	}
 	image := &Image{
-		allowedImageTypes: arg.AllowedImageTypes,
-		visionApiUrl:      arg.VisionApiUrl,
-		wg:                wg,
-		done:              mutex,
-		imageHrefs:        imageHrefs,
-		imageLimit:        arg.ImageLimit,
-		classifyLimit:     arg.ClassifyLimit,
+		scope:             arg.Scope,
+		classifier:        arg.Classifier,
+		fetcher:           fetcher,
+		downloads:         downloads,
+		classifications:   classifications,
+		run:               r,
+		quotas:            q,
+		downloadLimiter:   newStageLimiter("downloads", arg.ImageLimit, arg.AdaptiveLimits, registry),
+		classifyLimiter:   newStageLimiter("classifications", arg.ClassifyLimit, arg.AdaptiveLimits, registry),
+		classifyBatchSize: int(arg.ClassifyBatchSize),
+		classifyBatchWait: arg.ClassifyBatchWait,
+		model:             arg.ClassifierModel,
+		taxonomy:          arg.Taxonomy,
 		db:                arg.InitImage(),
+		store:             arg.BlobStore,
+		hashes:            phash.NewBKTree(),
+		maxHashDistance:   int(arg.MaxHashDistance),
+	}
+	err = image.loadPerceptualHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load perceptual hashes; %w", err)
 	}
 
+	fmt.Printf("Scraping as worker %v\n", worker)
+
 	return &Scraper{
-		imageScraper: image,
-		htmlScraper:  html,
-		wg:           wg,
-		done:         mutex,
+		imageScraper:         image,
+		htmlScraper:          html,
+		apiScraper:           api,
+		discoverySource:      arg.DiscoverySource,
+		seedHrefs:            seedHrefs,
+		reclassifyCategories: arg.ReclassifyCategories,
+		shutdownGrace:        arg.ShutdownGrace,
+		runs:                 arg.InitRun(),
+		run:                  r,
+		quotas:               q,
+		config:               configSnapshot(arg),
+	}, nil
+}
+
+// waitForClassifier waits until c is healthy, checking again after backoff, which
+// doubles every time; returns the last health error once wait passed, or the error
+// of ctx once ctx is done
+func waitForClassifier(ctx context.Context, c classifier.Classifier, wait time.Duration, backoff time.Duration) error {
+	deadline := time.Now().Add(wait)
+
+	for {
+		err := c.Health(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		fmt.Printf("Classifier is not healthy; checking again in %v; %v\n", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > classifierMaxHealthBackoff {
+			backoff = classifierMaxHealthBackoff
+		}
+	}
+}
+
+// newStageLimiter caps the concurrency of stage at max, -1 being uncapped; an
+// adaptive limiter starts halfway and adapts up to max
+func newStageLimiter(stage string, max int8, adaptive bool, registry *metrics.Registry) limit.Limiter {
+	if !adaptive {
+		return limit.NewLimiter(max)
 	}
+
+	if max == -1 {
+		max = math.MaxInt8
+	}
+
+	return limit.NewAdaptiveLimiter(limit.AdaptiveArguments{
+		Name:    stage,
+		Initial: int(max) / 2,
+		Min:     1,
+		Max:     int(max),
+		Gauge:   registry.NewGauge("scraper_concurrency_limit", "Current concurrency limit of an adaptively limited stage", "stage"),
+	})
+}
+
+// configSnapshot returns the configuration of the scraper as json
+func configSnapshot(arg NewScraperArguments) string {
+	config, err := json.Marshal(struct {
+		environment.ScraperEnv
+		ClassifierModel string
+		Taxonomy        *taxonomy.Taxonomy
+		Scope           *scope.Scope
+		PageTypeLimits  map[string]PageTypeLimit
+		BoardQuotas     map[string]BoardQuota
+		RetryPolicies   *retry.Policies
+		HostRates       *limit.Rates
+	}{
+		ScraperEnv:      arg.ScraperEnv,
+		ClassifierModel: arg.ClassifierModel,
+		Taxonomy:        arg.Taxonomy,
+		Scope:           arg.Scope,
+		PageTypeLimits:  arg.PageTypeLimits,
+		BoardQuotas:     arg.BoardQuotas,
+		RetryPolicies:   arg.RetryPolicies,
+		HostRates:       arg.HostRates,
+	})
+	utils.Check(err)
+	return string(config)
 }
 
-func (s *Scraper) Start(startHref string) *Scraper {
+// begin records the start of a run from seedHrefs
+func (s *Scraper) begin(ctx context.Context, seedHrefs []string) {
+	seeds, err := json.Marshal(seedHrefs)
+	utils.Check(err)
+
+	tx := s.runs.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	r, err := tx.Create(db.NewRun{
+		StartedAt: s.run.begin(),
+		SeedHrefs: string(seeds),
+		Config:    s.config,
+	})
+	utils.Check(err)
+
+	s.run.ID = r.ID
+	fmt.Printf("Started run %v\n", r.ID)
+}
+
+// Finish records exitReason and the counters of the run, and prints its summary
+func (s *Scraper) Finish(ctx context.Context, exitReason string) {
+	if s.run.ID == 0 {
+		return
+	}
+
+	tx := s.runs.CreateTransaction(ctx)
+	defer tx.Deferral()
+
+	utils.Check(tx.Finish(s.run.ID, exitReason, s.run.counters()))
+
+	r, err := tx.FindOneByID(s.run.ID)
+	utils.Check(err)
+	PrintRunSummary(r)
+}
+
+// Start discovers and classifies the images reachable from the seeds; a seed is either
+// a url or the name of a board, e.g. g for https://boards.4chan.org/g/. Cancelling
+// ctx stops discovery at once and gives downloads and classifications in flight
+// the shutdown grace to finish; the remaining work stays pending in the database
+func (s *Scraper) Start(ctx context.Context) *Scraper {
 	wg := &sync.WaitGroup{}
 	wgU := WaitGroupHelper{WaitGroup: wg}
 
-	s.done.Lock()
+	work, cancelWork := withGrace(ctx, s.shutdownGrace)
+	defer cancelWork()
+
+	s.begin(ctx, s.seedHrefs)
+
+	stopSyncing := s.quotas.keepSyncing(work)
+	defer stopSyncing()
 
-	s.wg.Add(2)
+	// closed once discovery enqueued every image download
+	discovered := make(chan bool)
 
 	wgU.Wrapper(func() {
-		s.htmlScraper.Start(startHref)
+		defer close(discovered)
+		if s.discoverySource == DiscoverySourceHtml {
+			s.htmlScraper.Start(ctx, work, s.seedHrefs)
+			return
+		}
+
+		apiWg := &sync.WaitGroup{}
+		apiWgU := WaitGroupHelper{WaitGroup: apiWg}
+		for _, href := range s.seedHrefs {
+			href := href
+			apiWgU.Wrapper(func() {
+				s.apiScraper.Start(ctx, work, href)
+			})
+		}
+		apiWg.Wait()
+	})
+	wgU.Wrapper(func() {
+		s.imageScraper.Start(ctx, work, discovered)
 	})
-	wgU.Wrapper(s.imageScraper.Start)
 
-	s.wg.Wait()
-	s.done.Unlock()
 	wg.Wait()
 
 	return s
 }
+
+// seedHref returns the url of the board seed names, or seed if it is a url; returns
+// an error if the url has no board
+func seedHref(seed string) (string, error) {
+	href := seed
+	if !strings.Contains(seed, "/") {
+		href = fmt.Sprintf("https://boards.4chan.org/%v/", seed)
+	}
+
+	_, err := extractBoardFromHref(href)
+	if err != nil {
+		return "", err
+	}
+	return href, nil
+}
+
+// Reclassify classifies stored images of an older model, or in one of the
+// configured categories, again without discovering new images
+func (s *Scraper) Reclassify(ctx context.Context) *Scraper {
+	work, cancelWork := withGrace(ctx, s.shutdownGrace)
+	defer cancelWork()
+
+	s.begin(ctx, []string{})
+	s.imageScraper.Reclassify(ctx, work, s.reclassifyCategories)
+	return s
+}
+
+// withGrace returns a context that is done grace after ctx is done, so work in
+// flight may finish after ctx stopped new work
+func withGrace(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	go func() {
+		select {
+		case <-work.Done():
+			return
+		case <-ctx.Done():
+		}
+
+		fmt.Printf("Stopping; giving work in flight %v to finish\n", grace)
+		select {
+		case <-work.Done():
+		case <-time.After(grace):
+			fmt.Println("Shutdown grace expired; interrupting work in flight")
+			cancel()
+		}
+	}()
+
+	return work, cancel
+}
@@ -0,0 +1,105 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"go-find-pepe/pkg/classifier"
+	"testing"
+	"time"
+)
+
+// unhealthy is the fake classifier that is not healthy for its first checks
+type unhealthy struct {
+	classifier.Classifier
+	checks int
+}
+
+func (c *unhealthy) Health(ctx context.Context) error {
+	if c.checks > 0 {
+		c.checks--
+		return errors.New("starting")
+	}
+	return c.Classifier.Health(ctx)
+}
+
+func TestWaitForClassifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks int
+		wait   time.Duration
+		ok     bool
+	}{
+		{"healthy", 0, 0, true},
+		{"healthy after backoff", 2, time.Second, true},
+		{"unhealthy", 100, 20 * time.Millisecond, false},
+	}
+
+	for _, test := range tests {
+		c := &unhealthy{Classifier: classifier.NewFake(), checks: test.checks}
+		err := waitForClassifier(context.Background(), c, test.wait, time.Millisecond)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: returned %v", test.name, err)
+		}
+	}
+}
+
+func TestWaitForClassifierCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := waitForClassifier(ctx, classifier.NewFake(), time.Minute, time.Millisecond)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("returned %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestSeedHref(t *testing.T) {
+	tests := []struct {
+		seed string
+		want string
+		ok   bool
+	}{
+		{"g", "https://boards.4chan.org/g/", true},
+		{"https://boards.4chan.org/v/catalog", "https://boards.4chan.org/v/catalog", true},
+		{"https://boards.4chan.org/", "", false},
+		{"://", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := seedHref(test.seed)
+		if got != test.want || (err == nil) != test.ok {
+			t.Errorf("%v: got %v, %v; want %v", test.seed, got, err, test.want)
+		}
+	}
+}
+
+func TestWithGrace(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	work, cancel := withGrace(ctx, 20*time.Millisecond)
+	defer cancel()
+
+	stop()
+	select {
+	case <-work.Done():
+		t.Fatal("work was done as soon as ctx was done")
+	case <-time.After(5 * time.Millisecond):
+	}
+
+	select {
+	case <-work.Done():
+	case <-time.After(time.Second):
+		t.Fatal("work was not done after the grace")
+	}
+}
+
+func TestWithGraceCancel(t *testing.T) {
+	work, cancel := withGrace(context.Background(), time.Hour)
+	if work.Err() != nil {
+		t.Fatalf("work is done before ctx; %v", work.Err())
+	}
+
+	cancel()
+	if work.Err() == nil {
+		t.Error("work is not done once cancelled")
+	}
+}
@@ -2,7 +2,6 @@ package scraper
 
 import (
 	"fmt"
-	"io"
 	"path/filepath"
 	"runtime/debug"
 	"strings"
@@ -25,9 +24,11 @@ func writeToPanicFile() {
 		path := filepath.Join(getProjectPath(), ErrorDirectory, "panic", time.Now().UTC().String()+".txt")
 
 		stack := string(debug.Stack()[:])
-		file := io.NopCloser(strings.NewReader(fmt.Sprintf("%v\n%v", stack, err)))
+		file := strings.NewReader(fmt.Sprintf("%v\n%v", stack, err))
 
-		writeFile(path, file)
+		if writeErr := writeFile(path, file); writeErr != nil {
+			fmt.Printf("Failed to write panic file; %v\n", writeErr)
+		}
 
 		panic(err)
 	}
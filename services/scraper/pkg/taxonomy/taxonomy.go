@@ -0,0 +1,108 @@
+package taxonomy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-find-pepe/pkg/constants"
+)
+
+// Band assigns Category to every score of at least Min
+type Band struct {
+	Min      float32 `json:"min"`
+	Category string  `json:"category"`
+}
+
+// Rule maps the score of one label onto a category; bands are tried in order
+type Rule struct {
+	Label string `json:"label"`
+	Bands []Band `json:"bands"`
+}
+
+// Taxonomy maps classifier scores onto categories; rules are tried in order and
+// the first matching band wins; Fallback is used if no band matches
+type Taxonomy struct {
+	Rules    []Rule `json:"rules"`
+	Fallback string `json:"fallback"`
+}
+
+// Default is the original pepe/maybe/non-pepe rule set
+func Default() *Taxonomy {
+	return &Taxonomy{
+		Rules: []Rule{
+			{
+				Label: "pepe",
+				Bands: []Band{
+					{Min: 0.9, Category: constants.CATEGORY_PEPE},
+					{Min: 0.3, Category: constants.CATEGORY_MAYBE},
+				},
+			},
+		},
+		Fallback: constants.CATEGORY_NON_PEPE,
+	}
+}
+
+// Parse reads a taxonomy from json; an empty string results in Default
+func Parse(raw string) (*Taxonomy, error) {
+	if raw == "" {
+		return Default(), nil
+	}
+
+	t := &Taxonomy{}
+	err := json.Unmarshal([]byte(raw), t)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, t.validate()
+}
+
+func (t *Taxonomy) validate() error {
+	if t.Fallback == "" {
+		return errors.New("taxonomy without fallback category")
+	}
+
+	for _, rule := range t.Rules {
+		if rule.Label == "" {
+			return errors.New("taxonomy rule without label")
+		}
+
+		for _, band := range rule.Bands {
+			if band.Category == "" {
+				return fmt.Errorf("taxonomy band of label %v without category", rule.Label)
+			}
+
+			if band.Category == constants.CATEGORY_UNCLASSIFIED || band.Category == constants.CATEGORY_FAULTY {
+				return fmt.Errorf("taxonomy category %v is reserved", band.Category)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Categorize returns the category of scores and the score that decided it; for the
+// fallback that is the score of the first rule whose label is present
+func (t *Taxonomy) Categorize(scores map[string]float32) (category string, score float32) {
+	found := false
+
+	for _, rule := range t.Rules {
+		s, ok := scores[rule.Label]
+		if !ok {
+			continue
+		}
+
+		if !found {
+			score = s
+			found = true
+		}
+
+		for _, band := range rule.Bands {
+			if s >= band.Min {
+				return band.Category, s
+			}
+		}
+	}
+
+	return t.Fallback, score
+}
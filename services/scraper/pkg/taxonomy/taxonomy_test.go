@@ -0,0 +1,79 @@
+package taxonomy
+
+import (
+	"go-find-pepe/pkg/constants"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw     string
+		wantErr bool
+	}{
+		{``, false},
+		{`{"rules": [{"label": "pepe", "bands": [{"min": 0.5, "category": "pepe"}]}], "fallback": "other"}`, false},
+		{`{"rules": [], "fallback": "other"}`, false},
+		{`{"rules": [`, true},
+		{`[]`, true},
+		{`{"rules": []}`, true},
+		{`{"rules": [{"bands": [{"min": 0.5, "category": "pepe"}]}], "fallback": "other"}`, true},
+		{`{"rules": [{"label": "pepe", "bands": [{"min": 0.5}]}], "fallback": "other"}`, true},
+		{`{"rules": [{"label": "pepe", "bands": [{"min": 0.5, "category": "unclassified"}]}], "fallback": "other"}`, true},
+		{`{"rules": [{"label": "pepe", "bands": [{"min": 0.5, "category": "faulty"}]}], "fallback": "other"}`, true},
+	}
+
+	for _, test := range tests {
+		taxonomy, err := Parse(test.raw)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.raw, err, test.wantErr)
+		}
+		if err == nil && taxonomy == nil {
+			t.Errorf("%q: got no taxonomy", test.raw)
+		}
+	}
+}
+
+func TestParseEmptyIsDefault(t *testing.T) {
+	taxonomy, err := Parse("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if category, _ := taxonomy.Categorize(map[string]float32{"pepe": 0.95}); category != constants.CATEGORY_PEPE {
+		t.Errorf("got %v, want %v", category, constants.CATEGORY_PEPE)
+	}
+}
+
+func TestCategorize(t *testing.T) {
+	taxonomy := &Taxonomy{
+		Rules: []Rule{
+			{Label: "pepe", Bands: []Band{{Min: 0.9, Category: "pepe"}, {Min: 0.3, Category: "maybe"}}},
+			{Label: "wojak", Bands: []Band{{Min: 0.8, Category: "wojak"}}},
+		},
+		Fallback: "other",
+	}
+
+	tests := []struct {
+		name         string
+		scores       map[string]float32
+		wantCategory string
+		wantScore    float32
+	}{
+		{"first band", map[string]float32{"pepe": 0.95, "wojak": 0.99}, "pepe", 0.95},
+		{"first band at its minimum", map[string]float32{"pepe": 0.9}, "pepe", 0.9},
+		{"second band", map[string]float32{"pepe": 0.5, "wojak": 0.99}, "maybe", 0.5},
+		{"second rule", map[string]float32{"pepe": 0.1, "wojak": 0.85}, "wojak", 0.85},
+		{"missing first label", map[string]float32{"wojak": 0.85}, "wojak", 0.85},
+		{"fallback with score of first rule", map[string]float32{"pepe": 0.1, "wojak": 0.2}, "other", 0.1},
+		{"fallback with score of first present rule", map[string]float32{"wojak": 0.2}, "other", 0.2},
+		{"fallback without labels", map[string]float32{"cat": 0.99}, "other", 0},
+		{"fallback without scores", nil, "other", 0},
+	}
+
+	for _, test := range tests {
+		category, score := taxonomy.Categorize(test.scores)
+		if category != test.wantCategory || score != test.wantScore {
+			t.Errorf("%v: got %v %v, want %v %v", test.name, category, score, test.wantCategory, test.wantScore)
+		}
+	}
+}
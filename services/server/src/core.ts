@@ -7,8 +7,9 @@ export class Core {
     autoBind(this);
   }
 
-  dbFileNameToPublicURL(p: string) {
-    const fileName = path.basename(p);
+  dbFileNameToPublicURL(key: string) {
+    // keys are relative to the data directory, e.g. image/ab/cd/<sha256>.jpg
+    const fileName = key.replace(/^image\//, "");
     const filePath = path.join(PUBLIC_SERVE_LOCATION, fileName);
 
     return filePath;